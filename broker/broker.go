@@ -20,6 +20,8 @@ import (
 	"github.com/celrenheit/sandflake"
 	"github.com/sandglass/sandglass"
 	"github.com/sandglass/sandglass/raft"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/encrypted"
 	"github.com/hashicorp/serf/serf"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -45,20 +47,53 @@ func init() {
 }
 
 type Config struct {
-	Name                    string        `yaml:"name,omitempty"`
-	DCName                  string        `yaml:"dc_name,omitempty"`
-	BindAddr                string        `yaml:"bind_addr,omitempty"`
-	AdvertiseAddr           string        `yaml:"advertise_addr,omitempty"`
-	DBPath                  string        `yaml:"data,omitempty"`
-	GossipPort              string        `yaml:"gossip_port,omitempty"`
-	HTTPPort                string        `yaml:"http_port,omitempty"`
-	GRPCPort                string        `yaml:"grpc_port,omitempty"`
-	RaftPort                string        `yaml:"raft_port,omitempty"`
-	InitialPeers            []string      `yaml:"initial_peers,omitempty"`
-	BootstrapRaft           bool          `yaml:"bootstrap_raft,omitempty"`
-	PProfPort               string        `yaml:"pprof_port,omitempty"`
-	LoggingLevel            *logrus.Level `yaml:"-"`
-	OffsetReplicationFactor int           `yaml:"-"`
+	Name                    string          `yaml:"name,omitempty"`
+	DCName                  string          `yaml:"dc_name,omitempty"`
+	BindAddr                string          `yaml:"bind_addr,omitempty"`
+	AdvertiseAddr           string          `yaml:"advertise_addr,omitempty"`
+	DBPath                  string          `yaml:"data,omitempty"`
+	GossipPort              string          `yaml:"gossip_port,omitempty"`
+	HTTPPort                string          `yaml:"http_port,omitempty"`
+	GRPCPort                string          `yaml:"grpc_port,omitempty"`
+	RaftPort                string          `yaml:"raft_port,omitempty"`
+	InitialPeers            []string        `yaml:"initial_peers,omitempty"`
+	BootstrapRaft           bool            `yaml:"bootstrap_raft,omitempty"`
+	PProfPort               string          `yaml:"pprof_port,omitempty"`
+	EncryptionKeyfile       string          `yaml:"encryption_keyfile,omitempty"`
+	EncryptionKeyring       string          `yaml:"encryption_keyring,omitempty"`
+	Storage                 storage.Options `yaml:"storage,omitempty"`
+	LoggingLevel            *logrus.Level   `yaml:"-"`
+	OffsetReplicationFactor int             `yaml:"-"`
+	// MinInSyncReplicas is how many replicas must hold a message before the HW mark
+	// moves past it, 0 means all the replicas of the partition
+	MinInSyncReplicas int `yaml:"min_insync_replicas,omitempty"`
+}
+
+// DataDir returns the directory holding the raft state and the topics
+func (conf *Config) DataDir() string {
+	return filepath.Join(conf.DBPath, "data")
+}
+
+// LoadKeyring loads the keys of encrypted topics, nil is returned when none is configured
+func (conf *Config) LoadKeyring() (*encrypted.Keyring, error) {
+	switch {
+	case conf.EncryptionKeyfile != "" && conf.EncryptionKeyring != "":
+		return nil, errors.New("only one of encryption keyfile or keyring directory should be specified")
+	case conf.EncryptionKeyfile != "":
+		k, err := encrypted.LoadKeyfile(conf.EncryptionKeyfile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load encryption keyfile")
+		}
+		return k, nil
+	case conf.EncryptionKeyring != "":
+		k, err := encrypted.LoadKeyringDir(conf.EncryptionKeyring)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load encryption keyring")
+		}
+		return k, nil
+	}
+
+	return nil, nil
 }
 
 type Broker struct {
@@ -79,6 +114,7 @@ type Broker struct {
 	readyListeners []chan interface{}
 	wg             sync.WaitGroup
 	raft           *raft.Store
+	keyring        *encrypted.Keyring
 
 	reconcileCh chan serf.Member
 
@@ -111,6 +147,11 @@ func New(conf *Config) (*Broker, error) {
 		}()
 	}
 
+	keyring, err := conf.LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+
 	level := logrus.InfoLevel
 	if conf.LoggingLevel != nil {
 		level = *conf.LoggingLevel
@@ -127,6 +168,7 @@ func New(conf *Config) (*Broker, error) {
 		consumers:    map[string]*ConsumerGroup{},
 		eventEmitter: watchy.New(),
 		reconcileCh:  make(chan serf.Member, 64),
+		keyring:      keyring,
 	}
 	b.server = NewServer(b, net.JoinHostPort(conf.BindAddr, conf.GRPCPort), net.JoinHostPort(conf.BindAddr, conf.HTTPPort))
 	return b, nil
@@ -321,7 +363,11 @@ func (b *Broker) Bootstrap() error {
 		Name:     b.conf.Name,
 		BindAddr: net.JoinHostPort(b.conf.BindAddr, b.conf.RaftPort),
 		AdvAddr:  net.JoinHostPort(advAddr, b.conf.RaftPort),
-		Dir:      filepath.Join(b.conf.DBPath, "data"),
+		Dir:      b.conf.DataDir(),
+
+		CommittedOffsetFunc: b.lowestCommittedOffset,
+		Keyring:             b.keyring,
+		StorageOptions:      b.conf.Storage,
 	}, b.Entry)
 
 	if err := b.raft.Init(b.conf.BootstrapRaft, cluster, b.reconcileCh); err != nil {
@@ -0,0 +1,498 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/topic"
+)
+
+// number of bytes of backup data sent per chunk
+const backupChunkSize = 64 << 10
+
+var topicCreationTimeout = 10 * time.Second
+
+// backup sends the config of the requested topics, all of them except the consumer offsets when none is set,
+// followed by the backup of each of their partitions. Partitions are backed up by their leader up to their
+// HW mark, each one from a snapshot of its storage.
+func (b *Broker) backup(ctx context.Context, req *sgproto.BackupRequest, fn func(chunk *sgproto.BackupChunk) error) error {
+	names := req.Topics
+	if len(names) == 0 {
+		for _, t := range b.raft.GetTopics() {
+			if t.Name != ConsumerOffsetTopicName {
+				names = append(names, t.Name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	topics := make([]*topic.Topic, 0, len(names))
+	for _, name := range names {
+		t := b.getTopic(name)
+		if t == nil {
+			return ErrTopicNotFound
+		}
+		topics = append(topics, t)
+	}
+
+	for _, t := range topics {
+		b.WithField("topic", t.Name).Debugf("backing up topic")
+		if err := fn(&sgproto.BackupChunk{Topic: topicConfig(t)}); err != nil {
+			return err
+		}
+
+		for _, p := range t.ListPartitions() {
+			hwMark := b.raft.GetHWMark(t.Name, p.Id)
+			err := fn(&sgproto.BackupChunk{
+				Partition: p.Id,
+				HwMark:    hwMark,
+			})
+			if err != nil {
+				return err
+			}
+
+			leader := b.getPartitionLeader(t.Name, p.Id)
+			if leader == nil {
+				return ErrNoLeaderFound
+			}
+
+			if leader.Name == b.Name() {
+				if err := b.backupPartition(t.Name, p.Id, hwMark, fn); err != nil {
+					return err
+				}
+				continue
+			}
+
+			stream, err := leader.BackupPartition(ctx, &sgproto.BackupPartitionRequest{
+				Topic:     t.Name,
+				Partition: p.Id,
+				HwMark:    hwMark,
+			})
+			if err != nil {
+				return err
+			}
+
+			for {
+				chunk, err := stream.Recv()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+
+				if err := fn(chunk); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *Broker) backupPartition(topicName, partition string, hwMark uint64, fn func(chunk *sgproto.BackupChunk) error) error {
+	t := b.getTopic(topicName)
+	if t == nil {
+		return ErrTopicNotFound
+	}
+
+	p := t.GetPartition(partition)
+	if p == nil {
+		return ErrPartitionNotFound
+	}
+
+	w := bufio.NewWriterSize(chunkWriter(fn), backupChunkSize)
+	if err := p.Backup(w, hwMark); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// restore creates the topics of a backup with their partitions and copies the backup of each
+// partition to all of its replicas. The topics should not exist yet.
+func (b *Broker) restore(ctx context.Context, recv func() (*sgproto.BackupChunk, error)) (res *sgproto.RestoreReply, err error) {
+	// cancelling stops the restores of the remote replicas
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res = &sgproto.RestoreReply{}
+	var (
+		t *topic.Topic
+		r *partitionRestore
+	)
+
+	defer func() {
+		if err != nil && r != nil {
+			r.Abort(err)
+		}
+	}()
+
+	finish := func() error {
+		if r == nil {
+			return nil
+		}
+		err := r.Close()
+		if err == nil {
+			err = r.setHWMark(ctx, b)
+		}
+		r = nil
+		return err
+	}
+
+	for {
+		chunk, err := recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case chunk.Topic != nil:
+			if err := finish(); err != nil {
+				return nil, err
+			}
+
+			t, err = b.restoreTopic(ctx, chunk.Topic)
+			if err != nil {
+				return nil, err
+			}
+			res.Topics = append(res.Topics, t.Name)
+		case chunk.Partition != "":
+			if err := finish(); err != nil {
+				return nil, err
+			}
+
+			if t == nil {
+				return nil, storage.ErrInvalidBackup
+			}
+
+			r, err = b.newPartitionRestore(ctx, t, chunk.Partition, chunk.HwMark)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if r == nil {
+				return nil, storage.ErrInvalidBackup
+			}
+
+			if err := r.Write(chunk.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := finish(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (b *Broker) restoreTopic(ctx context.Context, config *sgproto.TopicConfig) (*topic.Topic, error) {
+	if b.getTopic(config.Name) != nil {
+		return nil, ErrTopicAlreadyExist
+	}
+
+	b.WithField("topic", config.Name).Debugf("restoring topic")
+	created := b.eventEmitter.Once("topics:created:" + config.Name)
+	if _, err := b.CreateTopic(ctx, config); err != nil {
+		return nil, err
+	}
+
+	return b.waitForTopic(config.Name, created)
+}
+
+// waitForTopic waits until the topic is known by this broker, created should be registered before the topic is created
+func (b *Broker) waitForTopic(name string, created chan interface{}) (*topic.Topic, error) {
+	if t := b.getTopic(name); t != nil {
+		return t, nil
+	}
+
+	select {
+	case <-created:
+	case <-time.After(topicCreationTimeout):
+		return nil, fmt.Errorf("timed out creating topic: %v", name)
+	}
+
+	t := b.getTopic(name)
+	if t == nil {
+		return nil, ErrTopicNotFound
+	}
+	return t, nil
+}
+
+// restorePartition restores the backup of a partition held by this broker, the first chunk names the partition
+// and holds the HW mark it was backed up to
+func (b *Broker) restorePartition(recv func() (*sgproto.BackupChunk, error)) (*sgproto.RestoreReply, error) {
+	header, err := recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Topic == nil || header.Partition == "" {
+		return nil, storage.ErrInvalidBackup
+	}
+
+	// the topic might not be created on this broker yet
+	t, err := b.waitForTopic(header.Topic.Name, b.eventEmitter.Once("topics:created:"+header.Topic.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	p := t.GetPartition(header.Partition)
+	if p == nil {
+		return nil, ErrPartitionNotFound
+	}
+
+	if err := p.Restore(&chunkReader{recv: recv}, header.HwMark); err != nil {
+		return nil, err
+	}
+
+	return &sgproto.RestoreReply{Topics: []string{t.Name}}, nil
+}
+
+// partitionRestore copies the backup of a partition to each of its replicas as it is received
+type partitionRestore struct {
+	topic     string
+	partition string
+	hwMark    uint64
+	writers   []restoreWriter
+}
+
+type restoreWriter interface {
+	Write(data []byte) error
+	Close() error
+	Abort(err error)
+}
+
+func (b *Broker) newPartitionRestore(ctx context.Context, t *topic.Topic, partition string, hwMark uint64) (*partitionRestore, error) {
+	p := t.GetPartition(partition)
+	if p == nil {
+		return nil, ErrPartitionNotFound
+	}
+
+	r := &partitionRestore{
+		topic:     t.Name,
+		partition: p.Id,
+		hwMark:    hwMark,
+	}
+	for _, replica := range p.Replicas {
+		if replica == b.Name() {
+			r.writers = append(r.writers, newLocalRestore(p, hwMark))
+			continue
+		}
+
+		node := b.getNode(replica)
+		if node == nil {
+			r.Abort(ErrReplicaNotFound)
+			return nil, ErrReplicaNotFound
+		}
+
+		stream, err := node.RestorePartition(ctx)
+		if err != nil {
+			r.Abort(err)
+			return nil, err
+		}
+
+		err = stream.Send(&sgproto.BackupChunk{
+			Topic:     &sgproto.TopicConfig{Name: t.Name},
+			Partition: p.Id,
+			HwMark:    hwMark,
+		})
+		if err != nil {
+			r.Abort(err)
+			return nil, err
+		}
+
+		r.writers = append(r.writers, &remoteRestore{stream: stream})
+	}
+
+	return r, nil
+}
+
+func (r *partitionRestore) Write(data []byte) error {
+	for _, w := range r.writers {
+		if err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort stops the restore of every replica, the entries already written are kept
+func (r *partitionRestore) Abort(err error) {
+	for _, w := range r.writers {
+		w.Abort(err)
+	}
+}
+
+// setHWMark moves the HW mark of the partition to the one of the backup once every replica holds it,
+// so that the restored messages are readable right away
+func (r *partitionRestore) setHWMark(ctx context.Context, b *Broker) error {
+	if r.hwMark == 0 {
+		return nil
+	}
+
+	_, err := b.SetHWMark(ctx, &sgproto.SetHWMarkRequest{
+		Topic:     r.topic,
+		Partition: r.partition,
+		HwMark:    r.hwMark,
+	})
+	return err
+}
+
+// SetHWMark moves the HW mark of a partition forward, the request is forwarded to the controller
+func (b *Broker) SetHWMark(ctx context.Context, req *sgproto.SetHWMarkRequest) (*sgproto.SetHWMarkReply, error) {
+	if !b.IsController() {
+		leader := b.GetController()
+		if leader == nil {
+			return nil, ErrNoLeaderFound
+		}
+		return leader.SetHWMark(ctx, req)
+	}
+
+	t := b.getTopic(req.Topic)
+	if t == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	if t.GetPartition(req.Partition) == nil {
+		return nil, ErrPartitionNotFound
+	}
+
+	err := b.raft.SetPartitionHWMark(map[string]map[string]uint64{
+		req.Topic: {req.Partition: req.HwMark},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sgproto.SetHWMarkReply{}, nil
+}
+
+// Close waits for every replica to be restored
+func (r *partitionRestore) Close() error {
+	var firstErr error
+	for _, w := range r.writers {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type localRestore struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+func newLocalRestore(p *topic.Partition, hwMark uint64) *localRestore {
+	pr, pw := io.Pipe()
+	r := &localRestore{
+		w:    pw,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		err := p.Restore(pr, hwMark)
+		// unblocks the writes when the restore stops early
+		pr.CloseWithError(err)
+		r.done <- err
+	}()
+
+	return r
+}
+
+func (r *localRestore) Write(data []byte) error {
+	_, err := r.w.Write(data)
+	return err
+}
+
+func (r *localRestore) Close() error {
+	r.w.Close()
+	return <-r.done
+}
+
+func (r *localRestore) Abort(err error) {
+	r.w.CloseWithError(err)
+	<-r.done
+}
+
+type remoteRestore struct {
+	stream sgproto.InternalService_RestorePartitionClient
+}
+
+func (r *remoteRestore) Write(data []byte) error {
+	return r.stream.Send(&sgproto.BackupChunk{Data: data})
+}
+
+func (r *remoteRestore) Close() error {
+	_, err := r.stream.CloseAndRecv()
+	return err
+}
+
+// Abort relies on the cancellation of the context of the stream
+func (r *remoteRestore) Abort(err error) {}
+
+// chunkWriter sends the bytes written to it as backup chunks
+type chunkWriter func(chunk *sgproto.BackupChunk) error
+
+func (fn chunkWriter) Write(data []byte) (int, error) {
+	if err := fn(&sgproto.BackupChunk{Data: data}); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// chunkReader reads the data of the backup chunks returned by recv
+type chunkReader struct {
+	recv func() (*sgproto.BackupChunk, error)
+	buf  []byte
+}
+
+func (r *chunkReader) Read(data []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+
+	n := copy(data, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func topicConfig(t *topic.Topic) *sgproto.TopicConfig {
+	config := &sgproto.TopicConfig{
+		Name:                   t.Name,
+		Kind:                   t.Kind,
+		ReplicationFactor:      int32(t.ReplicationFactor),
+		NumPartitions:          int32(t.NumPartitions),
+		StorageDriver:          t.StorageDriver,
+		RetentionMaxAge:        t.RetentionMaxAge,
+		RetentionMaxBytes:      t.RetentionMaxBytes,
+		CompactByKey:           t.CompactByKey,
+		BloomFalsePositiveRate: t.BloomFalsePositiveRate,
+		CompressionCodec:       t.CompressionCodec,
+		Encrypted:              t.Encrypted,
+		StorageOptions:         t.StorageOptions.Proto(),
+		Partitioner:            t.Partitioner,
+		ExpiredChannel:         t.ExpiredChannel,
+	}
+
+	for _, p := range t.ListPartitions() {
+		config.Partitions = append(config.Partitions, p.Id)
+	}
+
+	return config
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/sandglass/sandglass"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/topic"
+)
+
+// Cancel withdraws a delayed message, it returns once the tombstone replacing it is replicated
+// so that consumer groups fetching the message afterwards do not deliver it
+func (b *Broker) Cancel(ctx context.Context, req *sgproto.CancelRequest) (*sgproto.CancelResponse, error) {
+	p, leader, err := b.delayedMessagePartition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	if leader.Name != b.Name() {
+		return leader.Cancel(ctx, req)
+	}
+
+	index, err := p.Cancel(req.Channel, req.Offset, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitHWMark(ctx, p, index, 0); err != nil {
+		return nil, err
+	}
+
+	return &sgproto.CancelResponse{}, nil
+}
+
+// Reschedule moves a delayed message to a new time, see Cancel
+func (b *Broker) Reschedule(ctx context.Context, req *sgproto.RescheduleRequest) (*sgproto.RescheduleResponse, error) {
+	p, leader, err := b.delayedMessagePartition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	if leader.Name != b.Name() {
+		return leader.Reschedule(ctx, req)
+	}
+
+	msg, err := p.Reschedule(req.Channel, req.Offset, req.ConsumeAt, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitHWMark(ctx, p, msg.Index, 0); err != nil {
+		return nil, err
+	}
+
+	return &sgproto.RescheduleResponse{
+		Offset: msg.Offset,
+	}, nil
+}
+
+func (b *Broker) delayedMessagePartition(topicName, partition string) (*topic.Partition, *sandglass.Node, error) {
+	t := b.getTopic(topicName)
+	if t == nil {
+		return nil, nil, ErrTopicNotFound
+	}
+
+	if t.Kind != sgproto.TopicKind_TimerKind {
+		return nil, nil, topic.ErrNotTimerTopic
+	}
+
+	if partition == "" {
+		return nil, nil, ErrNoPartitionSet
+	}
+
+	p := t.GetPartition(partition)
+	if p == nil {
+		return nil, nil, ErrPartitionNotFound
+	}
+
+	leader := b.getPartitionLeader(t.Name, p.Id)
+	if leader == nil {
+		return nil, nil, ErrNoLeaderFound
+	}
+
+	return p, leader, nil
+}
@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/topic"
+)
+
+var (
+	ErrReplicaNotFound = errors.New("ErrReplicaNotFound")
+)
+
+// compact compacts every replica of the requested partitions, all of them when no partition is set.
+// Each replica compacts its own copy of the partition, up to its own HW mark.
+func (b *Broker) compact(ctx context.Context, req *sgproto.CompactRequest, fn func(progress *sgproto.CompactProgress) error) error {
+	t := b.getTopic(req.Topic)
+	if t == nil {
+		return ErrTopicNotFound
+	}
+
+	if t.Kind != sgproto.TopicKind_KVKind {
+		return topic.ErrCompactionNotSupported
+	}
+
+	partitions := t.ListPartitions()
+	if req.Partition != "" {
+		p := t.GetPartition(req.Partition)
+		if p == nil {
+			return ErrPartitionNotFound
+		}
+		partitions = []*topic.Partition{p}
+	}
+
+	for _, p := range partitions {
+		for _, replica := range p.Replicas {
+			b.WithField("replica", replica).Debugf("compacting partition %s/%s", t.Name, p.Id)
+			if replica == b.Name() {
+				err := b.compactPartition(t.Name, p.Id, fn)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			node := b.getNode(replica)
+			if node == nil {
+				return ErrReplicaNotFound
+			}
+
+			stream, err := node.CompactPartition(ctx, &sgproto.CompactRequest{
+				Topic:     t.Name,
+				Partition: p.Id,
+			})
+			if err != nil {
+				return err
+			}
+
+			for {
+				progress, err := stream.Recv()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+
+				if err := fn(progress); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *Broker) compactPartition(topicName, partition string, fn func(progress *sgproto.CompactProgress) error) error {
+	t := b.getTopic(topicName)
+	if t == nil {
+		return ErrTopicNotFound
+	}
+
+	if partition == "" {
+		return ErrNoPartitionSet
+	}
+
+	p := t.GetPartition(partition)
+	if p == nil {
+		return ErrPartitionNotFound
+	}
+
+	return p.Compact(func(progress *sgproto.CompactProgress) error {
+		progress.Replica = b.Name()
+		return fn(progress)
+	})
+}
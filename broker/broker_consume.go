@@ -2,15 +2,26 @@ package broker
 
 import (
 	"context"
+	"errors"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/raft"
 	"github.com/sandglass/sandglass/storage"
 )
 
+var (
+	ErrFollowNotTimerTopic      = errors.New("ErrFollowNotTimerTopic")
+	ErrInvalidHeartbeatInterval = errors.New("ErrInvalidHeartbeatInterval")
+)
+
+// MinHeartbeatInterval is the shortest interval between the heartbeats of a consume stream
+const MinHeartbeatInterval = 100 * time.Millisecond
+
 func (b *Broker) Consume(ctx context.Context, req *sgproto.ConsumeFromGroupRequest, fn func(msg *sgproto.Message) error) error {
 	offsetTopic := b.getTopic(ConsumerOffsetTopicName)
 	if offsetTopic == nil {
@@ -33,6 +44,14 @@ func (b *Broker) Consume(ctx context.Context, req *sgproto.ConsumeFromGroupReque
 		return ErrTopicNotFound
 	}
 
+	if req.Follow && topic.Kind != sgproto.TopicKind_TimerKind {
+		return ErrFollowNotTimerTopic
+	}
+
+	if req.HeartbeatInterval < 0 || (req.HeartbeatInterval > 0 && req.HeartbeatInterval < MinHeartbeatInterval) {
+		return ErrInvalidHeartbeatInterval
+	}
+
 	if leader.Name != b.Name() {
 		b.WithFields(logrus.Fields{
 			"leader": leader.Name,
@@ -63,24 +82,100 @@ func (b *Broker) Consume(ctx context.Context, req *sgproto.ConsumeFromGroupReque
 	if p == nil {
 		return ErrPartitionNotFound
 	}
+
+	err := b.registerConsumerGroup(ctx, req.Topic, req.Partition, req.Channel, req.ConsumerGroupName)
+	if err != nil {
+		return err
+	}
+
 	cg := b.getConsumerGroup(req.Topic, req.Partition, req.Channel, req.ConsumerGroupName)
-	msgCh, closeCh, err := cg.Consume(req.ConsumerName)
+	msgCh, closeCh, err := cg.Consume(req.ConsumerName, req.Follow, req.Credits)
 	if err != nil {
 		return err
 	}
 
-	for msg := range msgCh {
-		if err := fn(msg); err != nil {
-			close(closeCh)
-			return err
+	var heartbeat <-chan time.Time
+	if req.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(req.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-msgCh:
+			if !ok {
+				return nil
+			}
+
+			if err := fn(msg); err != nil {
+				cg.leave(closeCh)
+				return err
+			}
+		case <-heartbeat:
+			if err := fn(&sgproto.Message{Heartbeat: true}); err != nil {
+				cg.leave(closeCh)
+				return err
+			}
+		case <-ctx.Done():
+			cg.leave(closeCh)
+			return ctx.Err()
 		}
 	}
+}
 
-	return nil
+// WaitDue returns once a message of a timer partition following req.After is due and replicated,
+// it is waited for on the leader of the partition
+func (b *Broker) WaitDue(ctx context.Context, req *sgproto.WaitDueRequest) (*sgproto.WaitDueReply, error) {
+	p, leader, err := b.delayedMessagePartition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	if leader.Name != b.Name() {
+		return leader.WaitDue(ctx, req)
+	}
+
+	if err := p.WaitDue(ctx, req.Channel, req.After); err != nil {
+		return nil, err
+	}
+
+	return &sgproto.WaitDueReply{}, nil
+}
+
+// registerConsumerGroup keeps track of the consumer group in the raft state,
+// this is used to retain messages that are still in flight.
+func (b *Broker) registerConsumerGroup(ctx context.Context, topicName, partition, channel, name string) error {
+	cg := raft.ConsumerGroup{
+		Topic:     topicName,
+		Partition: partition,
+		Channel:   channel,
+		Name:      name,
+	}
+	if b.raft.HasConsumerGroup(cg) {
+		return nil
+	}
+
+	if !b.IsController() {
+		leader := b.GetController()
+		if leader == nil {
+			return ErrNoLeaderFound
+		}
+
+		_, err := leader.RegisterConsumerGroup(ctx, &sgproto.RegisterConsumerGroupRequest{
+			Topic:         topicName,
+			Partition:     partition,
+			Channel:       channel,
+			ConsumerGroup: name,
+		})
+		return err
+	}
+
+	return b.raft.RegisterConsumerGroup(cg)
 }
 
 func (b *Broker) getConsumerGroup(topicName, partition, channel string, name string) *ConsumerGroup {
-	key := strings.Join([]string{topicName, partition, channel, name}, string(storage.Separator))
+	key := consumerGroupKey(topicName, partition, channel, name)
 	c := b.getConsumer(key)
 	if c != nil {
 		return c
@@ -101,3 +196,7 @@ func (b *Broker) getConsumer(key string) *ConsumerGroup {
 
 	return b.consumers[key]
 }
+
+func consumerGroupKey(topicName, partition, channel, name string) string {
+	return strings.Join([]string{topicName, partition, channel, name}, string(storage.Separator))
+}
@@ -8,11 +8,11 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
 	"github.com/sandglass/sandglass/storage"
 	"github.com/sandglass/sandglass/topic"
-	"github.com/grpc/grpc-go/status"
 )
 
 func (b *Broker) FetchRangeFn(ctx context.Context, req *sgproto.FetchRangeRequest, fn func(msg *sgproto.Message) error) error {
@@ -72,9 +72,10 @@ func (b *Broker) fetchFromSync(topicName, partition string, from []byte, fn func
 }
 
 func (b *Broker) EndOfLog(ctx context.Context, req *sgproto.EndOfLogRequest) (*sgproto.EndOfLogReply, error) {
+	// the HW mark skips the replicas that have not created the partition yet
 	topic := b.getTopic(req.Topic)
 	if topic == nil {
-		return nil, ErrTopicNotFound
+		return nil, status.Error(codes.NotFound, ErrTopicNotFound.Error())
 	}
 
 	if req.Partition == "" {
@@ -82,6 +83,10 @@ func (b *Broker) EndOfLog(ctx context.Context, req *sgproto.EndOfLogRequest) (*s
 	}
 
 	p := topic.GetPartition(req.Partition)
+	if p == nil {
+		return nil, status.Error(codes.NotFound, ErrPartitionNotFound.Error())
+	}
+
 	var index uint64
 	msg, err := p.EndOfLog()
 	if err != nil {
@@ -3,9 +3,12 @@ package broker
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
 	"github.com/sandglass/sandglass/sgutils"
@@ -110,7 +113,10 @@ func (b *Broker) leaderLoop(leaderStop chan struct{}) {
 	rearrangeTimer := time.NewTicker(15 * time.Second)
 	defer rearrangeTimer.Stop()
 
-	var wg sync.WaitGroup
+	var (
+		wg            sync.WaitGroup
+		materializing uint32
+	)
 	for {
 		select {
 		case <-leaderStop:
@@ -126,6 +132,16 @@ func (b *Broker) leaderLoop(leaderStop chan struct{}) {
 						Printf("unable to advance hw mark")
 				}
 			}()
+
+			// produces can outlast the tick while waiting for replication
+			if atomic.CompareAndSwapUint32(&materializing, 0, 1) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer atomic.StoreUint32(&materializing, 0)
+					b.materializeSchedules(ctx)
+				}()
+			}
 		case <-rearrangeTimer.C:
 			b.rearrangePartitionsLeadership()
 		}
@@ -207,20 +223,32 @@ func (b *Broker) TryAdvanceHWMark(ctx context.Context) error {
 					return nil
 				}
 
+				// acknowledged messages must be held by enough replicas, the HW mark waits for them
+				if minISR := b.minInSyncReplicas(len(partition.Replicas)); len(aliveReplicas) < minISR {
+					logger.WithField("min_insync_replicas", minISR).Debugf("not enough in-sync replicas")
+					return nil
+				}
+
+				// the HW mark is the lowest end of log, a replica lagging behind holds it back
 				var newHWMark uint64
-				for _, r := range aliveReplicas {
+				for i, r := range aliveReplicas {
 					index, err := getEndOfLog(ctx, r, t.Name, partition.Id)
+					if s, ok := status.FromError(err); ok && s.Code() == codes.NotFound {
+						// the replica has not created the partition yet, it will catch up on a later tick
+						logger.WithField("replica", r).Debugf("partition not found on replica")
+						return nil
+					}
 					if err != nil {
 						logger.WithError(err).Printf("error getting EndOfLog")
 						return err
 					}
 
-					if index > hwMark && (index < newHWMark || newHWMark == 0) {
+					if i == 0 || index < newHWMark {
 						newHWMark = index
 					}
 				}
 
-				if newHWMark != 0 {
+				if newHWMark > hwMark {
 					setHWMark(t.Name, partition.Id, newHWMark)
 				}
 
@@ -240,6 +268,16 @@ func (b *Broker) TryAdvanceHWMark(ctx context.Context) error {
 	return b.raft.SetPartitionHWMark(op)
 }
 
+// minInSyncReplicas returns how many replicas of a partition must hold a message
+// for it to be acknowledged, all of them unless the configuration asks for less
+func (b *Broker) minInSyncReplicas(replicas int) int {
+	if b.conf.MinInSyncReplicas > 0 && b.conf.MinInSyncReplicas < replicas {
+		return b.conf.MinInSyncReplicas
+	}
+
+	return replicas
+}
+
 func (b *Broker) getPartitionLeader(topic, partition string) *sandglass.Node {
 	leader, ok := b.raft.GetPartitionLeader(topic, partition)
 	if !ok {
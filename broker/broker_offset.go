@@ -58,7 +58,19 @@ func (b *Broker) mark(ctx context.Context, req *sgproto.MarkRequest) (bool, erro
 		Partition: p.Id,
 		Messages:  msgs,
 	})
-	return res != nil, err
+	if err != nil {
+		return res != nil, err
+	}
+
+	// the consumer groups are run by the leader of their offsets partition
+	switch req.State.Kind {
+	case sgproto.MarkKind_Acknowledged, sgproto.MarkKind_NotAcknowledged:
+		if cg := b.getConsumer(consumerGroupKey(req.Topic, req.Partition, req.Channel, req.ConsumerGroup)); cg != nil {
+			cg.release(req.Offsets...)
+		}
+	}
+
+	return res != nil, nil
 }
 
 func (b *Broker) lastOffset(ctx context.Context, topicName, partitionName, channel string, consumerGroup string, kind sgproto.MarkKind) (sgproto.Offset, error) {
@@ -152,6 +164,24 @@ func (b *Broker) isAcknoweldged(ctx context.Context, topicName, partition, chann
 	return b.hasKeyInPartition(ctx, ConsumerOffsetTopicName, p, ConsumerOffsetMainChannel, pk, clusterKey)
 }
 
+// lowestCommittedOffset returns the lowest offset committed by the consumer groups of a channel,
+// sgproto.MaxOffset is returned when there is no consumer group.
+func (b *Broker) lowestCommittedOffset(topicName, partition, channel string) (sgproto.Offset, error) {
+	lowest := sgproto.MaxOffset
+	for _, consumerGroup := range b.raft.GetConsumerGroups(topicName, partition, channel) {
+		offset, err := b.lastOffset(context.TODO(), topicName, partition, channel, consumerGroup, sgproto.MarkKind_Commited)
+		if err != nil {
+			return sgproto.Nil, err
+		}
+
+		if bytes.Compare(offset[:], lowest[:]) < 0 {
+			lowest = offset
+		}
+	}
+
+	return lowest, nil
+}
+
 func partitionKey(topicName, partitionName, channel, consumerGroup string) []byte {
 	return bytes.Join([][]byte{
 		[]byte("offsets"),
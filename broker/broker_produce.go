@@ -4,9 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/sandglass/sandglass/topic"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
 )
@@ -14,30 +18,86 @@ import (
 var (
 	ErrNoKeySet           = errors.New("ErrNoKeySet")
 	ErrNoMessageToProduce = errors.New("ErrNoMessageToProduce")
+	ErrNotKVTopic         = errors.New("ErrNotKVTopic")
+	ErrNoSequenceSet      = errors.New("ErrNoSequenceSet")
+	ErrAckTimeout         = errors.New("ErrAckTimeout")
 )
 
+// DefaultAckTimeout is the time a replicated produce waits for the HW mark when the request does not set one
+var DefaultAckTimeout = 10 * time.Second
+
 func (b *Broker) Produce(ctx context.Context, req *sgproto.ProduceMessageRequest) (*sgproto.ProduceResponse, error) {
 	b.WithFields(logrus.Fields{
 		"topic":     req.Topic,
 		"partition": req.Partition,
 		"messages":  len(req.Messages),
 	}).Debugf("produce message")
+
+	reqs, positions, err := b.routeProduce(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reqs) > 1 {
+		return b.produceSplit(ctx, reqs, positions, len(req.Messages))
+	}
+
+	return b.producePartition(ctx, reqs[0])
+}
+
+// routeProduce validates the request and returns one request per partition when none is set,
+// see splitProduceRequest. The request itself is returned with nil positions when it has a partition.
+func (b *Broker) routeProduce(req *sgproto.ProduceMessageRequest) ([]*sgproto.ProduceMessageRequest, [][]int, error) {
 	if len(req.Messages) == 0 {
-		return nil, ErrNoMessageToProduce
+		return nil, nil, ErrNoMessageToProduce
+	}
+
+	// a resent batch has to reach the same partition to be recognized
+	if req.ProducerId != "" {
+		if req.Partition == "" {
+			return nil, nil, ErrNoPartitionSet
+		}
+		if req.Sequence == 0 {
+			return nil, nil, ErrNoSequenceSet
+		}
 	}
 
 	t := b.getTopic(req.Topic)
 	if t == nil {
-		return nil, ErrTopicNotFound
+		return nil, nil, ErrTopicNotFound
 	}
 
-	var p *topic.Partition
 	if req.Partition != "" { // already specified
-		if p = t.GetPartition(req.Partition); p == nil {
-			return nil, fmt.Errorf("unknown partition '%s'", req.Partition)
-		}
-	} else { // choose one
-		p = t.ChooseRandomPartition()
+		return []*sgproto.ProduceMessageRequest{req}, nil, nil
+	}
+
+	partitioner := req.Partitioner
+	if partitioner == sgproto.Partitioner_DefaultPartitioner {
+		partitioner = t.DefaultPartitioner()
+	}
+	if partitioner == sgproto.Partitioner_ExplicitPartitioner {
+		return nil, nil, ErrNoPartitionSet
+	}
+
+	partitions, err := t.ChoosePartitions(partitioner, req.Messages)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reqs, positions := splitProduceRequest(req, partitions)
+	return reqs, positions, nil
+}
+
+// producePartition produces a request with a partition, on this broker when it leads the partition
+func (b *Broker) producePartition(ctx context.Context, req *sgproto.ProduceMessageRequest) (*sgproto.ProduceResponse, error) {
+	t := b.getTopic(req.Topic)
+	if t == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	p := t.GetPartition(req.Partition)
+	if p == nil {
+		return nil, fmt.Errorf("unknown partition '%s'", req.Partition)
 	}
 
 	leader := b.getPartitionLeader(req.Topic, p.Id)
@@ -49,9 +109,45 @@ func (b *Broker) Produce(ctx context.Context, req *sgproto.ProduceMessageRequest
 		return leader.Produce(ctx, req)
 	}
 
-	err := p.BatchPutMessages(req.Messages)
-	if err != nil {
-		return nil, err
+	if err := <-b.queueProduce(p, req); err != nil {
+		return nil, sequenceError(err)
+	}
+
+	return b.produceResponse(ctx, p, req)
+}
+
+// queueProduce queues the messages of the request in the partition led by this broker
+func (b *Broker) queueProduce(p *topic.Partition, req *sgproto.ProduceMessageRequest) <-chan error {
+	for _, msg := range req.Messages {
+		msg.ProducerId = req.ProducerId
+		msg.Sequence = req.Sequence
+	}
+
+	if req.PreserveProducedAt {
+		return p.QueueImportMessages(req.Messages)
+	}
+	return p.QueueMessages(req.Messages)
+}
+
+// sequenceError gives the errors of idempotent producers a status code, they are told apart by it
+// once forwarded by another broker
+func sequenceError(err error) error {
+	switch err {
+	case topic.ErrDuplicateSequence:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case topic.ErrOutOfOrderSequence:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return err
+}
+
+// produceResponse acknowledges the stored messages of the request according to its ack level
+func (b *Broker) produceResponse(ctx context.Context, p *topic.Partition, req *sgproto.ProduceMessageRequest) (*sgproto.ProduceResponse, error) {
+	if req.Acks == sgproto.AckLevel_ReplicatedAck {
+		if err := b.waitReplication(ctx, p, req); err != nil {
+			return nil, err
+		}
 	}
 
 	res := &sgproto.ProduceResponse{}
@@ -61,3 +157,130 @@ func (b *Broker) Produce(ctx context.Context, req *sgproto.ProduceMessageRequest
 
 	return res, nil
 }
+
+// splitProduceRequest splits a request produced without partition into one request per chosen partition,
+// positions holds the position in the original request of the messages of each of them
+func splitProduceRequest(req *sgproto.ProduceMessageRequest, partitions []*topic.Partition) (reqs []*sgproto.ProduceMessageRequest, positions [][]int) {
+	byPartition := map[string]int{}
+	for i, p := range partitions {
+		j, ok := byPartition[p.Id]
+		if !ok {
+			j = len(reqs)
+			byPartition[p.Id] = j
+			reqs = append(reqs, &sgproto.ProduceMessageRequest{
+				Topic:              req.Topic,
+				Partition:          p.Id,
+				PreserveProducedAt: req.PreserveProducedAt,
+				Acks:               req.Acks,
+				AckTimeout:         req.AckTimeout,
+			})
+			positions = append(positions, nil)
+		}
+
+		reqs[j].Messages = append(reqs[j].Messages, req.Messages[i])
+		positions[j] = append(positions[j], i)
+	}
+
+	return reqs, positions
+}
+
+// produceSplit produces the requests of a split batch to the leaders of their partitions concurrently.
+// The batch is not atomic, the messages of the other partitions are kept when one of them fails.
+func (b *Broker) produceSplit(ctx context.Context, reqs []*sgproto.ProduceMessageRequest, positions [][]int, n int) (*sgproto.ProduceResponse, error) {
+	res := &sgproto.ProduceResponse{
+		Offsets: make([]sgproto.Offset, n),
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	for i, req := range reqs {
+		req, positions := req, positions[i]
+		group.Go(func() error {
+			partRes, err := b.producePartition(ctx, req)
+			if err != nil {
+				return err
+			}
+
+			for j, offset := range partRes.Offsets {
+				res.Offsets[positions[j]] = offset
+			}
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// waitReplication waits until the HW mark of the partition covers the stored messages of the request.
+// The messages are kept when it times out, they might still be replicated later on.
+func (b *Broker) waitReplication(ctx context.Context, p *topic.Partition, req *sgproto.ProduceMessageRequest) error {
+	var index uint64
+	for _, msg := range req.Messages {
+		if msg.Index > index {
+			index = msg.Index
+		}
+	}
+
+	return waitHWMark(ctx, p, index, req.AckTimeout)
+}
+
+// waitHWMark waits until the HW mark of the partition reaches index, DefaultAckTimeout is used when timeout is not set
+func waitHWMark(ctx context.Context, p *topic.Partition, index uint64, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultAckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := p.WaitHWMark(ctx, index)
+	if err == context.DeadlineExceeded {
+		return ErrAckTimeout
+	}
+	return err
+}
+
+// Delete produces a tombstone for the key, it is replicated like any other message.
+// Without clustering key, every clustering key of the key is deleted.
+func (b *Broker) Delete(ctx context.Context, req *sgproto.DeleteRequest) (*sgproto.DeleteResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, ErrNoKeySet
+	}
+
+	t := b.getTopic(req.Topic)
+	if t == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	if t.Kind != sgproto.TopicKind_KVKind {
+		return nil, ErrNotKVTopic
+	}
+
+	partition := req.Partition
+	if partition == "" {
+		partition = t.ChoosePartitionForKey(req.Key).Id
+	}
+
+	res, err := b.Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:     req.Topic,
+		Partition: partition,
+		Messages: []*sgproto.Message{
+			{
+				Channel:       req.Channel,
+				Key:           req.Key,
+				ClusteringKey: req.ClusteringKey,
+				Tombstone:     true,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sgproto.DeleteResponse{
+		Offset: res.Offsets[0],
+	}, nil
+}
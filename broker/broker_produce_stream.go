@@ -0,0 +1,334 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/sandglass/sandglass"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+var ErrProduceStreamClosed = errors.New("ErrProduceStreamClosed")
+
+// number of requests of a produce stream being produced at once, the stream is not read
+// any further until one of them is acknowledged
+const maxProduceStreamInFlight = 64
+
+type produceCallback func(res *sgproto.ProduceResponse, err error)
+
+// produceStream produces the requests returned by recv and sends their responses as soon as they are
+// acknowledged. The requests of a partition are queued in the order they are received and the messages
+// of the partitions led by other brokers are forwarded on a single stream per broker. The first error
+// ends the stream, the requests not yet acknowledged might have been stored.
+func (b *Broker) produceStream(ctx context.Context, recv func() (*sgproto.ProduceMessageRequest, error), send func(res *sgproto.ProduceResponse) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		closed   bool
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	reply := func(res *sgproto.ProduceResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+
+		if err := send(res); err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	slots := make(chan struct{}, maxProduceStreamInFlight)
+	forwarders := map[string]*produceForwarder{}
+	read := make(chan struct{})
+
+	go func() {
+		defer close(read)
+		for {
+			req, err := recv()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				fail(err)
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			reqs, positions, err := b.routeProduce(req)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			wg.Add(1)
+			pending := newPendingProduce(req, len(reqs), func(res *sgproto.ProduceResponse, err error) {
+				if err != nil {
+					fail(err)
+				} else {
+					reply(res)
+				}
+				<-slots
+				wg.Done()
+			})
+
+			for i, sub := range reqs {
+				var pos []int
+				if positions != nil {
+					pos = positions[i]
+				}
+
+				b.streamPartition(ctx, sub, forwarders, func(res *sgproto.ProduceResponse, err error) {
+					pending.complete(pos, res, err)
+				})
+			}
+		}
+	}()
+
+	select {
+	case <-read:
+		wg.Wait()
+		for _, fwd := range forwarders {
+			if err := fwd.Close(); err != nil {
+				fail(err)
+			}
+		}
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	closed = true
+
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// streamPartition queues a request with a partition when this broker leads it and forwards it otherwise,
+// fn is called once it is acknowledged
+func (b *Broker) streamPartition(ctx context.Context, req *sgproto.ProduceMessageRequest, forwarders map[string]*produceForwarder, fn produceCallback) {
+	t := b.getTopic(req.Topic)
+	if t == nil {
+		fn(nil, ErrTopicNotFound)
+		return
+	}
+
+	p := t.GetPartition(req.Partition)
+	if p == nil {
+		fn(nil, ErrPartitionNotFound)
+		return
+	}
+
+	leader := b.getPartitionLeader(req.Topic, p.Id)
+	if leader == nil {
+		fn(nil, ErrNoLeaderFound)
+		return
+	}
+
+	if leader.Name != b.Name() {
+		fwd, ok := forwarders[leader.Name]
+		if !ok {
+			var err error
+			fwd, err = newProduceForwarder(ctx, leader)
+			if err != nil {
+				fn(nil, err)
+				return
+			}
+			forwarders[leader.Name] = fwd
+		}
+
+		fwd.Send(req, fn)
+		return
+	}
+
+	// queued right away to keep the order of the stream
+	stored := b.queueProduce(p, req)
+	go func() {
+		if err := <-stored; err != nil {
+			fn(nil, sequenceError(err))
+			return
+		}
+
+		fn(b.produceResponse(ctx, p, req))
+	}()
+}
+
+// pendingProduce gathers the responses of the partitions of a request of a produce stream
+type pendingProduce struct {
+	mu        sync.Mutex
+	res       *sgproto.ProduceResponse
+	err       error
+	remaining int
+	done      produceCallback
+}
+
+func newPendingProduce(req *sgproto.ProduceMessageRequest, partitions int, done produceCallback) *pendingProduce {
+	return &pendingProduce{
+		res: &sgproto.ProduceResponse{
+			RequestId: req.RequestId,
+			Offsets:   make([]sgproto.Offset, len(req.Messages)),
+		},
+		remaining: partitions,
+		done:      done,
+	}
+}
+
+// complete records the response of a partition, positions are the positions of its messages
+// in the request, nil when it is the whole request
+func (pp *pendingProduce) complete(positions []int, res *sgproto.ProduceResponse, err error) {
+	pp.mu.Lock()
+	if err != nil && pp.err == nil {
+		pp.err = err
+	}
+
+	if res != nil {
+		for i, offset := range res.Offsets {
+			if positions != nil {
+				pp.res.Offsets[positions[i]] = offset
+			} else {
+				pp.res.Offsets[i] = offset
+			}
+		}
+	}
+
+	pp.remaining--
+	finished := pp.remaining == 0
+	pp.mu.Unlock()
+
+	if !finished {
+		return
+	}
+
+	if pp.err != nil {
+		pp.done(nil, pp.err)
+		return
+	}
+	pp.done(pp.res, nil)
+}
+
+// produceForwarder forwards requests to the leader of their partitions on a produce stream
+type produceForwarder struct {
+	stream sgproto.BrokerService_ProduceStreamClient
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]produceCallback
+	err     error
+	done    chan struct{}
+}
+
+func newProduceForwarder(ctx context.Context, leader *sandglass.Node) (*produceForwarder, error) {
+	stream, err := leader.ProduceStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fwd := &produceForwarder{
+		stream:  stream,
+		pending: map[uint64]produceCallback{},
+		done:    make(chan struct{}),
+	}
+	go fwd.recvLoop()
+
+	return fwd, nil
+}
+
+func (fwd *produceForwarder) Send(req *sgproto.ProduceMessageRequest, fn produceCallback) {
+	fwd.mu.Lock()
+	if fwd.err != nil {
+		err := fwd.err
+		fwd.mu.Unlock()
+		fn(nil, err)
+		return
+	}
+
+	fwd.nextID++
+	forwarded := *req
+	forwarded.RequestId = fwd.nextID
+	fwd.pending[forwarded.RequestId] = fn
+
+	err := fwd.stream.Send(&forwarded)
+	if err != nil {
+		delete(fwd.pending, forwarded.RequestId)
+	}
+	fwd.mu.Unlock()
+
+	// the actual error is returned by Recv
+	if err != nil {
+		fn(nil, err)
+	}
+}
+
+func (fwd *produceForwarder) recvLoop() {
+	defer close(fwd.done)
+	for {
+		res, err := fwd.stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				err = ErrProduceStreamClosed
+			}
+
+			fwd.mu.Lock()
+			fwd.err = err
+			pending := fwd.pending
+			fwd.pending = nil
+			fwd.mu.Unlock()
+
+			for _, fn := range pending {
+				fn(nil, err)
+			}
+			return
+		}
+
+		fwd.mu.Lock()
+		fn, ok := fwd.pending[res.RequestId]
+		delete(fwd.pending, res.RequestId)
+		fwd.mu.Unlock()
+
+		if ok {
+			fn(res, nil)
+		}
+	}
+}
+
+// Close ends the stream once every forwarded request was acknowledged
+func (fwd *produceForwarder) Close() error {
+	fwd.mu.Lock()
+	err := fwd.stream.CloseSend()
+	fwd.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	<-fwd.done
+
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	if fwd.err == ErrProduceStreamClosed {
+		return nil
+	}
+	return fwd.err
+}
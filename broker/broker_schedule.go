@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/schedule"
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/topic"
+)
+
+var (
+	ErrScheduleAlreadyExist = errors.New("ErrScheduleAlreadyExist")
+	ErrScheduleNotFound     = errors.New("ErrScheduleNotFound")
+)
+
+// ScheduleLookahead is how long before their time the occurrences of the schedules are produced
+var ScheduleLookahead = time.Minute
+
+// CreateSchedule registers a schedule on a timer topic, its first occurrence is the first one after now
+func (b *Broker) CreateSchedule(ctx context.Context, req *sgproto.Schedule) (*sgproto.Schedule, error) {
+	if err := schedule.Validate(req); err != nil {
+		return nil, err
+	}
+
+	if !b.IsController() {
+		leader := b.GetController()
+		if leader == nil {
+			return nil, ErrNoLeaderFound
+		}
+		return leader.CreateSchedule(ctx, req)
+	}
+
+	t := b.getTopic(req.Topic)
+	if t == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	if t.Kind != sgproto.TopicKind_TimerKind {
+		return nil, topic.ErrNotTimerTopic
+	}
+
+	if b.raft.GetSchedule(req.Topic, req.Name) != nil {
+		return nil, ErrScheduleAlreadyExist
+	}
+
+	s := *req
+	if s.Partition == "" {
+		// occurrences are resent to the same partition to be recognized, see producers
+		s.Partition = t.Partitions[sgutils.HashString(s.Name, len(t.Partitions))].Id
+	} else if t.GetPartition(s.Partition) == nil {
+		return nil, ErrPartitionNotFound
+	}
+
+	next, err := schedule.Next(&s, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	s.Next = next
+	s.Occurrences = 0
+	s.Sequence = 0
+
+	if err := b.raft.SetSchedule(&s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (b *Broker) ListSchedules(ctx context.Context, req *sgproto.ListSchedulesRequest) (*sgproto.ListSchedulesReply, error) {
+	return &sgproto.ListSchedulesReply{
+		Schedules: b.raft.GetSchedules(req.Topic),
+	}, nil
+}
+
+// DeleteSchedule removes a schedule, the occurrences already produced are still delivered
+func (b *Broker) DeleteSchedule(ctx context.Context, req *sgproto.DeleteScheduleRequest) (*sgproto.DeleteScheduleReply, error) {
+	if !b.IsController() {
+		leader := b.GetController()
+		if leader == nil {
+			return nil, ErrNoLeaderFound
+		}
+		return leader.DeleteSchedule(ctx, req)
+	}
+
+	if b.raft.GetSchedule(req.Topic, req.Name) == nil {
+		return nil, ErrScheduleNotFound
+	}
+
+	if err := b.raft.DeleteSchedule(req.Topic, req.Name); err != nil {
+		return nil, err
+	}
+
+	return &sgproto.DeleteScheduleReply{}, nil
+}
+
+// materializeSchedules produces the occurrences of the schedules due within ScheduleLookahead,
+// it is run by the controller
+func (b *Broker) materializeSchedules(ctx context.Context) {
+	now := time.Now().UTC()
+
+	var wg sync.WaitGroup
+	for _, s := range b.raft.GetSchedules("") {
+		if s.Next.After(now.Add(ScheduleLookahead)) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *sgproto.Schedule) {
+			defer wg.Done()
+			if err := b.materializeSchedule(ctx, s, now); err != nil {
+				b.WithError(err).WithFields(logrus.Fields{
+					"topic":    s.Topic,
+					"schedule": s.Name,
+				}).Printf("unable to produce schedule occurrences")
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// materializeSchedule produces the next occurrences of a schedule in a single batch and records them in
+// the raft state. The batch is produced as an idempotent producer so that it is not stored twice when the
+// controller fails to record it. The partition only remembers the producer for topic.ProducerIdleTimeout,
+// a batch left unrecorded for longer, when no controller runs in the meantime, is stored again.
+func (b *Broker) materializeSchedule(ctx context.Context, s *sgproto.Schedule, now time.Time) error {
+	req, next, err := schedule.Batch(s, now, now.Add(ScheduleLookahead))
+	if err != nil || req == nil {
+		return err
+	}
+
+	// a duplicate is a batch stored by a former controller which did not record it,
+	// it might span a different number of occurrences but it is not produced again
+	_, err = b.Produce(ctx, req)
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return err
+	}
+
+	return b.raft.AdvanceSchedule(s.Topic, s.Name, next, s.Occurrences+uint64(len(req.Messages)), req.Sequence)
+}
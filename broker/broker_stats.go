@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/topic"
+)
+
+// topicStats gathers the storage statistics of every node holding a replica of the requested partitions,
+// all of them when no partition is set. Each replica reports the statistics of its own copy.
+func (b *Broker) topicStats(ctx context.Context, req *sgproto.TopicStatsRequest) (*sgproto.TopicStatsReply, error) {
+	t := b.getTopic(req.Topic)
+	if t == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	partitions, err := b.statsPartitions(t, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	var replicas []string
+	seen := map[string]bool{}
+	for _, p := range partitions {
+		for _, replica := range p.Replicas {
+			if !seen[replica] {
+				seen[replica] = true
+				replicas = append(replicas, replica)
+			}
+		}
+	}
+
+	res := &sgproto.TopicStatsReply{
+		Topic: t.Name,
+	}
+
+	for _, replica := range replicas {
+		var (
+			reply *sgproto.TopicStatsReply
+			err   error
+		)
+
+		if replica == b.Name() {
+			reply, err = b.localTopicStats(t.Name, req.Partition)
+		} else {
+			node := b.getNode(replica)
+			if node == nil {
+				return nil, ErrReplicaNotFound
+			}
+
+			reply, err = node.GetLocalTopicStats(ctx, &sgproto.TopicStatsRequest{
+				Topic:     t.Name,
+				Partition: req.Partition,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res.Storages = append(res.Storages, reply.Storages...)
+		res.Partitions = append(res.Partitions, reply.Partitions...)
+	}
+
+	return res, nil
+}
+
+// localTopicStats returns the statistics of the storage of the topic on this node and of the
+// requested partitions it holds a replica of
+func (b *Broker) localTopicStats(topicName, partition string) (*sgproto.TopicStatsReply, error) {
+	t := b.getTopic(topicName)
+	if t == nil {
+		return nil, ErrTopicNotFound
+	}
+
+	partitions, err := b.statsPartitions(t, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	storageStats, err := t.StorageStats()
+	if err != nil {
+		return nil, err
+	}
+	storageStats.Replica = b.Name()
+
+	res := &sgproto.TopicStatsReply{
+		Topic:    t.Name,
+		Storages: []*sgproto.StorageStats{storageStats},
+	}
+
+	for _, p := range partitions {
+		if !sgutils.StringSliceHasString(p.Replicas, b.Name()) {
+			continue
+		}
+
+		stats, err := p.Stats()
+		if err != nil {
+			return nil, err
+		}
+		stats.Replica = b.Name()
+
+		res.Partitions = append(res.Partitions, stats)
+	}
+
+	return res, nil
+}
+
+func (b *Broker) statsPartitions(t *topic.Topic, partition string) ([]*topic.Partition, error) {
+	if partition == "" {
+		return t.ListPartitions(), nil
+	}
+
+	p := t.GetPartition(partition)
+	if p == nil {
+		return nil, ErrPartitionNotFound
+	}
+
+	return []*topic.Partition{p}, nil
+}
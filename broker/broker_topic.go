@@ -9,6 +9,7 @@ import (
 
 	"github.com/celrenheit/sandflake"
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
 	"github.com/sandglass/sandglass/topic"
 	"github.com/hashicorp/serf/serf"
 	"github.com/serialx/hashring"
@@ -24,6 +25,8 @@ var (
 	ErrNoControllerSet        = errors.New("ErrNoControllerSet")
 	ErrNoLeaderFound          = errors.New("ErrNoLeaderFound")
 	ErrNoConsumerFound        = errors.New("ErrNoConsumerFound")
+	ErrNoKeyring              = errors.New("ErrNoKeyring")
+	ErrInvalidPartitions      = errors.New("ErrInvalidPartitions")
 )
 
 func (b *Broker) watchTopic() error {
@@ -65,12 +68,39 @@ func (b *Broker) CreateTopic(ctx context.Context, params *sgproto.TopicConfig) (
 		return nil, ErrTopicAlreadyExist
 	}
 
+	if params.Encrypted && b.keyring == nil {
+		return nil, ErrNoKeyring
+	}
+
 	t := &topic.Topic{
-		Name:              params.Name,
-		Kind:              params.Kind,
-		ReplicationFactor: int(params.ReplicationFactor),
-		NumPartitions:     int(params.NumPartitions),
-		StorageDriver:     params.StorageDriver,
+		Name:                   params.Name,
+		Kind:                   params.Kind,
+		ReplicationFactor:      int(params.ReplicationFactor),
+		NumPartitions:          int(params.NumPartitions),
+		StorageDriver:          params.StorageDriver,
+		RetentionMaxAge:        params.RetentionMaxAge,
+		RetentionMaxBytes:      params.RetentionMaxBytes,
+		CompactByKey:           params.CompactByKey,
+		BloomFalsePositiveRate: params.BloomFalsePositiveRate,
+		CompressionCodec:       params.CompressionCodec,
+		Encrypted:              params.Encrypted,
+		StorageOptions:         storage.OptionsFromProto(params.StorageOptions),
+		Partitioner:            params.Partitioner,
+		ExpiredChannel:         params.ExpiredChannel,
+	}
+
+	if len(params.Partitions) > 0 {
+		ids := map[string]bool{}
+		for _, id := range params.Partitions {
+			if id == "" || ids[id] {
+				return nil, ErrInvalidPartitions
+			}
+			ids[id] = true
+		}
+
+		if len(ids) != t.NumPartitions {
+			return nil, ErrInvalidPartitions
+		}
 	}
 
 	var g sandflake.Generator
@@ -78,6 +108,9 @@ func (b *Broker) CreateTopic(ctx context.Context, params *sgproto.TopicConfig) (
 		p := &topic.Partition{
 			Id: g.Next().String(),
 		}
+		if len(params.Partitions) > 0 { // restoring a backup
+			p.Id = params.Partitions[i]
+		}
 
 		replicas, ok := b.selectReplicasForPartition(t, p)
 		if !ok {
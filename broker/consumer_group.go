@@ -1,7 +1,9 @@
 package broker
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/topic"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -22,6 +25,11 @@ var (
 	MaxRedeliveryCount = 5
 )
 
+var (
+	errStopConsuming = errors.New("errStopConsuming")
+	errNoCredits     = errors.New("errNoCredits")
+)
+
 type ConsumerGroup struct {
 	broker    *Broker
 	topic     string
@@ -31,6 +39,17 @@ type ConsumerGroup struct {
 	mu        sync.RWMutex
 	receivers []*receiver
 	logger    *logrus.Entry
+	// changed is signaled when a consumer joins or leaves
+	changed chan struct{}
+	// credited is signaled when a consumer is given credits back
+	credited chan struct{}
+	// turn is the position of the last receiver a message was sent to
+	turn int
+	// held are the receivers holding a credit for the offsets sent to them, guarded by mu
+	held map[sgproto.Offset]*receiver
+	// final are the offsets delivered for the last time, see MaxRedeliveryCount. They are acknowledged
+	// as they are sent and hold no credit, guarded by mu.
+	final map[sgproto.Offset]struct{}
 }
 
 func NewConsumerGroup(b *Broker, topic, partition, channel, name string) *ConsumerGroup {
@@ -40,6 +59,8 @@ func NewConsumerGroup(b *Broker, topic, partition, channel, name string) *Consum
 		topic:     topic,
 		channel:   channel,
 		partition: partition,
+		changed:   make(chan struct{}, 1),
+		credited:  make(chan struct{}, 1),
 		logger: b.WithFields(logrus.Fields{
 			"topic":          topic,
 			"partition":      partition,
@@ -50,11 +71,16 @@ func NewConsumerGroup(b *Broker, topic, partition, channel, name string) *Consum
 
 type receiver struct {
 	name   string
+	follow bool
 	msgCh  chan *sgproto.Message
 	doneCh chan struct{}
+	// window is the number of messages the receiver can have unacknowledged, it is unbounded when 0.
+	// credits is what remains of it, both are guarded by the lock of the group.
+	window  int
+	credits int
 }
 
-func (c *ConsumerGroup) register(consumerName string) *receiver {
+func (c *ConsumerGroup) register(consumerName string, follow bool, credits uint32) *receiver {
 	r := c.getReceiver(consumerName)
 	if r != nil {
 		return r
@@ -64,14 +90,19 @@ func (c *ConsumerGroup) register(consumerName string) *receiver {
 	defer c.mu.Unlock()
 
 	r = &receiver{
-		name:   consumerName,
-		msgCh:  make(chan *sgproto.Message),
-		doneCh: make(chan struct{}),
+		name:    consumerName,
+		follow:  follow,
+		msgCh:   make(chan *sgproto.Message),
+		doneCh:  make(chan struct{}),
+		window:  int(credits),
+		credits: int(credits),
 	}
 	c.receivers = append(c.receivers, r)
 
 	if len(c.receivers) == 1 {
 		go c.consumeLoop()
+	} else {
+		c.signalChange()
 	}
 
 	return r
@@ -82,11 +113,16 @@ func (c *ConsumerGroup) consumeLoop() {
 		c.mu.Lock()
 		for _, r := range c.receivers {
 			close(r.msgCh)
-			close(r.doneCh)
 		}
 		c.receivers = c.receivers[:0]
+		c.held = nil
+		c.final = nil
 		c.mu.Unlock()
 	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	lastCommited, err := c.broker.lastOffset(context.TODO(), c.topic, c.partition, c.channel, c.name, sgproto.MarkKind_Commited)
 	if err != nil {
 		c.logger.WithError(err).Debugf("got error when fetching last committed offset")
@@ -102,234 +138,634 @@ func (c *ConsumerGroup) consumeLoop() {
 	msgCh := make(chan *sgproto.Message)
 	var group errgroup.Group
 
-	if !lastCommited.Equal(lastConsumed) {
-		group.Go(func() error {
-			var (
-				lastMessage *sgproto.Message
-				committed   = false
-			)
-			req := &sgproto.FetchRangeRequest{
-				Topic:     c.topic,
-				Partition: c.partition,
-				Channel:   c.channel,
-				From:      lastCommited,
-				To:        lastConsumed,
+	group.Go(func() error {
+		return c.redeliver(ctx, lastCommited, lastConsumed, msgCh)
+	})
+	newest := lastConsumed
+	group.Go(func() error {
+		var err error
+		newest, err = c.consumeNew(ctx, lastConsumed, msgCh, nil, time.Time{})
+		return err
+	})
+
+	go func() {
+		err := group.Wait()
+		if err != nil {
+			c.logger.WithError(err).Info("error in consumeLoop")
+		}
+		close(msgCh)
+	}()
+
+	m, ok := c.dispatch(msgCh)
+	c.markConsumed(m, lastConsumed)
+	if !ok {
+		return
+	}
+
+	// the following consumers stay attached and receive the messages as they become due. The messages
+	// delivered before the previous redelivery round are checked again every RedeliveryTimeout,
+	// they have been in flight long enough to be redelivered. Waiting for credits stops for the
+	// redeliveries, which give back the credits of the messages they supersede.
+	var (
+		from        = newest
+		redeliverTo = newest
+		redeliverAt = time.Now().Add(RedeliveryTimeout)
+	)
+	for c.keepFollowers() {
+		if err := c.waitDue(from, time.Until(redeliverAt)); err != nil {
+			c.logger.WithError(err).Debugf("error while waiting for due messages")
+			return
+		}
+
+		if !time.Now().Before(redeliverAt) {
+			if !c.redeliverFollowing(ctx, redeliverTo) {
+				return
 			}
+			redeliverTo = from
+			redeliverAt = time.Now().Add(RedeliveryTimeout)
+		}
 
-			commit := func(offset sgproto.Offset) {
-				_, err := c.broker.Commit(context.TODO(), &sgproto.MarkRequest{
-					Topic:         c.topic,
-					Partition:     c.partition,
-					Channel:       c.channel,
-					ConsumerGroup: c.name,
-					Offsets:       []sgproto.Offset{lastMessage.Offset},
-				})
-				if err != nil {
-					c.logger.WithError(err).Debugf("unable to commit")
-				}
+		msgCh := make(chan *sgproto.Message)
+		stop := make(chan struct{})
+		last := from
+		go func(from sgproto.Offset) {
+			var err error
+			last, err = c.consumeNew(ctx, from, msgCh, stop, redeliverAt)
+			if err != nil && err != errStopConsuming {
+				c.logger.WithError(err).Info("error in consumeLoop")
+			}
+			close(msgCh)
+		}(from)
+
+		m, ok := c.dispatch(msgCh)
+		close(stop)
+		c.markConsumed(m, from)
+		if !ok {
+			return
+		}
+		from = last
+	}
+}
+
+// redeliverFollowing sends the redeliveries of the messages up to lastConsumed to the following consumers,
+// it returns false once every consumer left
+func (c *ConsumerGroup) redeliverFollowing(ctx context.Context, lastConsumed sgproto.Offset) bool {
+	lastCommited, err := c.broker.lastOffset(ctx, c.topic, c.partition, c.channel, c.name, sgproto.MarkKind_Commited)
+	if err != nil {
+		c.logger.WithError(err).Debugf("got error when fetching last committed offset")
+		return true
+	}
+
+	msgCh := make(chan *sgproto.Message)
+	go func() {
+		if err := c.redeliver(ctx, lastCommited, lastConsumed, msgCh); err != nil && err != context.Canceled {
+			c.logger.WithError(err).Info("error in consumeLoop")
+		}
+		close(msgCh)
+	}()
+
+	// the redeliveries are marked as they are sent
+	_, ok := c.dispatch(msgCh)
+	return ok
+}
+
+// redeliver sends to msgCh the messages consumed between the last committed and the last consumed
+// offsets which should be delivered again, and commits the ones acknowledged in a row
+func (c *ConsumerGroup) redeliver(ctx context.Context, lastCommited, lastConsumed sgproto.Offset, msgCh chan<- *sgproto.Message) error {
+	if lastCommited.Equal(lastConsumed) {
+		return nil
+	}
+
+	var (
+		lastMessage *sgproto.Message
+		committed   = false
+	)
+	req := &sgproto.FetchRangeRequest{
+		Topic:     c.topic,
+		Partition: c.partition,
+		Channel:   c.channel,
+		From:      lastCommited,
+		To:        lastConsumed,
+	}
+
+	commit := func(offset sgproto.Offset) {
+		_, err := c.broker.Commit(context.TODO(), &sgproto.MarkRequest{
+			Topic:         c.topic,
+			Partition:     c.partition,
+			Channel:       c.channel,
+			ConsumerGroup: c.name,
+			Offsets:       []sgproto.Offset{lastMessage.Offset},
+		})
+		if err != nil {
+			c.logger.WithError(err).Debugf("unable to commit")
+			return
+		}
+
+		// the committed messages are not delivered again
+		c.releaseTo(lastMessage.Offset)
+	}
+
+	i := 0
+	err := c.broker.FetchRangeFn(ctx, req, func(m *sgproto.Message) error {
+		if m.Offset.Equal(lastCommited) { // skip first item, since it is already committed
+			lastMessage = m
+			return nil
+		}
+		i++
+
+		markedMsg, err := c.broker.GetMarkStateMessage(context.TODO(), &sgproto.GetMarkRequest{
+			Topic:         c.topic,
+			Partition:     c.partition,
+			Channel:       c.channel,
+			ConsumerGroup: c.name,
+			Offset:        m.Offset,
+		})
+		if err != nil {
+			s, ok := status.FromError(err)
+			if !ok || s.Code() != codes.NotFound {
+				return err
 			}
+		}
 
-			i := 0
-			err := c.broker.FetchRangeFn(context.TODO(), req, func(m *sgproto.Message) error {
-				if m.Offset.Equal(lastCommited) { // skip first item, since it is already committed
-					lastMessage = m
-					return nil
+		var state sgproto.MarkState
+		if markedMsg != nil {
+			err := proto.Unmarshal(markedMsg.Value, &state)
+			if err != nil {
+				return err
+			}
+		}
+
+		// advance commit offset
+		// if we only got acked messages before
+		if !committed && lastMessage != nil {
+			if state.Kind != sgproto.MarkKind_Acknowledged {
+				// we might commit in a goroutine, we can redo this the next time we consume
+				if !lastMessage.Offset.Equal(lastCommited) {
+					commit(lastMessage.Offset)
 				}
-				i++
+				committed = true
+			} else if i%10000 == 0 {
+				go commit(lastMessage.Offset)
+			}
+		}
+		lastMessage = m
+
+		if c.shouldRedeliver(m, state) {
+			if topic.Expired(m, time.Now()) {
+				return c.expire(ctx, m)
+			}
+
+			if state.Kind != sgproto.MarkKind_Unknown && int(state.DeliveryCount)+1 >= MaxRedeliveryCount {
+				c.deliverFinal(m.Offset)
+			}
+
+			select { // deliver
+			case msgCh <- m:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 
-				markedMsg, err := c.broker.GetMarkStateMessage(context.TODO(), &sgproto.GetMarkRequest{
+			// those calls should be batched
+			if state.Kind == sgproto.MarkKind_Unknown {
+				// TODO: Should we mark this consumed?
+				_, err := c.broker.Mark(context.Background(), &sgproto.MarkRequest{
 					Topic:         c.topic,
 					Partition:     c.partition,
 					Channel:       c.channel,
 					ConsumerGroup: c.name,
-					Offset:        m.Offset,
+					Offsets:       []sgproto.Offset{m.Offset},
+					State: &sgproto.MarkState{
+						Kind:          sgproto.MarkKind_Consumed,
+						DeliveryCount: 1,
+					},
 				})
 				if err != nil {
-					s, ok := status.FromError(err)
-					if !ok || s.Code() != codes.NotFound {
-						return err
-					}
+					c.logger.WithError(err).Debugf("error while acking message for the first redilvery")
+					return err
 				}
+			} else {
+				state.DeliveryCount++
 
-				var state sgproto.MarkState
-				if markedMsg != nil {
-					err := proto.Unmarshal(markedMsg.Value, &state)
-					if err != nil {
-						return err
-					}
+				if int(state.DeliveryCount) >= MaxRedeliveryCount {
+					// Mark the message as ACKed
+					// TODO: produce this a dead letter queue
+					state.Kind = sgproto.MarkKind_Acknowledged
 				}
 
-				// advance commit offset
-				// if we only got acked messages before
-				if !committed && lastMessage != nil {
-					if state.Kind != sgproto.MarkKind_Acknowledged {
-						// we might commit in a goroutine, we can redo this the next time we consume
-						if !lastMessage.Offset.Equal(lastCommited) {
-							commit(lastMessage.Offset)
-						}
-						committed = true
-					} else if i%10000 == 0 {
-						go commit(lastMessage.Offset)
-					}
+				markedMsg.Value, err = proto.Marshal(&state)
+				if err != nil {
+					return err
 				}
-				lastMessage = m
-
-				if c.shouldRedeliver(m, state) {
-					msgCh <- m // deliver
-
-					// those calls should be batched
-					if state.Kind == sgproto.MarkKind_Unknown {
-						// TODO: Should we mark this consumed?
-						_, err := c.broker.Mark(context.Background(), &sgproto.MarkRequest{
-							Topic:         c.topic,
-							Partition:     c.partition,
-							Channel:       c.channel,
-							ConsumerGroup: c.name,
-							Offsets:       []sgproto.Offset{m.Offset},
-							State: &sgproto.MarkState{
-								Kind:          sgproto.MarkKind_Consumed,
-								DeliveryCount: 1,
-							},
-						})
-						if err != nil {
-							c.logger.WithError(err).Debugf("error while acking message for the first redilvery")
-							return err
-						}
-					} else {
-						state.DeliveryCount++
-
-						if int(state.DeliveryCount) >= MaxRedeliveryCount {
-							// Mark the message as ACKed
-							// TODO: produce this a dead letter queue
-							state.Kind = sgproto.MarkKind_Acknowledged
-						}
-
-						markedMsg.Value, err = proto.Marshal(&state)
-						if err != nil {
-							return err
-						}
-
-						// TODO: Should handle this in higher level method
-						t := c.broker.getTopic(ConsumerOffsetTopicName)
-						p := t.ChoosePartitionForKey(markedMsg.Key)
-						markedMsg.ClusteringKey = generateClusterKey(m.Offset, state.Kind)
-
-						var group errgroup.Group
-						group.Go(func() error {
-							// TODO: should we add channel here
-							_, err := c.broker.Produce(context.TODO(), &sgproto.ProduceMessageRequest{
-								Topic:     ConsumerOffsetTopicName,
-								Partition: p.Id,
-								Messages:  []*sgproto.Message{markedMsg},
-							})
-							if err != nil {
-								c.logger.Printf("error marking message as acked (death letter)")
-							}
-							return err
-						})
-						// sending the message to death letter channel
-						m.Channel = DeathLetterChannel
-						group.Go(func() error {
-							_, err := c.broker.Produce(context.TODO(), &sgproto.ProduceMessageRequest{
-								Topic:     c.topic,
-								Partition: c.partition,
-								Messages:  []*sgproto.Message{m},
-							})
-							if err != nil {
-								c.logger.Printf("error producing death letter message")
-							}
-							return err
-						})
-
-						if err := group.Wait(); err != nil {
-							return err
-						}
+
+				// TODO: Should handle this in higher level method
+				t := c.broker.getTopic(ConsumerOffsetTopicName)
+				p := t.ChoosePartitionForKey(markedMsg.Key)
+				markedMsg.ClusteringKey = generateClusterKey(m.Offset, state.Kind)
+
+				var group errgroup.Group
+				group.Go(func() error {
+					// TODO: should we add channel here
+					_, err := c.broker.Produce(context.TODO(), &sgproto.ProduceMessageRequest{
+						Topic:     ConsumerOffsetTopicName,
+						Partition: p.Id,
+						Messages:  []*sgproto.Message{markedMsg},
+					})
+					if err != nil {
+						c.logger.Printf("error marking message as acked (death letter)")
 					}
-				}
+					return err
+				})
+				// sending the message to death letter channel
+				m.Channel = DeathLetterChannel
+				group.Go(func() error {
+					_, err := c.broker.Produce(context.TODO(), &sgproto.ProduceMessageRequest{
+						Topic:     c.topic,
+						Partition: c.partition,
+						Messages:  []*sgproto.Message{m},
+					})
+					if err != nil {
+						c.logger.Printf("error producing death letter message")
+					}
+					return err
+				})
 
-				return nil
-			})
-			if err != nil {
-				return err
+				if err := group.Wait(); err != nil {
+					return err
+				}
 			}
+		}
 
-			if !committed && lastMessage != nil {
-				commit(lastMessage.Offset)
-			}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-			return nil
-		})
+	if !committed && lastMessage != nil {
+		commit(lastMessage.Offset)
 	}
-	group.Go(func() error {
-		now := sgproto.NewOffset(sgproto.MaxOffset.Index(), time.Now())
-		req := &sgproto.FetchRangeRequest{
-			Topic:     c.topic,
-			Partition: c.partition,
-			Channel:   c.channel,
-			From:      lastConsumed,
-			To:        now,
+
+	return nil
+}
+
+// consumeNew sends the messages due after from to msgCh until stop is closed,
+// it returns the offset of the last one. The fetch is not kept open while no receiver has credits left,
+// it starts again from the next message once one has. The wait stops at until when it is set.
+func (c *ConsumerGroup) consumeNew(ctx context.Context, from sgproto.Offset, msgCh chan<- *sgproto.Message, stop <-chan struct{}, until time.Time) (sgproto.Offset, error) {
+	last := from
+	now := sgproto.NewOffset(sgproto.MaxOffset.Index(), time.Now())
+	req := &sgproto.FetchRangeRequest{
+		Topic:     c.topic,
+		Partition: c.partition,
+		Channel:   c.channel,
+		To:        now,
+	}
+
+	send := func(m *sgproto.Message) error {
+		select {
+		case msgCh <- m:
+			return nil
+		case <-stop:
+			return errStopConsuming
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
 
-		return c.broker.FetchRangeFn(context.TODO(), req, func(m *sgproto.Message) error {
+	for {
+		req.From = last
+		err := c.broker.FetchRangeFn(ctx, req, func(m *sgproto.Message) error {
 			// skip the first if it is the same as the starting point
-			if lastConsumed == m.Offset {
+			if last == m.Offset {
 				return nil
 			}
 
-			msgCh <- m
+			if topic.Expired(m, time.Now()) {
+				last = m.Offset
+				return c.expire(ctx, m)
+			}
+
+			if !c.hasCredits() {
+				return errNoCredits
+			}
 
-			return nil
+			last = m.Offset
+			return send(m)
 		})
-	})
+		if err != errNoCredits {
+			return last, err
+		}
 
-	go func() {
-		err := group.Wait()
-		if err != nil {
-			c.logger.WithError(err).Info("error in consumeLoop")
+		ok, err := c.waitCredits(ctx, stop, until)
+		if !ok {
+			return last, err
 		}
-		close(msgCh)
-	}()
+	}
+}
 
-	var i int
+// dispatch sends the messages to the receivers in turn until msgCh is closed, it returns the last
+// message received and false once every receiver left
+func (c *ConsumerGroup) dispatch(msgCh <-chan *sgproto.Message) (*sgproto.Message, bool) {
 	var m *sgproto.Message
-loop:
 	for m = range msgCh {
+		// a redelivery supersedes the previous delivery of the message
+		c.release(m.Offset)
+
 		// select receiver
 	selectreceiver:
-		i++
-		c.mu.RLock()
-		r := c.receivers[i%len(c.receivers)]
-		c.mu.RUnlock()
+		r, ok := c.nextReceiver()
+		if !ok {
+			return m, false
+		}
 
 		select {
 		case <-r.doneCh:
-			if c.removeConsumer(r.name) {
-				c.mu.RLock()
-				l := len(c.receivers)
-				c.mu.RUnlock()
+			c.removeConsumer(r.name)
+			goto selectreceiver // select another receiver
+		case r.msgCh <- m:
+			c.useCredit(r, m.Offset)
+		}
+	}
 
-				if l == 0 {
-					break loop
-				}
+	return m, true
+}
 
-				goto selectreceiver // select another receiver
+// nextReceiver returns the next receiver in turn which has credits left, the ones without credits are
+// skipped so that a slow consumer does not hold the messages of the others. It waits when none has
+// credits left and returns false once every receiver left.
+func (c *ConsumerGroup) nextReceiver() (*receiver, bool) {
+	for {
+		c.mu.Lock()
+		receivers := c.receivers[:0]
+		for _, r := range c.receivers {
+			select {
+			case <-r.doneCh:
+			default:
+				receivers = append(receivers, r)
 			}
-		case r.msgCh <- m:
+		}
+		c.receivers = receivers
+
+		for range c.receivers {
+			c.turn = (c.turn + 1) % len(c.receivers)
+			r := c.receivers[c.turn]
+			if r.window == 0 || r.credits > 0 {
+				c.mu.Unlock()
+				return r, true
+			}
+		}
+
+		left := len(c.receivers) == 0
+		c.mu.Unlock()
+
+		if left {
+			return nil, false
+		}
+
+		select {
+		case <-c.credited:
+		case <-c.changed:
 		}
 	}
+}
 
-	if m != nil && !m.Offset.Equal(lastConsumed) {
-		_, err := c.broker.MarkConsumed(context.TODO(), &sgproto.MarkRequest{
-			Topic:         c.topic,
-			Partition:     c.partition,
-			Channel:       c.channel,
-			ConsumerGroup: c.name,
-			Offsets:       []sgproto.Offset{m.Offset},
-		})
-		if err != nil {
-			c.logger.WithError(err).Debugf("unable to mark as consumed")
+// hasCredits returns whether a message can be sent to a receiver right away, or whether none is left
+func (c *ConsumerGroup) hasCredits() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, r := range c.receivers {
+		if r.window == 0 || r.credits > 0 {
+			return true
 		}
 	}
+
+	return len(c.receivers) == 0
+}
+
+// waitCredits blocks until a receiver has credits left, it returns false when stop is closed, ctx is
+// done or until is reached when set
+func (c *ConsumerGroup) waitCredits(ctx context.Context, stop <-chan struct{}, until time.Time) (bool, error) {
+	var deadline <-chan time.Time
+	if !until.IsZero() {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for !c.hasCredits() {
+		select {
+		case <-c.credited:
+		case <-c.changed:
+		case <-deadline:
+			return false, nil
+		case <-stop:
+			return false, errStopConsuming
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	return true, nil
+}
+
+// useCredit records that the receiver holds a credit for offset until it is released
+func (c *ConsumerGroup) useCredit(r *receiver, offset sgproto.Offset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.final[offset]; ok {
+		delete(c.final, offset)
+		return
+	}
+
+	if r.window == 0 {
+		return
+	}
+
+	r.credits--
+	if c.held == nil {
+		c.held = map[sgproto.Offset]*receiver{}
+	}
+	c.held[offset] = r
+}
+
+// deliverFinal records that offset is about to be delivered for the last time, it holds no credit
+func (c *ConsumerGroup) deliverFinal(offset sgproto.Offset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.final == nil {
+		c.final = map[sgproto.Offset]struct{}{}
+	}
+	c.final[offset] = struct{}{}
+}
+
+// release gives back the credits held for the offsets, once they are acknowledged, not acknowledged,
+// redelivered, expired or committed. Credits are given back up to the credits the receivers started with.
+func (c *ConsumerGroup) release(offsets ...sgproto.Offset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, offset := range offsets {
+		r, ok := c.held[offset]
+		if !ok {
+			continue
+		}
+		delete(c.held, offset)
+
+		if r.credits < r.window {
+			r.credits++
+		}
+
+		select {
+		case c.credited <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// releaseTo gives back the credits held for the offsets up to offset, once they are committed
+func (c *ConsumerGroup) releaseTo(offset sgproto.Offset) {
+	c.mu.RLock()
+	var offsets []sgproto.Offset
+	for held := range c.held {
+		if bytes.Compare(held[:], offset[:]) <= 0 {
+			offsets = append(offsets, held)
+		}
+	}
+	c.mu.RUnlock()
+
+	c.release(offsets...)
+}
+
+func (c *ConsumerGroup) markConsumed(m *sgproto.Message, from sgproto.Offset) {
+	if m == nil || m.Offset.Equal(from) {
+		return
+	}
+
+	_, err := c.broker.MarkConsumed(context.TODO(), &sgproto.MarkRequest{
+		Topic:         c.topic,
+		Partition:     c.partition,
+		Channel:       c.channel,
+		ConsumerGroup: c.name,
+		Offsets:       []sgproto.Offset{m.Offset},
+	})
+	if err != nil {
+		c.logger.WithError(err).Debugf("unable to mark as consumed")
+	}
+}
+
+// keepFollowers closes the receivers which do not follow the group and removes the ones which left,
+// it returns whether some are still attached
+func (c *ConsumerGroup) keepFollowers() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	receivers := c.receivers[:0]
+	for _, r := range c.receivers {
+		select {
+		case <-r.doneCh:
+			continue
+		default:
+		}
+
+		if !r.follow {
+			close(r.msgCh)
+			continue
+		}
+		receivers = append(receivers, r)
+	}
+	c.receivers = receivers
+
+	return len(c.receivers) > 0
+}
+
+// waitDue blocks until a message following from is due, a consumer joins or leaves the group or the timeout elapses
+func (c *ConsumerGroup) waitDue(from sgproto.Offset, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.broker.WaitDue(ctx, &sgproto.WaitDueRequest{
+			Topic:     c.topic,
+			Partition: c.partition,
+			Channel:   c.channel,
+			After:     from,
+		})
+		errCh <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-c.changed:
+		return nil
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *ConsumerGroup) signalChange() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// leave detaches a consumer, the group stops sending it messages
+func (c *ConsumerGroup) leave(closeCh chan<- struct{}) {
+	close(closeCh)
+	c.signalChange()
+}
+
+// expire acknowledges an expired message instead of delivering it and copies it to the expired channel
+// of the topic when it has one. Every consumer group expiring the message produces the same copy, as the
+// first batch of a producer named after its offset, so that the partition stores it once. A group
+// expiring it after the producer was evicted, see topic.ProducerIdleTimeout, stores it again.
+func (c *ConsumerGroup) expire(ctx context.Context, m *sgproto.Message) error {
+	c.release(m.Offset)
+
+	_, err := c.broker.Mark(ctx, &sgproto.MarkRequest{
+		Topic:         c.topic,
+		Partition:     c.partition,
+		Channel:       c.channel,
+		ConsumerGroup: c.name,
+		Offsets:       []sgproto.Offset{m.Offset},
+		State: &sgproto.MarkState{
+			Kind:   sgproto.MarkKind_Acknowledged,
+			Reason: sgproto.MarkReason_Expired,
+		},
+	})
+	if err != nil {
+		c.logger.WithError(err).Debugf("error while acking expired message")
+		return err
+	}
+
+	t := c.broker.getTopic(c.topic)
+	if t == nil || t.ExpiredChannel == "" || t.ExpiredChannel == c.channel {
+		return nil
+	}
+
+	expired := *m
+	expired.Channel = t.ExpiredChannel
+	expired.ExpiresAt = time.Time{}
+	expired.Ttl = 0
+	_, err = c.broker.Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:      c.topic,
+		Partition:  c.partition,
+		Messages:   []*sgproto.Message{&expired},
+		ProducerId: "expired/" + m.Offset.String(),
+		Sequence:   1,
+	})
+	if err != nil {
+		c.logger.WithError(err).Debugf("error producing expired message")
+	}
+	return err
 }
 
 func (c *ConsumerGroup) shouldRedeliver(m *sgproto.Message, state sgproto.MarkState) bool {
@@ -377,8 +813,12 @@ func (c *ConsumerGroup) getReceiver(consumerName string) *receiver {
 	return nil
 }
 
-func (c *ConsumerGroup) Consume(consumerName string) (<-chan *sgproto.Message, chan<- struct{}, error) {
-	r := c.register(consumerName)
+// Consume attaches a consumer to the group, the returned channel is closed once the messages due now
+// are consumed unless it follows the group. It is sent at most credits messages in flight when credits is set,
+// see sgproto.ConsumeFromGroupRequest: each holds a credit until it is acknowledged, not acknowledged,
+// redelivered, expired or committed.
+func (c *ConsumerGroup) Consume(consumerName string, follow bool, credits uint32) (<-chan *sgproto.Message, chan<- struct{}, error) {
+	r := c.register(consumerName, follow, credits)
 
 	return r.msgCh, r.doneCh, nil
 }
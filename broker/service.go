@@ -13,7 +13,7 @@ import (
 func (b *Broker) GetTopic(ctx context.Context, req *sgproto.GetTopicParams) (*sgproto.GetTopicReply, error) {
 	t := b.raft.GetTopic(req.Name)
 	if t == nil {
-		return nil, status.Errorf(codes.NotFound, "topic '%s' not found")
+		return nil, status.Errorf(codes.NotFound, "topic '%s' not found", req.Name)
 	}
 	partitions := t.ListPartitions()
 	res := make([]string, len(partitions))
@@ -27,6 +27,10 @@ func (b *Broker) GetTopic(ctx context.Context, req *sgproto.GetTopicParams) (*sg
 	}, nil
 }
 
+func (b *Broker) ProduceStream(stream sgproto.BrokerService_ProduceStreamServer) error {
+	return b.produceStream(stream.Context(), stream.Recv, stream.Send)
+}
+
 func (b *Broker) FetchFrom(req *sgproto.FetchFromRequest, stream sgproto.BrokerService_FetchFromServer) error {
 	partitionReq := &sgproto.FetchRangeRequest{
 		Topic:     req.Topic,
@@ -135,5 +139,62 @@ func (b *Broker) FetchFromSync(req *sgproto.FetchFromSyncRequest, stream sgproto
 	})
 }
 
+func (b *Broker) RegisterConsumerGroup(ctx context.Context, req *sgproto.RegisterConsumerGroupRequest) (*sgproto.RegisterConsumerGroupReply, error) {
+	err := b.registerConsumerGroup(ctx, req.Topic, req.Partition, req.Channel, req.ConsumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sgproto.RegisterConsumerGroupReply{
+		Success: true,
+	}, nil
+}
+
+func (b *Broker) Compact(req *sgproto.CompactRequest, stream sgproto.BrokerService_CompactServer) error {
+	return b.compact(stream.Context(), req, func(progress *sgproto.CompactProgress) error {
+		return stream.Send(progress)
+	})
+}
+
+func (b *Broker) CompactPartition(req *sgproto.CompactRequest, stream sgproto.InternalService_CompactPartitionServer) error {
+	return b.compactPartition(req.Topic, req.Partition, func(progress *sgproto.CompactProgress) error {
+		return stream.Send(progress)
+	})
+}
+
+func (b *Broker) GetTopicStats(ctx context.Context, req *sgproto.TopicStatsRequest) (*sgproto.TopicStatsReply, error) {
+	return b.topicStats(ctx, req)
+}
+
+func (b *Broker) GetLocalTopicStats(ctx context.Context, req *sgproto.TopicStatsRequest) (*sgproto.TopicStatsReply, error) {
+	return b.localTopicStats(req.Topic, req.Partition)
+}
+
+func (b *Broker) Backup(req *sgproto.BackupRequest, stream sgproto.BrokerService_BackupServer) error {
+	return b.backup(stream.Context(), req, stream.Send)
+}
+
+func (b *Broker) Restore(stream sgproto.BrokerService_RestoreServer) error {
+	res, err := b.restore(stream.Context(), stream.Recv)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(res)
+}
+
+func (b *Broker) BackupPartition(req *sgproto.BackupPartitionRequest, stream sgproto.InternalService_BackupPartitionServer) error {
+	return b.backupPartition(req.Topic, req.Partition, req.HwMark, stream.Send)
+}
+
+func (b *Broker) RestorePartition(stream sgproto.InternalService_RestorePartitionServer) error {
+	res, err := b.restorePartition(stream.Recv)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(res)
+}
+
 var _ sgproto.BrokerServiceServer = (*Broker)(nil)
 var _ sgproto.InternalServiceServer = (*Broker)(nil)
@@ -0,0 +1,147 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"google.golang.org/grpc"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/spf13/cobra"
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup [topics...]",
+	Short: "Back up topics",
+	Long: `Write a point-in-time backup of the given topics, all of them when none is given.
+Each partition is backed up by its leader up to its HW mark, along with the config of its topic.
+Consumer group offsets are not backed up. Use restore to recreate the topics on another cluster.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "" && output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		bw := bufio.NewWriter(w)
+
+		stream, err := client.Backup(context.Background(), &sgproto.BackupRequest{
+			Topics: args,
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		var size int
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Fatal(grpc.ErrorDesc(err))
+			}
+
+			switch {
+			case chunk.Topic != nil:
+				fmt.Fprintf(os.Stderr, "backing up topic %s\n", chunk.Topic.Name)
+			case chunk.Partition != "":
+				fmt.Fprintf(os.Stderr, "  partition %s up to index %d\n", chunk.Partition, chunk.HwMark)
+			}
+
+			n, err := writeChunk(bw, chunk)
+			if err != nil {
+				log.Fatal(err)
+			}
+			size += n
+		}
+
+		if err := bw.Flush(); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(os.Stderr, "backup done, %d bytes written\n", size)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(backupCmd)
+
+	backupCmd.Flags().StringP("output", "o", "", "File to write the backup to (default: stdout)")
+}
+
+// a backup file is a sequence of backup chunks, each one prefixed by its size as a uvarint
+
+func writeChunk(w io.Writer, chunk *sgproto.BackupChunk) (int, error) {
+	data, err := chunk.Marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	return writeDelimited(w, data)
+}
+
+func readChunk(r *bufio.Reader) (*sgproto.BackupChunk, error) {
+	data, err := readDelimited(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunk sgproto.BackupChunk
+	if err := chunk.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+// writeDelimited writes data prefixed by its size as a uvarint
+func writeDelimited(w io.Writer, data []byte) (int, error) {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(buf, uint64(len(data)))
+	buf = append(buf[:n], data...)
+
+	return w.Write(buf)
+}
+
+func readDelimited(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,126 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/spf13/cobra"
+)
+
+// cancelCmd represents the cancel command
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [topic] [partition] [offset]",
+	Short: "Cancel a delayed message",
+	Long:  `Withdraw a message of a timer topic before it is due, consumer groups never deliver it afterwards`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 3 {
+			log.Fatal("you should provide a topic, a partition and an offset")
+		}
+
+		offset, err := parseOffset(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		channel, err := cmd.Flags().GetString("channel")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		_, err = client.Cancel(context.Background(), &sgproto.CancelRequest{
+			Topic:     args[0],
+			Partition: args[1],
+			Channel:   channel,
+			Offset:    offset,
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		fmt.Println("OK")
+	},
+}
+
+// rescheduleCmd represents the reschedule command
+var rescheduleCmd = &cobra.Command{
+	Use:   "reschedule [topic] [partition] [offset]",
+	Short: "Reschedule a delayed message",
+	Long:  `Move a message of a timer topic to a new time before it is due and print its new offset`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 3 {
+			log.Fatal("you should provide a topic, a partition and an offset")
+		}
+
+		offset, err := parseOffset(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		channel, err := cmd.Flags().GetString("channel")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		in, err := cmd.Flags().GetDuration("in")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		at := time.Now().Add(in)
+		if cmd.Flag("at").Changed {
+			s, err := cmd.Flags().GetString("at")
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			at, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				log.Fatalf("invalid time, expected RFC3339: %s", s)
+			}
+		} else if !cmd.Flag("in").Changed {
+			log.Fatal("you should provide --at or --in")
+		}
+
+		res, err := client.Reschedule(context.Background(), &sgproto.RescheduleRequest{
+			Topic:     args[0],
+			Partition: args[1],
+			Channel:   channel,
+			Offset:    offset,
+			ConsumeAt: at.UTC(),
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		fmt.Println(res.Offset.String())
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cancelCmd)
+	RootCmd.AddCommand(rescheduleCmd)
+
+	cancelCmd.Flags().String("channel", "", "Channel of the message (default: master)")
+	rescheduleCmd.Flags().String("channel", "", "Channel of the message (default: master)")
+	rescheduleCmd.Flags().String("at", "", "New time of the message (RFC3339)")
+	rescheduleCmd.Flags().Duration("in", 0, "New time of the message relative to now")
+}
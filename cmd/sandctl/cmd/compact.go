@@ -0,0 +1,75 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"google.golang.org/grpc"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/spf13/cobra"
+)
+
+// compactCmd represents the compact command
+var compactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Compact a KV topic",
+	Long:  `Remove the outdated versions of the messages of a KV topic on every replica`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("only one topic is allowed")
+		}
+
+		partition, err := cmd.Flags().GetString("partition")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		stream, err := client.Compact(context.Background(), &sgproto.CompactRequest{
+			Topic:     args[0],
+			Partition: partition,
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		for {
+			progress, err := stream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Fatal(grpc.ErrorDesc(err))
+			}
+
+			status := "compacting"
+			if progress.Done {
+				status = "done"
+			}
+
+			fmt.Printf("%s/%s on %s: %s, %d entries scanned, %d deleted\n",
+				progress.Topic, progress.Partition, progress.Replica, status, progress.Scanned, progress.Deleted)
+		}
+	},
+}
+
+func init() {
+	topicsCmd.AddCommand(compactCmd)
+
+	compactCmd.Flags().String("partition", "", "Partition to compact (default: all)")
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
 	"time"
 
 	"github.com/sandglass/sandglass/cmd/cmdcommon"
@@ -43,6 +44,10 @@ var consumeCmd = &cobra.Command{
 		}
 		topic := args[0]
 
+		if viper.GetInt("credits") > 0 && !viper.GetBool("ack") {
+			log.Fatal("credits are given back by acks, they cannot be used without --ack")
+		}
+
 		consumerGroup := viper.GetString("consumer-group")
 		consumerName := viper.GetString("consumer-name")
 		if consumerName == "" {
@@ -79,7 +84,19 @@ var consumeCmd = &cobra.Command{
 			close(msgCh)
 		}()
 
+		printHeaders := viper.GetBool("headers")
 		for msg := range msgCh {
+			if printHeaders {
+				names := make([]string, 0, len(msg.Headers))
+				for name := range msg.Headers {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				for _, name := range names {
+					fmt.Printf("%s=%s\n", name, msg.Headers[name])
+				}
+			}
 			fmt.Println(string(msg.Value))
 		}
 
@@ -92,9 +109,12 @@ func init() {
 	consumeCmd.Flags().String("partition", "random", "Partition to produce in")
 	consumeCmd.Flags().String("consumer-group", "sandctl", "Consumer group")
 	consumeCmd.Flags().String("consumer-name", "", "Consumer name (default: random)")
-	consumeCmd.Flags().Duration("poll-interval", 50*time.Millisecond, "Poll interval")
-	consumeCmd.Flags().BoolP("follow", "f", false, "Consumer name (default: random)")
+	consumeCmd.Flags().Duration("poll-interval", 50*time.Millisecond, "Time to wait before consuming again when following and the stream ends")
+	consumeCmd.Flags().BoolP("follow", "f", false, "Keep consuming, messages are received as soon as they are produced or due")
 	consumeCmd.Flags().Bool("ack", true, "Ack messages (batching 10k messages)")
+	consumeCmd.Flags().Bool("headers", false, "Print the headers of each message before its value")
+	consumeCmd.Flags().Uint32("credits", 0, "Maximum number of unacknowledged messages sent per partition (default: unbounded)")
+	consumeCmd.Flags().Duration("heartbeat", 10*time.Second, "Interval of the heartbeats sent when following, the stream is reconnected after three are missed")
 
 	cmdcommon.BindViper(consumeCmd.Flags(),
 		"partition",
@@ -103,19 +123,44 @@ func init() {
 		"poll-interval",
 		"follow",
 		"ack",
+		"headers",
+		"credits",
+		"heartbeat",
 	)
 }
 
 func consume(msgCh chan *sgproto.Message, topic, partition, group, name string, follow, ack bool) {
-	ctx := context.Background()
+	credits := uint32(viper.GetInt("credits"))
+	var heartbeat time.Duration
+	if follow {
+		heartbeat = viper.GetDuration("heartbeat")
+	}
+
+	// acks give credits back, they are sent before running out of them
+	batch := 1000
+	if follow {
+		batch = 1
+	} else if credits > 0 && int(credits) < batch {
+		batch = int(credits)
+	}
 
 FOLLOW:
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the stream is reconnected when it stays silent for three heartbeats
+	var watchdog *time.Timer
+	if heartbeat > 0 {
+		watchdog = time.AfterFunc(3*heartbeat, cancel)
+	}
 
 	stream, err := client.ConsumeFromGroup(ctx, &sgproto.ConsumeFromGroupRequest{
 		Topic:             topic,
 		Partition:         partition,
 		ConsumerGroupName: group,
 		ConsumerName:      name,
+		Follow:            follow,
+		Credits:           credits,
+		HeartbeatInterval: heartbeat,
 	})
 	if err != nil {
 		panic(err)
@@ -137,17 +182,28 @@ FOLLOW:
 		msg, err := stream.Recv()
 		if err == io.EOF {
 			break
+		} else if err != nil && ctx.Err() != nil {
+			log.Printf("no heartbeat received from partition %s, reconnecting", partition)
+			break
 		} else if err != nil {
 			panic(err)
 		}
 
+		if watchdog != nil {
+			watchdog.Reset(3 * heartbeat)
+		}
+
+		if msg.Heartbeat {
+			continue
+		}
+
 		msgCh <- msg
 
 		if ack {
 			offsets = append(offsets, msg.Offset)
 		}
 
-		if ack && len(offsets) == 1000 {
+		if ack && len(offsets) >= batch {
 			err := ackFn(offsets)
 			if err != nil {
 				panic(err)
@@ -157,6 +213,11 @@ FOLLOW:
 		}
 	}
 
+	if watchdog != nil {
+		watchdog.Stop()
+	}
+	cancel()
+
 	if ack && len(offsets) > 0 {
 		err := ackFn(offsets)
 		if err != nil {
@@ -164,7 +225,7 @@ FOLLOW:
 		}
 	}
 
-	if follow {
+	if follow { // the stream ends when the consumer group stops, e.g. on a leadership change
 		time.Sleep(viper.GetDuration("poll-interval"))
 		goto FOLLOW
 	}
@@ -40,15 +40,62 @@ var createCmd = &cobra.Command{
 		}
 		name := args[0]
 
+		kind, ok := sgproto.TopicKind_value[viper.GetString("kind")]
+		if !ok {
+			log.Fatalf("unknown topic kind: %s", viper.GetString("kind"))
+		}
+
+		storageDriver, ok := sgproto.StorageDriver_value[viper.GetString("storage_driver")]
+		if !ok {
+			log.Fatalf("unknown storage driver: %s", viper.GetString("storage_driver"))
+		}
+
+		compressionCodec, ok := sgproto.CompressionCodec_value[viper.GetString("compression_codec")]
+		if !ok {
+			log.Fatalf("unknown compression codec: %s", viper.GetString("compression_codec"))
+		}
+
+		compactionStyle, ok := sgproto.CompactionStyle_value[viper.GetString("storage_compaction_style")]
+		if !ok {
+			log.Fatalf("unknown compaction style: %s", viper.GetString("storage_compaction_style"))
+		}
+
+		syncMode, ok := sgproto.SyncMode_value[viper.GetString("storage_sync_mode")]
+		if !ok {
+			log.Fatalf("unknown sync mode: %s", viper.GetString("storage_sync_mode"))
+		}
+
+		partitioner, ok := sgproto.Partitioner_value[viper.GetString("partitioner")]
+		if !ok {
+			log.Fatalf("unknown partitioner: %s", viper.GetString("partitioner"))
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
 		defer cancel()
 
 		_, err := client.CreateTopic(ctx, &sgproto.TopicConfig{
-			Name:              name,
-			ReplicationFactor: int32(viper.GetInt("replication_factor")),
-			NumPartitions:     int32(viper.GetInt("num_partitions")),
-			Kind:              sgproto.TopicKind(sgproto.TopicKind_value[viper.GetString("storage_driver")]),
-			StorageDriver:     sgproto.StorageDriver(sgproto.StorageDriver_value[viper.GetString("num_partitions")]),
+			Name:                   name,
+			ReplicationFactor:      int32(viper.GetInt("replication_factor")),
+			NumPartitions:          int32(viper.GetInt("num_partitions")),
+			Kind:                   sgproto.TopicKind(kind),
+			StorageDriver:          sgproto.StorageDriver(storageDriver),
+			RetentionMaxAge:        viper.GetDuration("retention_max_age"),
+			RetentionMaxBytes:      viper.GetInt64("retention_max_bytes"),
+			CompactByKey:           viper.GetBool("compact_by_key"),
+			BloomFalsePositiveRate: viper.GetFloat64("bloom_false_positive_rate"),
+			CompressionCodec:       sgproto.CompressionCodec(compressionCodec),
+			Encrypted:              viper.GetBool("encrypted"),
+			StorageOptions: &sgproto.StorageOptions{
+				BlockCacheSize:           viper.GetInt64("storage_block_cache_size"),
+				CompressedBlockCacheSize: viper.GetInt64("storage_compressed_block_cache_size"),
+				BloomBitsPerKey:          int32(viper.GetInt("storage_bloom_bits_per_key")),
+				SyncMode:                 sgproto.SyncMode(syncMode),
+				ValueThreshold:           int32(viper.GetInt("storage_value_threshold")),
+				ValueLogFileSize:         viper.GetInt64("storage_value_log_file_size"),
+				CompactionStyle:          sgproto.CompactionStyle(compactionStyle),
+			},
+			Partitioner:    sgproto.Partitioner(partitioner),
+			ExpiredChannel: viper.GetString("expired_channel"),
 		})
 		if err != nil {
 			fmt.Println(grpc.ErrorDesc(err))
@@ -64,13 +111,43 @@ func init() {
 
 	createCmd.Flags().IntP("replication_factor", "r", 0, "Replication factor")
 	createCmd.Flags().IntP("num_partitions", "p", 0, "Number of partitions")
-	createCmd.Flags().String("storage_driver", sgproto.StorageDriver_RocksDB.String(), "Number of partitions")
+	createCmd.Flags().String("storage_driver", sgproto.StorageDriver_RocksDB.String(), "Storage driver (RocksDB, Badger, Memory or Bolt)")
 	createCmd.Flags().String("kind", sgproto.TopicKind_TimerKind.String(), "Topic kind")
+	createCmd.Flags().String("compression_codec", sgproto.CompressionCodec_NoCompression.String(), "Compression codec of message values (NoCompression, Gzip or Flate)")
+	createCmd.Flags().String("partitioner", sgproto.Partitioner_DefaultPartitioner.String(), "Partitioner of the messages produced without partition (RandomPartitioner, KeyHashPartitioner, RoundRobinPartitioner or ExplicitPartitioner)")
+	createCmd.Flags().String("expired_channel", "", "Channel receiving a copy of the expired messages skipped by consumer groups (default: none)")
+	createCmd.Flags().Bool("encrypted", false, "Encrypt messages at rest, brokers should be configured with a keyring")
+	createCmd.Flags().Duration("retention_max_age", 0, "Maximum age of messages, relative to their offset (0 keeps messages forever)")
+	createCmd.Flags().Int64("retention_max_bytes", 0, "Maximum size in bytes of each partition (0 for unlimited)")
+	createCmd.Flags().Float64("bloom_false_positive_rate", 0, "False positive rate of the bloom filters of KV topics (default 0.01)")
+	createCmd.Flags().Bool("compact_by_key", false, "Keep a single version per key when compacting a KV topic, regardless of clustering keys")
+	createCmd.Flags().String("storage_sync_mode", sgproto.SyncMode_DefaultSync.String(), "Whether Badger and Bolt fsync each write (NoSync or SyncWrites, default: broker setting), recent messages may be lost on a crash with NoSync")
+	createCmd.Flags().Int64("storage_block_cache_size", 0, "Size in bytes of the RocksDB block cache (default: broker setting)")
+	createCmd.Flags().Int64("storage_compressed_block_cache_size", 0, "Size in bytes of the RocksDB compressed block cache (default: broker setting)")
+	createCmd.Flags().Int("storage_bloom_bits_per_key", 0, "Bits per key of the RocksDB bloom filters (default: broker setting)")
+	createCmd.Flags().Int("storage_value_threshold", 0, "Size in bytes from which Badger stores values in its value log (default: broker setting)")
+	createCmd.Flags().Int64("storage_value_log_file_size", 0, "Maximum size in bytes of the Badger value log files (default: broker setting)")
+	createCmd.Flags().String("storage_compaction_style", sgproto.CompactionStyle_DefaultCompaction.String(), "RocksDB compaction style (LevelCompaction, UniversalCompaction or FIFOCompaction)")
 
 	cmdcommon.BindViper(createCmd.Flags(),
 		"replication_factor",
 		"num_partitions",
 		"storage_driver",
 		"kind",
+		"compression_codec",
+		"partitioner",
+		"expired_channel",
+		"encrypted",
+		"retention_max_age",
+		"retention_max_bytes",
+		"compact_by_key",
+		"bloom_false_positive_rate",
+		"storage_sync_mode",
+		"storage_block_cache_size",
+		"storage_compressed_block_cache_size",
+		"storage_bloom_bits_per_key",
+		"storage_value_threshold",
+		"storage_value_log_file_size",
+		"storage_compaction_style",
 	)
 }
@@ -0,0 +1,89 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"google.golang.org/grpc"
+
+	"github.com/spf13/viper"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/spf13/cobra"
+)
+
+// describeCmd represents the describe command
+var describeCmd = &cobra.Command{
+	Use:   "describe",
+	Short: "Describe the storage of a topic",
+	Long:  `Show the approximate storage statistics of a topic on every replica: disk usage, engine statistics and the number of entries of each partition`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("only one topic is allowed")
+		}
+
+		partition, err := cmd.Flags().GetString("partition")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+		defer cancel()
+
+		stats, err := client.GetTopicStats(ctx, &sgproto.TopicStatsRequest{
+			Topic:     args[0],
+			Partition: partition,
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		fmt.Printf("topic: %s\n\n", stats.Topic)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PARTITION\tREPLICA\tWAL ENTRIES\tWAL BYTES\tVIEW ENTRIES\tVIEW BYTES")
+		for _, p := range stats.Partitions {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", p.Partition, p.Replica, p.WalEntries, p.WalBytes, p.ViewEntries, p.ViewBytes)
+		}
+		w.Flush()
+
+		for _, s := range stats.Storages {
+			fmt.Printf("\nstorage on %s: %s, %d bytes on disk\n", s.Replica, s.StorageDriver, s.DiskBytes)
+
+			names := make([]string, 0, len(s.Properties))
+			for name := range s.Properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				fmt.Fprintf(w, "  %s\t%s\n", name, s.Properties[name])
+			}
+			w.Flush()
+		}
+	},
+}
+
+func init() {
+	topicsCmd.AddCommand(describeCmd)
+
+	describeCmd.Flags().String("partition", "", "Partition to describe (default: all)")
+}
@@ -0,0 +1,344 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the messages of a topic",
+	Long: `Write the messages of a channel of a topic, with their offsets, keys and production times,
+to a file that can be imported into another topic with import, whatever its storage driver.
+Only the last version of each key of a KV topic is exported.
+
+Formats:
+  proto: records encoded as protobuf, each one prefixed by its size as a uvarint
+  json:  one JSON record per line, bytes being encoded in base64`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("only one topic is allowed")
+		}
+
+		flags := cmd.Flags()
+		partition, err := flags.GetString("partition")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		channel, err := flags.GetString("channel")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		format, err := flags.GetString("format")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		output, err := flags.GetString("output")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "" && output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		rw, err := newRecordWriter(format, w)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx := context.Background()
+		t, err := client.GetTopic(ctx, &sgproto.GetTopicParams{
+			Name: args[0],
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		// every partition is listed, their order is used to map them to the partitions of another topic
+		err = rw.Write(&sgproto.ExportRecord{
+			Topic:      t.Name,
+			Partitions: t.Partitions,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		partitions := t.Partitions
+		if partition != "" {
+			partitions = []string{partition}
+		}
+
+		for _, part := range partitions {
+			stream, err := client.FetchRange(ctx, &sgproto.FetchRangeRequest{
+				Topic:     t.Name,
+				Partition: part,
+				Channel:   channel,
+				From:      sgproto.Nil,
+				To:        sgproto.MaxOffset,
+			})
+			if err != nil {
+				log.Fatal(grpc.ErrorDesc(err))
+			}
+
+			var count int
+			for {
+				msg, err := stream.Recv()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					log.Fatal(grpc.ErrorDesc(err))
+				}
+
+				// the index is local to the WAL of the partition
+				msg.Index = 0
+				err = rw.Write(&sgproto.ExportRecord{
+					Partition: part,
+					Message:   msg,
+				})
+				if err != nil {
+					log.Fatal(err)
+				}
+				count++
+			}
+
+			fmt.Fprintf(os.Stderr, "partition %s: %d messages exported\n", part, count)
+		}
+
+		if err := rw.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	topicsCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().String("partition", "", "Partition to export (default: all)")
+	exportCmd.Flags().String("channel", "", "Channel to export (default: master)")
+	exportCmd.Flags().String("format", "proto", "Format of the export: proto or json")
+	exportCmd.Flags().StringP("output", "o", "", "File to write the export to (default: stdout)")
+}
+
+type recordWriter interface {
+	Write(rec *sgproto.ExportRecord) error
+	Flush() error
+}
+
+type recordReader interface {
+	// Read returns io.EOF once every record was read
+	Read() (*sgproto.ExportRecord, error)
+}
+
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "proto":
+		return &protoRecordWriter{w: bw}, nil
+	case "json":
+		return &jsonRecordWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format: %v", format)
+}
+
+func newRecordReader(format string, r io.Reader) (recordReader, error) {
+	br := bufio.NewReader(r)
+	switch format {
+	case "proto":
+		return &protoRecordReader{r: br}, nil
+	case "json":
+		return &jsonRecordReader{dec: json.NewDecoder(br)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format: %v", format)
+}
+
+type protoRecordWriter struct {
+	w *bufio.Writer
+}
+
+func (rw *protoRecordWriter) Write(rec *sgproto.ExportRecord) error {
+	data, err := rec.Marshal()
+	if err != nil {
+		return err
+	}
+
+	_, err = writeDelimited(rw.w, data)
+	return err
+}
+
+func (rw *protoRecordWriter) Flush() error { return rw.w.Flush() }
+
+type protoRecordReader struct {
+	r *bufio.Reader
+}
+
+func (rr *protoRecordReader) Read() (*sgproto.ExportRecord, error) {
+	data, err := readDelimited(rr.r)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec sgproto.ExportRecord
+	if err := rec.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// jsonRecord is the JSON representation of an export record
+type jsonRecord struct {
+	Topic      string       `json:"topic,omitempty"`
+	Partitions []string     `json:"partitions,omitempty"`
+	Partition  string       `json:"partition,omitempty"`
+	Message    *jsonMessage `json:"message,omitempty"`
+}
+
+type jsonMessage struct {
+	Channel       string            `json:"channel"`
+	Offset        string            `json:"offset"`
+	ProducedAt    time.Time         `json:"producedAt"`
+	ConsumeIn     string            `json:"consumeIn,omitempty"`
+	ExpiresAt     *time.Time        `json:"expiresAt,omitempty"`
+	Key           []byte            `json:"key,omitempty"`
+	ClusteringKey []byte            `json:"clusteringKey,omitempty"`
+	Value         []byte            `json:"value,omitempty"`
+	Headers       map[string][]byte `json:"headers,omitempty"`
+	Tombstone     bool              `json:"tombstone,omitempty"`
+}
+
+type jsonRecordWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (rw *jsonRecordWriter) Write(rec *sgproto.ExportRecord) error {
+	jrec := &jsonRecord{
+		Topic:      rec.Topic,
+		Partitions: rec.Partitions,
+		Partition:  rec.Partition,
+	}
+
+	if msg := rec.Message; msg != nil {
+		jrec.Message = &jsonMessage{
+			Channel:       msg.Channel,
+			Offset:        msg.Offset.String(),
+			ProducedAt:    msg.ProducedAt,
+			Key:           msg.Key,
+			ClusteringKey: msg.ClusteringKey,
+			Value:         msg.Value,
+			Headers:       msg.Headers,
+			Tombstone:     msg.Tombstone,
+		}
+		if msg.ConsumeIn != 0 {
+			jrec.Message.ConsumeIn = msg.ConsumeIn.String()
+		}
+		if !msg.ExpiresAt.IsZero() {
+			expiresAt := msg.ExpiresAt
+			jrec.Message.ExpiresAt = &expiresAt
+		}
+	}
+
+	return rw.enc.Encode(jrec)
+}
+
+func (rw *jsonRecordWriter) Flush() error { return rw.w.Flush() }
+
+type jsonRecordReader struct {
+	dec *json.Decoder
+}
+
+func (rr *jsonRecordReader) Read() (*sgproto.ExportRecord, error) {
+	var jrec jsonRecord
+	if err := rr.dec.Decode(&jrec); err != nil {
+		return nil, err
+	}
+
+	rec := &sgproto.ExportRecord{
+		Topic:      jrec.Topic,
+		Partitions: jrec.Partitions,
+		Partition:  jrec.Partition,
+	}
+
+	if jmsg := jrec.Message; jmsg != nil {
+		offset, err := parseOffset(jmsg.Offset)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := &sgproto.Message{
+			Channel:       jmsg.Channel,
+			Offset:        offset,
+			ProducedAt:    jmsg.ProducedAt,
+			Key:           jmsg.Key,
+			ClusteringKey: jmsg.ClusteringKey,
+			Value:         jmsg.Value,
+			Headers:       jmsg.Headers,
+			Tombstone:     jmsg.Tombstone,
+		}
+
+		if jmsg.ConsumeIn != "" {
+			msg.ConsumeIn, err = time.ParseDuration(jmsg.ConsumeIn)
+			if err != nil {
+				return nil, fmt.Errorf("invalid consumeIn: %v", jmsg.ConsumeIn)
+			}
+		}
+
+		if jmsg.ExpiresAt != nil {
+			msg.ExpiresAt = *jmsg.ExpiresAt
+		}
+
+		rec.Message = msg
+	}
+
+	return rec, nil
+}
+
+// parseOffset parses an offset printed in hex
+func parseOffset(s string) (sgproto.Offset, error) {
+	var offset sgproto.Offset
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sgproto.Size {
+		return offset, fmt.Errorf("invalid offset: %v", s)
+	}
+
+	copy(offset[:], b)
+	return offset, nil
+}
@@ -0,0 +1,194 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"google.golang.org/grpc"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/spf13/cobra"
+)
+
+// number of messages produced per request when importing
+const importBatchSize = 1000
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import [topic]",
+	Short: "Import messages exported from a topic",
+	Long: `Produce the messages of an export made with the export command, keeping their offsets and production times.
+The topic, the exported one by default, should already exist. When it does not have the partitions of the exported topic,
+the messages of each exported partition are imported into the partition at the same position, both topics should then
+have the same number of partitions.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			log.Fatal("only one topic is allowed")
+		}
+
+		flags := cmd.Flags()
+		format, err := flags.GetString("format")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		input, err := flags.GetString("input")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var r io.Reader = os.Stdin
+		if input != "" && input != "-" {
+			f, err := os.Open(input)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		rr, err := newRecordReader(format, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		header, err := rr.Read()
+		if err != nil {
+			log.Fatalf("unable to read the export header: %v", err)
+		}
+
+		if header.Topic == "" || header.Message != nil {
+			log.Fatal("the export does not start with its header")
+		}
+
+		name := header.Topic
+		if len(args) == 1 {
+			name = args[0]
+		}
+
+		ctx := context.Background()
+		t, err := client.GetTopic(ctx, &sgproto.GetTopicParams{
+			Name: name,
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		partitions, err := mapPartitions(header.Partitions, t.Partitions)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var (
+			partition string
+			batch     []*sgproto.Message
+			count     int
+		)
+
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+
+			_, err := client.Produce(ctx, &sgproto.ProduceMessageRequest{
+				Topic:              t.Name,
+				Partition:          partition,
+				Messages:           batch,
+				PreserveProducedAt: true,
+			})
+			if err != nil {
+				log.Fatal(grpc.ErrorDesc(err))
+			}
+
+			count += len(batch)
+			batch = batch[:0]
+		}
+
+		for {
+			rec, err := rr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Fatal(err)
+			}
+
+			if rec.Message == nil {
+				log.Fatal("invalid record: no message")
+			}
+
+			dest, ok := partitions[rec.Partition]
+			if !ok {
+				log.Fatalf("invalid record: unknown partition '%s'", rec.Partition)
+			}
+
+			if dest != partition || len(batch) == importBatchSize {
+				flush()
+				partition = dest
+			}
+
+			batch = append(batch, rec.Message)
+		}
+		flush()
+
+		fmt.Printf("%d messages imported into topic '%s'\n", count, t.Name)
+	},
+}
+
+func init() {
+	topicsCmd.AddCommand(importCmd)
+
+	importCmd.Flags().String("format", "proto", "Format of the export: proto or json")
+	importCmd.Flags().StringP("input", "i", "", "File to read the export from (default: stdin)")
+}
+
+// mapPartitions maps the exported partitions to the partitions of the topic, by id when the topic
+// has all of them and by position otherwise
+func mapPartitions(exported, partitions []string) (map[string]string, error) {
+	m := make(map[string]string, len(exported))
+
+	ids := make(map[string]bool, len(partitions))
+	for _, id := range partitions {
+		ids[id] = true
+	}
+
+	sameIds := true
+	for _, id := range exported {
+		if !ids[id] {
+			sameIds = false
+			break
+		}
+	}
+
+	if sameIds {
+		for _, id := range exported {
+			m[id] = id
+		}
+		return m, nil
+	}
+
+	if len(exported) != len(partitions) {
+		return nil, fmt.Errorf("the topic has %d partitions while the exported one had %d", len(partitions), len(exported))
+	}
+
+	for i, id := range exported {
+		m[id] = partitions[i]
+	}
+	return m, nil
+}
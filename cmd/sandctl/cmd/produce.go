@@ -17,8 +17,12 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"strings"
+
+	"google.golang.org/grpc"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
 
@@ -56,53 +60,133 @@ var produceCmd = &cobra.Command{
 			log.Fatal("you should provide a file or a payload")
 		}
 
+		acks, ok := sgproto.AckLevel_value[viper.GetString("acks")]
+		if !ok {
+			log.Fatalf("unknown ack level: %s", viper.GetString("acks"))
+		}
+
+		partitioner, ok := sgproto.Partitioner_value[viper.GetString("partitioner")]
+		if !ok {
+			log.Fatalf("unknown partitioner: %s", viper.GetString("partitioner"))
+		}
+
+		headers := parseHeaders(viper.GetStringSlice("header"))
+
 		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
 		defer cancel()
 
+		stream, err := client.ProduceStream(ctx)
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		// the batches are acknowledged while the next ones are sent
+		done := make(chan error, 1)
+		go func() {
+			for {
+				if _, err := stream.Recv(); err == io.EOF {
+					done <- nil
+					return
+				} else if err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+
+		var requestID uint64
 		produce := func(msgs []*sgproto.Message) error {
-			_, err := client.Produce(ctx, &sgproto.ProduceMessageRequest{
-				Topic:     topic,
-				Partition: partition,
-				Messages:  msgs,
+			requestID++
+			return stream.Send(&sgproto.ProduceMessageRequest{
+				Topic:       topic,
+				Partition:   partition,
+				Messages:    msgs,
+				Acks:        sgproto.AckLevel(acks),
+				AckTimeout:  viper.GetDuration("ack-timeout"),
+				Partitioner: sgproto.Partitioner(partitioner),
+				RequestId:   requestID,
 			})
-			return err
 		}
 
-		batchSize := 10000
+		var (
+			batchSize = 10000
+			number    = viper.GetInt("number")
+			batches   = (number + batchSize - 1) / batchSize
+			sent      int
+			sendErr   error
+		)
 		messages := make([]*sgproto.Message, 0, batchSize)
-		for i := 0; i < viper.GetInt("number"); i++ {
+		for i := 0; i < number; i++ {
 			messages = append(messages, &sgproto.Message{
-				Value: data,
+				Value:   data,
+				Headers: headers,
+				Ttl:     viper.GetDuration("ttl"),
 			})
 
-			if len(messages) == batchSize {
-				if err := produce(messages); err != nil {
-					panic(err)
+			if len(messages) == batchSize || i == number-1 {
+				if sendErr = produce(messages); sendErr != nil {
+					break
 				}
+				sent++
 				messages = messages[:0]
 			}
 		}
 
-		if len(messages) > 0 {
-			if err := produce(messages); err != nil {
-				panic(err)
+		stream.CloseSend()
+		err = <-done
+		if sent < batches {
+			// a failed send is reported by Recv, io.EOF is all Send knows
+			if err == nil {
+				err = sendErr
 			}
+			log.Fatalf("%d of %d batches were not sent: %s", batches-sent, batches, grpc.ErrorDesc(err))
+		}
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
 		}
 
 		fmt.Println("OK")
 	},
 }
 
+// parseHeaders parses name=value headers
+func parseHeaders(values []string) map[string][]byte {
+	var headers map[string][]byte
+	for _, h := range values {
+		parts := strings.SplitN(h, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("invalid header, expected name=value: %s", h)
+		}
+
+		if headers == nil {
+			headers = map[string][]byte{}
+		}
+		headers[parts[0]] = []byte(parts[1])
+	}
+
+	return headers
+}
+
 func init() {
 	RootCmd.AddCommand(produceCmd)
 
 	produceCmd.Flags().String("partition", "", "In which partition should we produce")
 	produceCmd.Flags().String("file", "", "File to produce")
 	produceCmd.Flags().IntP("number", "n", 1, "File to produce")
+	produceCmd.Flags().String("partitioner", sgproto.Partitioner_DefaultPartitioner.String(), "Partitioner used when no partition is set (default: the one of the topic)")
+	produceCmd.Flags().String("acks", sgproto.AckLevel_LeaderAck.String(), "Acknowledgement level (LeaderAck or ReplicatedAck)")
+	produceCmd.Flags().Duration("ack-timeout", 0, "Time to wait for the replication of the messages with ReplicatedAck (default: server default)")
+	produceCmd.Flags().Duration("ttl", 0, "Time after which consumer groups skip the messages, from the time they are due (0 never expires)")
+	produceCmd.Flags().StringSliceP("header", "H", nil, "Header of the messages as name=value, can be repeated")
 
 	cmdcommon.BindViper(produceCmd.Flags(),
 		"partition",
 		"file",
 		"number",
+		"acks",
+		"ack-timeout",
+		"partitioner",
+		"header",
+		"ttl",
 	)
 }
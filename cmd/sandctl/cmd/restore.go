@@ -0,0 +1,87 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"google.golang.org/grpc"
+
+	"github.com/spf13/cobra"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore topics from a backup",
+	Long: `Recreate the topics of a backup made with the backup command, with their config and partitions.
+The topics should not exist on the cluster.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		input, err := cmd.Flags().GetString("input")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var r io.Reader = os.Stdin
+		if input != "" && input != "-" {
+			f, err := os.Open(input)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			r = f
+		}
+		br := bufio.NewReader(r)
+
+		stream, err := client.Restore(context.Background())
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		for {
+			chunk, err := readChunk(br)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := stream.Send(chunk); err != nil {
+				// the actual error is returned by CloseAndRecv
+				break
+			}
+		}
+
+		reply, err := stream.CloseAndRecv()
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		for _, name := range reply.Topics {
+			fmt.Printf("topic '%s' was successfully restored\n", name)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().StringP("input", "i", "", "File to read the backup from (default: stdin)")
+}
@@ -0,0 +1,211 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/spf13/viper"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/spf13/cobra"
+)
+
+// schedulesCmd represents the schedules command
+var schedulesCmd = &cobra.Command{
+	Use:   "schedules",
+	Short: "Recurring schedules",
+	Long:  `Manage the recurring schedules of timer topics, the controller produces a message at each of their occurrences`,
+}
+
+// scheduleCreateCmd represents the schedules create command
+var scheduleCreateCmd = &cobra.Command{
+	Use:   "create [topic] [name] [payload]",
+	Short: "Create a recurring schedule",
+	Long:  `Register a schedule producing the payload at each occurrence of a cron expression (--cron) or every interval (--every)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 2 {
+			log.Fatal("you should provide a topic and a name")
+		}
+
+		var data []byte
+		switch {
+		case len(args) == 3:
+			data = []byte(args[2])
+		case cmd.Flag("file").Changed:
+			file, err := cmd.Flags().GetString("file")
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			data, err = ioutil.ReadFile(file)
+			if err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatal("you should provide a file or a payload")
+		}
+
+		cron, err := cmd.Flags().GetString("cron")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		every, err := cmd.Flags().GetDuration("every")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if (cron == "") == (every == 0) {
+			log.Fatal("you should provide either --cron or --every")
+		}
+
+		partition, err := cmd.Flags().GetString("partition")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		channel, err := cmd.Flags().GetString("channel")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		key, err := cmd.Flags().GetString("key")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ttl, err := cmd.Flags().GetDuration("ttl")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		headers, err := cmd.Flags().GetStringSlice("header")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+		defer cancel()
+
+		s, err := client.CreateSchedule(ctx, &sgproto.Schedule{
+			Topic:     args[0],
+			Name:      args[1],
+			Partition: partition,
+			Cron:      cron,
+			Interval:  every,
+			Template: &sgproto.Message{
+				Channel: channel,
+				Key:     []byte(key),
+				Value:   data,
+				Headers: parseHeaders(headers),
+				Ttl:     ttl,
+			},
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		fmt.Printf("schedule '%s' was successfully created, next occurrence at %s\n", s.Name, s.Next.Format(time.RFC3339))
+	},
+}
+
+// scheduleListCmd represents the schedules list command
+var scheduleListCmd = &cobra.Command{
+	Use:   "list [topic]",
+	Short: "List the recurring schedules",
+	Long:  `List the schedules of a topic, or the ones of every topic when none is given`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			log.Fatal("only one topic is allowed")
+		}
+
+		var topic string
+		if len(args) == 1 {
+			topic = args[0]
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+		defer cancel()
+
+		res, err := client.ListSchedules(ctx, &sgproto.ListSchedulesRequest{
+			Topic: topic,
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TOPIC\tNAME\tPARTITION\tSCHEDULE\tNEXT\tOCCURRENCES")
+		for _, s := range res.Schedules {
+			when := s.Cron
+			if when == "" {
+				when = "every " + s.Interval.String()
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", s.Topic, s.Name, s.Partition, when, s.Next.Format(time.RFC3339), s.Occurrences)
+		}
+		w.Flush()
+	},
+}
+
+// scheduleDeleteCmd represents the schedules delete command
+var scheduleDeleteCmd = &cobra.Command{
+	Use:   "delete [topic] [name]",
+	Short: "Delete a recurring schedule",
+	Long:  `Delete a schedule, the occurrences already produced are still delivered`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatal("you should provide a topic and a name")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+		defer cancel()
+
+		_, err := client.DeleteSchedule(ctx, &sgproto.DeleteScheduleRequest{
+			Topic: args[0],
+			Name:  args[1],
+		})
+		if err != nil {
+			log.Fatal(grpc.ErrorDesc(err))
+		}
+
+		fmt.Println("OK")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(schedulesCmd)
+	schedulesCmd.AddCommand(scheduleCreateCmd)
+	schedulesCmd.AddCommand(scheduleListCmd)
+	schedulesCmd.AddCommand(scheduleDeleteCmd)
+
+	scheduleCreateCmd.Flags().String("cron", "", "Cron expression of the occurrences in UTC (minute hour day-of-month month day-of-week)")
+	scheduleCreateCmd.Flags().Duration("every", 0, "Interval between the occurrences, instead of a cron expression")
+	scheduleCreateCmd.Flags().String("partition", "", "Partition receiving the occurrences (default: chosen from the name)")
+	scheduleCreateCmd.Flags().String("file", "", "File to produce")
+	scheduleCreateCmd.Flags().String("channel", "", "Channel of the messages (default: master)")
+	scheduleCreateCmd.Flags().String("key", "", "Key of the messages")
+	scheduleCreateCmd.Flags().Duration("ttl", 0, "Time after which consumer groups skip the messages, from the time they are due (0 never expires)")
+	scheduleCreateCmd.Flags().StringSliceP("header", "H", nil, "Header of the messages as name=value, can be repeated")
+}
@@ -0,0 +1,108 @@
+// Copyright © 2017 Salim Alami Idrissi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/sandglass/sandglass/broker"
+	"github.com/sandglass/sandglass/raft"
+	"github.com/sandglass/sandglass/topic"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// fsckCmd represents the fsck command
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check the integrity of the data of a stopped node",
+	Long: `Check the integrity of the data of a stopped node without joining the cluster.
+The WAL of every partition should be contiguous and have its entries up to the HW mark
+in the view. With --repair, missing or broken view entries are rebuilt from the WAL.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := broker.Config{
+			DBPath:            viper.GetString("data"),
+			EncryptionKeyfile: viper.GetString("encryption_keyfile"),
+			EncryptionKeyring: viper.GetString("encryption_keyring"),
+			Storage:           storageOptions(),
+		}
+		if conf.DBPath == "" {
+			log.Fatal("no data storage path specified, use --data")
+		}
+
+		repair, err := cmd.Flags().GetBool("repair")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		keyring, err := conf.LoadKeyring()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		state, err := raft.ReadState(conf.DataDir())
+		if err != nil {
+			log.Fatalf("unable to read raft state: %v", err)
+		}
+
+		names := make([]string, 0, len(state.Topics))
+		for name := range state.Topics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var failed int
+		for _, name := range names {
+			t := state.Topics[name]
+			t.SetKeyring(keyring)
+			t.SetDefaultStorageOptions(conf.Storage)
+
+			err := t.Check(raft.TopicsDir(conf.DataDir()), state.PartitionHWMarks[name], repair, func(report *topic.CheckReport) error {
+				status := "ok"
+				if len(report.Issues) > 0 {
+					status = fmt.Sprintf("%d issues", len(report.Issues))
+				}
+
+				fmt.Printf("%s/%s: %s, hw mark %d, %d WAL entries, %d view entries\n",
+					report.Topic, report.Partition, status, report.HWMark, report.WALEntries, report.ViewEntries)
+				for _, issue := range report.Issues {
+					fmt.Printf("  %v\n", issue)
+				}
+
+				if !report.OK() {
+					failed++
+				}
+				return nil
+			})
+			if err != nil {
+				log.Fatalf("unable to check topic %s: %v", name, err)
+			}
+		}
+
+		if failed > 0 {
+			fmt.Printf("%d partitions have unrepaired issues\n", failed)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(fsckCmd)
+
+	fsckCmd.Flags().Bool("repair", false, "rebuild missing or broken view entries from the WAL")
+}
@@ -30,7 +30,9 @@ import (
 
 	"time"
 
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
 	"github.com/sandglass/sandglass/broker"
+	"github.com/sandglass/sandglass/storage"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -69,6 +71,10 @@ var RootCmd = &cobra.Command{
 			InitialPeers:            viper.GetStringSlice("initial_peers"),
 			BootstrapRaft:           viper.GetBool("bootstrap_raft"),
 			OffsetReplicationFactor: viper.GetInt("offset_replication_factor"),
+			MinInSyncReplicas:       viper.GetInt("min_insync_replicas"),
+			EncryptionKeyfile:       viper.GetString("encryption_keyfile"),
+			EncryptionKeyring:       viper.GetString("encryption_keyring"),
+			Storage:                 storageOptions(),
 		}
 
 		if viper.GetBool("verbose") {
@@ -157,6 +163,12 @@ func init() {
 	cmdcommon.BindViper(RootCmd.PersistentFlags(), "verbose")
 	RootCmd.PersistentFlags().Int("offset_replication_factor", 3, "Bootstrap raft")
 	cmdcommon.BindViper(RootCmd.PersistentFlags(), "offset_replication_factor")
+	RootCmd.PersistentFlags().Int("min_insync_replicas", 0, "Replicas holding a message before it is acknowledged, 0 for all of them")
+	cmdcommon.BindViper(RootCmd.PersistentFlags(), "min_insync_replicas")
+	RootCmd.PersistentFlags().String("encryption_keyfile", "", "file holding the keys of encrypted topics, one '<id> <base64 key>' per line")
+	cmdcommon.BindViper(RootCmd.PersistentFlags(), "encryption_keyfile")
+	RootCmd.PersistentFlags().String("encryption_keyring", "", "directory holding the keys of encrypted topics as '<id>.key' files")
+	cmdcommon.BindViper(RootCmd.PersistentFlags(), "encryption_keyring")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -187,6 +199,39 @@ func initConfig() {
 	}
 }
 
+// storageOptions reads the storage block of the config file
+func storageOptions() storage.Options {
+	opts := storage.Options{
+		BlockCacheSize:           viper.GetInt64("storage.block_cache_size"),
+		CompressedBlockCacheSize: viper.GetInt64("storage.compressed_block_cache_size"),
+		BloomBitsPerKey:          viper.GetInt("storage.bloom_bits_per_key"),
+		ValueThreshold:           viper.GetInt("storage.value_threshold"),
+		ValueLogFileSize:         viper.GetInt64("storage.value_log_file_size"),
+	}
+
+	if style := viper.GetString("storage.compaction_style"); style != "" {
+		v, ok := sgproto.CompactionStyle_value[style]
+		if !ok {
+			log.Fatalf("unknown compaction style: %s", style)
+		}
+		opts.CompactionStyle = sgproto.CompactionStyle(v)
+	}
+
+	if mode := viper.GetString("storage.sync_mode"); mode != "" {
+		v, ok := sgproto.SyncMode_value[mode]
+		if !ok {
+			log.Fatalf("unknown sync mode: %s", mode)
+		}
+		opts.SyncMode = sgproto.SyncMode(v)
+	}
+
+	if err := opts.Validate(); err != nil {
+		log.Fatalf("invalid storage options: %v", err)
+	}
+
+	return opts
+}
+
 func isURL(u string) bool {
 	p, err := url.Parse(u)
 	if err != nil {
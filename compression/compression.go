@@ -0,0 +1,56 @@
+// Package compression provides the codecs used to compress the values of stored messages.
+package compression
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+var (
+	ErrUnknownCodec = errors.New("ErrUnknownCodec")
+)
+
+// Codec compresses message values before they are written to the storage
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = map[sgproto.CompressionCodec]Codec{
+		sgproto.CompressionCodec_NoCompression: noCompression{},
+		sgproto.CompressionCodec_Gzip:          gzipCodec{},
+		sgproto.CompressionCodec_Flate:         flateCodec{},
+	}
+)
+
+// Register makes a codec available to topics under id.
+// Ids outside of the ones declared by sgproto.CompressionCodec can be used for custom codecs,
+// it should be called before any topic using it is loaded.
+func Register(id sgproto.CompressionCodec, codec Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	codecs[id] = codec
+}
+
+// Get returns the codec registered under id
+func Get(id sgproto.CompressionCodec) (Codec, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	codec, ok := codecs[id]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+
+	return codec, nil
+}
+
+type noCompression struct{}
+
+func (noCompression) Compress(data []byte) ([]byte, error)   { return data, nil }
+func (noCompression) Decompress(data []byte) ([]byte, error) { return data, nil }
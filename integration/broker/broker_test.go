@@ -17,14 +17,20 @@ import (
 
 	"fmt"
 
+	"io"
 	"io/ioutil"
 
 	"os"
 
 	"github.com/celrenheit/sandflake"
+	"github.com/gogo/protobuf/proto"
+	"github.com/sandglass/sandglass"
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
 	"github.com/sandglass/sandglass/broker"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // func TestLeak(t *testing.T) {
@@ -83,8 +89,14 @@ func TestSandglass(t *testing.T) {
 }
 
 func syncAndAdvance(t *testing.T, brokers []*broker.Broker) {
+	// a leader might not know about a partition created right before
 	for _, b := range brokers {
+		deadline := time.Now().Add(5 * time.Second)
 		err := b.TriggerSyncRequest()
+		for err != nil && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+			err = b.TriggerSyncRequest()
+		}
 		require.NoError(t, err)
 	}
 
@@ -97,6 +109,17 @@ func syncAndAdvance(t *testing.T, brokers []*broker.Broker) {
 	time.Sleep(1100 * time.Millisecond)
 }
 
+// waitFor polls cond until it holds, the test fails once timeout is reached
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool, msgAndArgs ...interface{}) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "condition not met in time", msgAndArgs...)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
 func getController(brokers []*broker.Broker) *broker.Broker {
 	return getBrokerByName(brokers, brokers[0].GetController().Name)
 }
@@ -166,6 +189,18 @@ func TestKVTopic(t *testing.T) {
 	})
 	require.NoError(t, err)
 	require.Equal(t, "999", string(msg.Value))
+
+	// only timer topics have messages becoming due to follow
+	err = brokers[1].Consume(ctx, &sgproto.ConsumeFromGroupRequest{
+		Topic:             "payments",
+		Partition:         part,
+		ConsumerGroupName: "group1",
+		ConsumerName:      "cons1",
+		Follow:            true,
+	}, func(msg *sgproto.Message) error {
+		return nil
+	})
+	require.Equal(t, broker.ErrFollowNotTimerTopic.Error(), grpc.ErrorDesc(err))
 }
 
 func TestACK(t *testing.T) {
@@ -211,8 +246,858 @@ func TestACK(t *testing.T) {
 	require.Equal(t, offset, got)
 }
 
+func TestReplicatedAck(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "payments",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     3,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+	part := topic.Partitions[0]
+
+	res, err := brokers[0].Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:     topic.Name,
+		Partition: part.Id,
+		Messages: []*sgproto.Message{
+			{
+				Value: []byte("critical"),
+			},
+		},
+		Acks:       sgproto.AckLevel_ReplicatedAck,
+		AckTimeout: 10 * time.Second,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Offsets, 1)
+
+	// every replica has the message in its WAL and the leader already has it in its view
+	for _, replica := range part.Replicas {
+		p := getTopicFromBroker(getBrokerByName(brokers, replica), topic.Name).GetPartition(part.Id)
+		msg, err := p.EndOfLog()
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		require.Equal(t, "critical", string(msg.Value))
+	}
+
+	var count int
+	err = brokers[0].FetchRangeFn(ctx, &sgproto.FetchRangeRequest{
+		Topic:     topic.Name,
+		Partition: part.Id,
+		From:      sgproto.Nil,
+		To:        sgproto.MaxOffset,
+	}, func(msg *sgproto.Message) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// a replica without the partition is skipped by the HW mark instead of failing it
+	_, err = brokers[0].EndOfLog(ctx, &sgproto.EndOfLogRequest{
+		Topic:     topic.Name,
+		Partition: "unknown",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.NoError(t, getController(brokers).TryAdvanceHWMark(ctx))
+}
+
+func TestPartitioner(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "payments",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     3,
+		Partitioner:       sgproto.Partitioner_KeyHashPartitioner,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+
+	var msgs []*sgproto.Message
+	for i := 0; i < 30; i++ {
+		msgs = append(msgs, &sgproto.Message{
+			Key:   []byte("key" + strconv.Itoa(i%10)),
+			Value: []byte(strconv.Itoa(i)),
+		})
+	}
+
+	// the batch is split between the leaders of the partitions of the keys
+	res, err := brokers[0].Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:    topic.Name,
+		Messages: msgs,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Offsets, 30)
+
+	_, err = brokers[0].Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:       topic.Name,
+		Messages:    []*sgproto.Message{{Value: []byte("explicit")}},
+		Partitioner: sgproto.Partitioner_ExplicitPartitioner,
+	})
+	require.Equal(t, broker.ErrNoPartitionSet, err)
+
+	syncAndAdvance(t, brokers)
+
+	var total int
+	for _, p := range topic.Partitions {
+		var values []int
+		err := brokers[0].FetchRangeFn(ctx, &sgproto.FetchRangeRequest{
+			Topic:     topic.Name,
+			Partition: p.Id,
+			From:      sgproto.Nil,
+			To:        sgproto.MaxOffset,
+		}, func(msg *sgproto.Message) error {
+			i, err := strconv.Atoi(string(msg.Value))
+			require.NoError(t, err)
+			require.Equal(t, p.Id, topic.Partitions[sgutils.Hash(msg.Key, len(topic.Partitions))].Id)
+			require.Equal(t, res.Offsets[i], msg.Offset)
+			values = append(values, i)
+			return nil
+		})
+		require.NoError(t, err)
+
+		for j := 1; j < len(values); j++ {
+			require.True(t, values[j-1] < values[j], "the order of the messages of a partition should be kept")
+		}
+		total += len(values)
+	}
+	require.Equal(t, 30, total)
+}
+
+func TestProduceStream(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "payments",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     3,
+		Partitioner:       sgproto.Partitioner_RoundRobinPartitioner,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+
+	node := &sandglass.Node{
+		GRPCAddr: net.JoinHostPort(brokers[0].Conf().AdvertiseAddr, brokers[0].Conf().GRPCPort),
+	}
+	require.NoError(t, node.Dial())
+	defer node.Close()
+
+	stream, err := node.ProduceStream(ctx)
+	require.NoError(t, err)
+
+	// every partition but the ones led by brokers[0] is forwarded to its leader
+	part := topic.Partitions[0].Id
+	for i := 0; i < 100; i++ {
+		req := &sgproto.ProduceMessageRequest{
+			Topic:     topic.Name,
+			RequestId: uint64(i),
+			Messages: []*sgproto.Message{
+				{Value: []byte(strconv.Itoa(i))},
+				{Value: []byte(strconv.Itoa(i))},
+			},
+		}
+		if i%2 == 0 {
+			req.Partition = part
+		}
+		require.NoError(t, stream.Send(req))
+	}
+	require.NoError(t, stream.CloseSend())
+
+	acked := map[uint64]bool{}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Len(t, res.Offsets, 2)
+		require.False(t, acked[res.RequestId])
+		acked[res.RequestId] = true
+	}
+	require.Len(t, acked, 100)
+
+	syncAndAdvance(t, brokers)
+
+	var values []int
+	err = brokers[1].FetchRangeFn(ctx, &sgproto.FetchRangeRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		From:      sgproto.Nil,
+		To:        sgproto.MaxOffset,
+	}, func(msg *sgproto.Message) error {
+		i, err := strconv.Atoi(string(msg.Value))
+		require.NoError(t, err)
+		if i%2 == 0 {
+			values = append(values, i)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, values, 100)
+	for j := 2; j < len(values); j++ {
+		require.True(t, values[j-2] <= values[j], "the order of the stream should be kept in a partition")
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "payments",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     3,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+	part := topic.Partitions[0].Id
+
+	headers := func(i int) map[string][]byte {
+		return map[string][]byte{
+			"trace-id":     []byte(strconv.Itoa(i)),
+			"content-type": []byte("text/plain"),
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := brokers[0].Produce(ctx, &sgproto.ProduceMessageRequest{
+			Topic:     topic.Name,
+			Partition: part,
+			Messages: []*sgproto.Message{
+				{
+					Value:   []byte(strconv.Itoa(i)),
+					Headers: headers(i),
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	syncAndAdvance(t, brokers)
+
+	check := func(msg *sgproto.Message) error {
+		i, err := strconv.Atoi(string(msg.Value))
+		require.NoError(t, err)
+		require.Equal(t, headers(i), msg.Headers)
+		return nil
+	}
+
+	// every replica returns the headers
+	for _, b := range brokers {
+		var count int
+		err := b.FetchRangeFn(ctx, &sgproto.FetchRangeRequest{
+			Topic:     topic.Name,
+			Partition: part,
+			From:      sgproto.Nil,
+			To:        sgproto.MaxOffset,
+		}, func(msg *sgproto.Message) error {
+			count++
+			return check(msg)
+		})
+		require.NoError(t, err)
+		require.Equal(t, 10, count)
+	}
+
+	var count int
+	err := brokers[2].Consume(ctx, &sgproto.ConsumeFromGroupRequest{
+		Topic:             topic.Name,
+		Partition:         part,
+		ConsumerGroupName: "group1",
+		ConsumerName:      "cons1",
+	}, func(msg *sgproto.Message) error {
+		count++
+		return check(msg)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10, count)
+}
+
+func TestExpiredMessages(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "reminders",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     3,
+		ExpiredChannel:    "expired",
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+	part := topic.Partitions[0].Id
+
+	// odd messages are expired by the time they are consumed
+	var expired []sgproto.Offset
+	for i := 0; i < 10; i++ {
+		msg := &sgproto.Message{
+			Channel: "master",
+			Value:   []byte(strconv.Itoa(i)),
+		}
+		if i%2 == 1 {
+			msg.Ttl = time.Millisecond
+		}
+
+		res, err := brokers[0].Produce(ctx, &sgproto.ProduceMessageRequest{
+			Topic:     topic.Name,
+			Partition: part,
+			Messages:  []*sgproto.Message{msg},
+		})
+		require.NoError(t, err)
+		if i%2 == 1 {
+			expired = append(expired, res.Offsets[0])
+		}
+	}
+
+	syncAndAdvance(t, brokers)
+
+	consume := func(channel, group string) []int {
+		var values []int
+		err := brokers[2].Consume(ctx, &sgproto.ConsumeFromGroupRequest{
+			Topic:             topic.Name,
+			Partition:         part,
+			Channel:           channel,
+			ConsumerGroupName: group,
+			ConsumerName:      "cons1",
+		}, func(msg *sgproto.Message) error {
+			i, err := strconv.Atoi(string(msg.Value))
+			require.NoError(t, err)
+			values = append(values, i)
+			return nil
+		})
+		require.NoError(t, err)
+		return values
+	}
+
+	require.Equal(t, []int{0, 2, 4, 6, 8}, consume("master", "group1"))
+
+	syncAndAdvance(t, brokers)
+
+	for _, offset := range expired {
+		markedMsg, err := brokers[1].GetMarkStateMessage(ctx, &sgproto.GetMarkRequest{
+			Topic:         topic.Name,
+			Partition:     part,
+			Channel:       "master",
+			ConsumerGroup: "group1",
+			Offset:        offset,
+		})
+		require.NoError(t, err)
+
+		var state sgproto.MarkState
+		require.NoError(t, proto.Unmarshal(markedMsg.Value, &state))
+		require.Equal(t, sgproto.MarkKind_Acknowledged, state.Kind)
+		require.Equal(t, sgproto.MarkReason_Expired, state.Reason)
+	}
+
+	require.Equal(t, []int{1, 3, 5, 7, 9}, consume("expired", "group1"), "expired messages should be routed to the expired channel")
+
+	// another group expiring the same messages does not copy them again
+	endOfLog := func() uint64 {
+		leader := getBrokerByName(brokers, topic.Partitions[0].Replicas[0])
+		res, err := leader.EndOfLog(ctx, &sgproto.EndOfLogRequest{
+			Topic:     topic.Name,
+			Partition: part,
+		})
+		require.NoError(t, err)
+		return res.Index
+	}
+	index := endOfLog()
+	require.Equal(t, []int{0, 2, 4, 6, 8}, consume("master", "group2"))
+	syncAndAdvance(t, brokers)
+	require.Equal(t, index, endOfLog(), "expired messages should be copied once")
+}
+
+func TestCancelAndReschedule(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "emails",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     3,
+	}
+	errInvalidConsumeAt := topic.ErrInvalidConsumeAt
+	topic := createTopic(t, brokers, createTopicParams)
+	part := topic.Partitions[0].Id
+
+	res, err := brokers[0].Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		Messages: []*sgproto.Message{
+			{Value: []byte("cancelled"), ConsumeIn: time.Hour},
+			{Value: []byte("rescheduled"), ConsumeIn: time.Hour},
+			{Value: []byte("later"), ConsumeIn: time.Hour},
+		},
+	})
+	require.NoError(t, err)
+
+	syncAndAdvance(t, brokers)
+
+	// every broker forwards to the leader of the partition
+	_, err = brokers[1].Cancel(ctx, &sgproto.CancelRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		Offset:    res.Offsets[0],
+	})
+	require.NoError(t, err)
+
+	_, err = brokers[2].Cancel(ctx, &sgproto.CancelRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		Offset:    res.Offsets[0],
+	})
+	require.Error(t, err)
+
+	// the leader and the brokers forwarding to it reject a time which is not in the future
+	for _, b := range brokers {
+		for _, at := range []time.Time{{}, time.Now().Add(-time.Second)} {
+			_, err = b.Reschedule(ctx, &sgproto.RescheduleRequest{
+				Topic:     topic.Name,
+				Partition: part,
+				Offset:    res.Offsets[1],
+				ConsumeAt: at,
+			})
+			require.Error(t, err)
+			require.Equal(t, errInvalidConsumeAt.Error(), grpc.ErrorDesc(err))
+		}
+	}
+
+	moved, err := brokers[2].Reschedule(ctx, &sgproto.RescheduleRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		Offset:    res.Offsets[1],
+		ConsumeAt: time.Now().Add(time.Second),
+	})
+	require.NoError(t, err)
+
+	var values []string
+	err = brokers[1].FetchRangeFn(ctx, &sgproto.FetchRangeRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		From:      sgproto.Nil,
+		To:        sgproto.MaxOffset,
+	}, func(msg *sgproto.Message) error {
+		values = append(values, string(msg.Value))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"rescheduled", "later"}, values)
+
+	time.Sleep(time.Until(moved.Offset.Time()))
+	syncAndAdvance(t, brokers)
+
+	values = nil
+	err = brokers[0].Consume(ctx, &sgproto.ConsumeFromGroupRequest{
+		Topic:             topic.Name,
+		Partition:         part,
+		ConsumerGroupName: "group1",
+		ConsumerName:      "cons1",
+	}, func(msg *sgproto.Message) error {
+		values = append(values, string(msg.Value))
+		require.Equal(t, moved.Offset, msg.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"rescheduled"}, values)
+}
+
+func TestSchedules(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "jobs",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     3,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+
+	_, err := brokers[0].CreateSchedule(ctx, &sgproto.Schedule{
+		Topic: topic.Name,
+		Name:  "invalid",
+		Cron:  "0 0 30 2 *",
+	})
+	require.Error(t, err)
+
+	// every broker forwards to the controller
+	created, err := brokers[1].CreateSchedule(ctx, &sgproto.Schedule{
+		Topic:    topic.Name,
+		Name:     "cleanup",
+		Interval: time.Second,
+		Template: &sgproto.Message{Value: []byte("tick")},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, created.Partition)
+
+	_, err = brokers[2].CreateSchedule(ctx, &sgproto.Schedule{
+		Topic:    topic.Name,
+		Name:     "cleanup",
+		Interval: time.Second,
+	})
+	require.Equal(t, broker.ErrScheduleAlreadyExist.Error(), grpc.ErrorDesc(err))
+
+	// the occurrences of the next minute are produced ahead of time
+	var s *sgproto.Schedule
+	for i := 0; i < 40 && (s == nil || s.Occurrences == 0); i++ {
+		time.Sleep(500 * time.Millisecond)
+		res, err := getController(brokers).ListSchedules(ctx, &sgproto.ListSchedulesRequest{Topic: topic.Name})
+		require.NoError(t, err)
+		require.Len(t, res.Schedules, 1)
+		s = res.Schedules[0]
+	}
+	require.True(t, s.Occurrences > 1)
+	require.True(t, s.Next.After(time.Now().Add(30*time.Second)))
+
+	time.Sleep(2 * time.Second)
+	syncAndAdvance(t, brokers)
+
+	var offsets []sgproto.Offset
+	err = brokers[0].Consume(ctx, &sgproto.ConsumeFromGroupRequest{
+		Topic:             topic.Name,
+		Partition:         created.Partition,
+		ConsumerGroupName: "group1",
+		ConsumerName:      "cons1",
+	}, func(msg *sgproto.Message) error {
+		require.Equal(t, "tick", string(msg.Value))
+		offsets = append(offsets, msg.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, offsets)
+	require.True(t, len(offsets) < int(s.Occurrences))
+	// the first occurrence might have been produced late
+	for i := 2; i < len(offsets); i++ {
+		require.Equal(t, time.Second, offsets[i].Time().Sub(offsets[i-1].Time()))
+	}
+
+	_, err = brokers[2].DeleteSchedule(ctx, &sgproto.DeleteScheduleRequest{Topic: topic.Name, Name: "cleanup"})
+	require.NoError(t, err)
+
+	_, err = brokers[2].DeleteSchedule(ctx, &sgproto.DeleteScheduleRequest{Topic: topic.Name, Name: "cleanup"})
+	require.Error(t, err)
+
+	res, err := getController(brokers).ListSchedules(ctx, &sgproto.ListSchedulesRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.Schedules)
+}
+
+func TestFollowConsume(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	defer func(timeout time.Duration) { broker.RedeliveryTimeout = timeout }(broker.RedeliveryTimeout)
+	broker.RedeliveryTimeout = 500 * time.Millisecond
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "reminders",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     1,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+	part := topic.Partitions[0].Id
+
+	consumeCtx, cancel := context.WithCancel(ctx)
+	received := make(chan *sgproto.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- brokers[1].Consume(consumeCtx, &sgproto.ConsumeFromGroupRequest{
+			Topic:             topic.Name,
+			Partition:         part,
+			ConsumerGroupName: "group1",
+			ConsumerName:      "cons1",
+			Follow:            true,
+		}, func(msg *sgproto.Message) error {
+			received <- msg
+			return nil
+		})
+	}()
+
+	res, err := brokers[2].Produce(ctx, &sgproto.ProduceMessageRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		Acks:      sgproto.AckLevel_ReplicatedAck,
+		Messages: []*sgproto.Message{
+			{Value: []byte("later"), ConsumeIn: 2 * time.Second},
+		},
+	})
+	require.NoError(t, err)
+
+	// the message is sent once due, without consuming again
+	select {
+	case msg := <-received:
+		require.Equal(t, "later", string(msg.Value))
+		require.Equal(t, res.Offsets[0], msg.Offset)
+		require.False(t, time.Now().Before(msg.Offset.Time()))
+	case <-time.After(5 * time.Second):
+		t.Fatal("due message not received")
+	}
+
+	// it is not acknowledged, it is sent again while following
+	select {
+	case msg := <-received:
+		require.Equal(t, res.Offsets[0], msg.Offset)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not redelivered")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("following consumer stopped: %v", err)
+	default:
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		require.Equal(t, context.Canceled.Error(), grpc.ErrorDesc(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("following consumer not stopped")
+	}
+}
+
+func TestConsumeCredits(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "jobs",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     1,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+	part := topic.Partitions[0].Id
+
+	consumeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	follow := func(b *broker.Broker, name string, credits uint32) chan *sgproto.Message {
+		received := make(chan *sgproto.Message, 100)
+		go b.Consume(consumeCtx, &sgproto.ConsumeFromGroupRequest{
+			Topic:             topic.Name,
+			Partition:         part,
+			ConsumerGroupName: "group1",
+			ConsumerName:      name,
+			Follow:            true,
+			Credits:           credits,
+			HeartbeatInterval: 100 * time.Millisecond,
+		}, func(msg *sgproto.Message) error {
+			received <- msg
+			return nil
+		})
+		return received
+	}
+
+	produce := func(value string) sgproto.Offset {
+		res, err := brokers[2].Produce(ctx, &sgproto.ProduceMessageRequest{
+			Topic:     topic.Name,
+			Partition: part,
+			Acks:      sgproto.AckLevel_ReplicatedAck,
+			Messages: []*sgproto.Message{
+				{Value: []byte(value)},
+			},
+		})
+		require.NoError(t, err)
+		return res.Offsets[0]
+	}
+
+	// next skips the heartbeats, it returns nil when no message is received in time
+	next := func(received chan *sgproto.Message, timeout time.Duration) (*sgproto.Message, int) {
+		var heartbeats int
+		deadline := time.After(timeout)
+		for {
+			select {
+			case msg := <-received:
+				if msg.Heartbeat {
+					heartbeats++
+					continue
+				}
+				return msg, heartbeats
+			case <-deadline:
+				return nil, heartbeats
+			}
+		}
+	}
+
+	err := brokers[1].Consume(consumeCtx, &sgproto.ConsumeFromGroupRequest{
+		Topic:             topic.Name,
+		Partition:         part,
+		ConsumerGroupName: "group1",
+		ConsumerName:      "cons1",
+		Follow:            true,
+		HeartbeatInterval: time.Millisecond,
+	}, func(msg *sgproto.Message) error {
+		return nil
+	})
+	require.Equal(t, broker.ErrInvalidHeartbeatInterval.Error(), grpc.ErrorDesc(err))
+
+	// the heartbeats are sent once the consumer is attached
+	attached := func(received chan *sgproto.Message) {
+		select {
+		case msg := <-received:
+			require.True(t, msg.Heartbeat, "message received before producing")
+		case <-time.After(5 * time.Second):
+			t.Fatal("consumer not attached")
+		}
+	}
+
+	cons1 := follow(brokers[1], "cons1", 1)
+	attached(cons1)
+
+	first := produce("first")
+	second := produce("second")
+
+	// the produced messages are sent without consuming again
+	msg, _ := next(cons1, 5*time.Second)
+	require.NotNil(t, msg, "produced message not received")
+	require.Equal(t, first, msg.Offset)
+
+	msg, heartbeats := next(cons1, time.Second)
+	require.Nil(t, msg, "message sent without credits")
+	require.True(t, heartbeats > 0, "no heartbeat received")
+
+	_, err = brokers[0].Acknowledge(ctx, &sgproto.MarkRequest{
+		Topic:         topic.Name,
+		Partition:     part,
+		ConsumerGroup: "group1",
+		ConsumerName:  "cons1",
+		Offsets:       []sgproto.Offset{first},
+	})
+	require.NoError(t, err)
+
+	msg, _ = next(cons1, 5*time.Second)
+	require.NotNil(t, msg, "message not received once acknowledged")
+	require.Equal(t, second, msg.Offset)
+
+	// cons1 is out of credits again, it does not hold the messages of the other consumers
+	third := produce("third")
+	p := getTopicFromBroker(getController(brokers), topic.Name).GetPartition(part)
+	waitFor(t, 5*time.Second, func() bool {
+		return p.HWMark() >= third.Index()
+	}, "message not replicated")
+	cons2 := follow(brokers[0], "cons2", 0)
+
+	msg, _ = next(cons2, 5*time.Second)
+	require.NotNil(t, msg, "message held by a consumer without credits")
+	require.Equal(t, third, msg.Offset)
+
+	msg, _ = next(cons1, time.Second)
+	require.Nil(t, msg)
+}
+
+func TestConsumeCreditsReleased(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	defer func(timeout time.Duration, count int) {
+		broker.RedeliveryTimeout = timeout
+		broker.MaxRedeliveryCount = count
+	}(broker.RedeliveryTimeout, broker.MaxRedeliveryCount)
+	broker.RedeliveryTimeout = 500 * time.Millisecond
+	broker.MaxRedeliveryCount = 2
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "jobs",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 2,
+		NumPartitions:     2,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+
+	consumeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	follow := func(part, group string) chan *sgproto.Message {
+		received := make(chan *sgproto.Message, 100)
+		go brokers[1].Consume(consumeCtx, &sgproto.ConsumeFromGroupRequest{
+			Topic:             topic.Name,
+			Partition:         part,
+			ConsumerGroupName: group,
+			ConsumerName:      "cons1",
+			Follow:            true,
+			Credits:           1,
+		}, func(msg *sgproto.Message) error {
+			received <- msg
+			return nil
+		})
+		return received
+	}
+
+	produce := func(part string, msg *sgproto.Message) sgproto.Offset {
+		res, err := brokers[2].Produce(ctx, &sgproto.ProduceMessageRequest{
+			Topic:     topic.Name,
+			Partition: part,
+			Acks:      sgproto.AckLevel_ReplicatedAck,
+			Messages:  []*sgproto.Message{msg},
+		})
+		require.NoError(t, err)
+		return res.Offsets[0]
+	}
+
+	next := func(received chan *sgproto.Message) *sgproto.Message {
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not received")
+		}
+		return nil
+	}
+
+	// the redeliveries of a message which is never acknowledged supersede its previous delivery,
+	// the credit is given back once it is acknowledged after the last one or committed
+	part := topic.Partitions[0].Id
+	received := follow(part, "group1")
+	first := produce(part, &sgproto.Message{Value: []byte("first")})
+	second := produce(part, &sgproto.Message{Value: []byte("second")})
+
+	deliveries := 0
+	msg := next(received)
+	for ; msg.Offset == first; msg = next(received) {
+		deliveries++
+	}
+	require.True(t, deliveries > 1, "message not redelivered")
+	require.Equal(t, second, msg.Offset)
+
+	// the credit of a message which expires in flight is given back
+	part = topic.Partitions[1].Id
+	received = follow(part, "group2")
+	expiring := produce(part, &sgproto.Message{Value: []byte("expiring"), Ttl: 3 * time.Second})
+	last := produce(part, &sgproto.Message{Value: []byte("last")})
+
+	deliveries = 0
+	msg = next(received)
+	for ; msg.Offset == expiring; msg = next(received) {
+		deliveries++
+	}
+	require.True(t, deliveries > 0, "message not delivered before it expired")
+	require.Equal(t, last, msg.Offset)
+}
+
 func createTopic(t *testing.T, brokers []*broker.Broker, createTopicParams *sgproto.TopicConfig) *topic.Topic {
-	_, err := brokers[0].CreateTopic(ctx, createTopicParams)
+	// the controller might not be elected yet
+	var err error
+	waitFor(t, 10*time.Second, func() bool {
+		_, err = brokers[0].CreateTopic(ctx, createTopicParams)
+		return grpc.ErrorDesc(err) != broker.ErrNoLeaderFound.Error()
+	}, "no controller to create the topic")
 	require.Nil(t, err)
 
 	_, err = brokers[0].CreateTopic(ctx, createTopicParams)
@@ -221,7 +1106,12 @@ func createTopic(t *testing.T, brokers []*broker.Broker, createTopicParams *sgpr
 	n := len(brokers)
 	require.Len(t, brokers[0].Members(), n)
 	for i := 0; i < n; i++ {
-		require.Len(t, brokers[i].Topics(), 2)
+		b := brokers[i]
+		waitFor(t, 5*time.Second, func() bool {
+			topic := getTopicFromBroker(b, createTopicParams.Name)
+			return topic != nil && len(topic.ListPartitions()) == int(createTopicParams.NumPartitions)
+		}, "topic not created on %s", b.Name())
+		require.Len(t, b.Topics(), 2)
 	}
 
 	var topic *topic.Topic
@@ -443,6 +1333,42 @@ func TestSyncRequest(t *testing.T) {
 	}
 }
 
+func TestSetHWMark(t *testing.T) {
+	n := 3
+	brokers, destroyFn := makeNBrokers(t, n)
+	defer destroyFn()
+
+	createTopicParams := &sgproto.TopicConfig{
+		Name:              "payments",
+		Kind:              sgproto.TopicKind_TimerKind,
+		ReplicationFactor: 3,
+		NumPartitions:     1,
+	}
+	topic := createTopic(t, brokers, createTopicParams)
+	part := topic.Partitions[0].Id
+
+	var nonController *broker.Broker
+	for _, b := range brokers {
+		if !b.IsController() {
+			nonController = b
+		}
+	}
+
+	_, err := nonController.SetHWMark(ctx, &sgproto.SetHWMarkRequest{
+		Topic:     topic.Name,
+		Partition: part,
+		HwMark:    42,
+	})
+	require.NoError(t, err, "the HW mark should be set through the controller")
+
+	for _, b := range brokers {
+		p := getTopicFromBroker(b, topic.Name).GetPartition(part)
+		waitFor(t, 5*time.Second, func() bool {
+			return p.HWMark() == 42
+		}, "HW mark not set on %s", b.Name())
+	}
+}
+
 func TestChannels(t *testing.T) {
 	n := 3
 	brokers, destroyFn := makeNBrokers(t, n)
@@ -0,0 +1,160 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/sandglass/sandglass/topic"
+)
+
+// OfflineState is the part of the raft state needed to inspect the data of a stopped node
+type OfflineState struct {
+	Topics           map[string]*topic.Topic
+	PartitionHWMarks map[string]map[string]uint64
+}
+
+// TopicsDir returns the directory holding the topics of a node whose raft data is in dir
+func TopicsDir(dir string) string {
+	return filepath.Join(dir, "topics")
+}
+
+// ReadState rebuilds the topics and HW marks of a node from its last raft snapshot and the
+// log entries following it, without joining the cluster. The raft log is opened read-only and the
+// topics are returned uninitialized. The node should be stopped since it locks its raft log while running.
+func ReadState(dir string) (*OfflineState, error) {
+	raftDir := filepath.Join(dir, "raft")
+	if _, err := os.Stat(raftDir); err != nil {
+		return nil, err
+	}
+
+	st := &OfflineState{
+		Topics:           map[string]*topic.Topic{},
+		PartitionHWMarks: map[string]map[string]uint64{},
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, retainSnapshotCount, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+
+	metas, err := snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastIndex uint64
+	if len(metas) > 0 {
+		meta, rc, err := snapshots.Open(metas[0].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		restored := newState()
+		err = json.NewDecoder(rc).Decode(restored)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for name, t := range restored.Topics {
+			st.Topics[name] = t
+		}
+		for t, partitions := range restored.PartitionHWMarks {
+			for p, hwMark := range partitions {
+				st.setHWMark(t, p, hwMark)
+			}
+		}
+		lastIndex = meta.Index
+	}
+
+	logStore, err := raftboltdb.New(raftboltdb.Options{
+		Path: filepath.Join(raftDir, "raft.db"),
+		BoltOptions: &bolt.Options{
+			ReadOnly: true,
+			Timeout:  time.Second,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer logStore.Close()
+
+	first, err := logStore.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := logStore.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	if first <= lastIndex {
+		first = lastIndex + 1
+	}
+
+	for i := first; i <= last; i++ {
+		var l raft.Log
+		if err := logStore.GetLog(i, &l); err != nil {
+			return nil, err
+		}
+
+		if l.Type != raft.LogCommand {
+			continue
+		}
+
+		if err := st.apply(l.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// apply replays the commands changing the topics and HW marks, the others are ignored
+func (st *OfflineState) apply(data []byte) error {
+	var c command
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+
+	switch c.Op {
+	case CreateTopicOp:
+		var t topic.Topic
+		if err := json.Unmarshal(c.Payload, &t); err != nil {
+			return err
+		}
+
+		if _, ok := st.Topics[t.Name]; !ok {
+			st.Topics[t.Name] = &t
+		}
+	case SetHWMarks:
+		var s setHWMarks
+		if err := json.Unmarshal(c.Payload, &s); err != nil {
+			return err
+		}
+
+		for t, partitions := range s.State {
+			for p, hwMark := range partitions {
+				if old, ok := st.PartitionHWMarks[t][p]; !ok || old < hwMark {
+					st.setHWMark(t, p, hwMark)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (st *OfflineState) setHWMark(t, p string, hwMark uint64) {
+	if st.PartitionHWMarks[t] == nil {
+		st.PartitionHWMarks[t] = map[string]uint64{}
+	}
+	st.PartitionHWMarks[t][p] = hwMark
+}
@@ -9,10 +9,14 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/sandglass/sandglass"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/encrypted"
 	"github.com/sandglass/sandglass/topic"
 	"github.com/sirupsen/logrus"
 
@@ -34,6 +38,10 @@ const (
 	AddNode                  = "AddNode"
 	DeleteNode               = "DeleteNode"
 	SetHWMarks               = "SetHWMarks"
+	RegisterConsumerGroupOp  = "RegisterConsumerGroupOp"
+	SetScheduleOp            = "SetScheduleOp"
+	DeleteScheduleOp         = "DeleteScheduleOp"
+	AdvanceScheduleOp        = "AdvanceScheduleOp"
 )
 
 type Config struct {
@@ -42,6 +50,15 @@ type Config struct {
 	AdvAddr       string
 	Dir           string
 	StartAsLeader bool
+
+	// CommittedOffsetFunc is used by topics to avoid deleting in flight messages
+	CommittedOffsetFunc topic.CommittedOffsetFunc
+
+	// Keyring used by encrypted topics
+	Keyring *encrypted.Keyring
+
+	// StorageOptions used by the topics that do not override them
+	StorageOptions storage.Options
 }
 
 type Store struct {
@@ -62,6 +79,7 @@ type Store struct {
 	reconcileCh chan serf.Member
 
 	transport *raft.NetworkTransport
+	logStore  *raftboltdb.BoltStore
 	topicsDir string
 }
 
@@ -70,6 +88,15 @@ type state struct {
 	Topics           map[string]*topic.Topic
 	PartitionLeaders map[string]map[string]string
 	PartitionHWMarks map[string]map[string]uint64
+	ConsumerGroups   map[string][]ConsumerGroup
+	Schedules        map[string]map[string]*sgproto.Schedule
+}
+
+type ConsumerGroup struct {
+	Topic     string
+	Partition string
+	Channel   string
+	Name      string
 }
 
 func newState() *state {
@@ -78,6 +105,8 @@ func newState() *state {
 		Topics:           map[string]*topic.Topic{},
 		PartitionLeaders: map[string]map[string]string{},
 		PartitionHWMarks: map[string]map[string]uint64{},
+		ConsumerGroups:   map[string][]ConsumerGroup{},
+		Schedules:        map[string]map[string]*sgproto.Schedule{},
 	}
 }
 
@@ -89,7 +118,7 @@ func New(conf Config, logger *logrus.Entry) *Store {
 		newTopicChan:     make(chan *topic.Topic, 10),
 		leaderChangeChan: make(chan bool, 10),
 		shutdownCh:       make(chan struct{}),
-		topicsDir:        filepath.Join(conf.Dir, "topics"),
+		topicsDir:        TopicsDir(conf.Dir),
 	}
 }
 
@@ -141,6 +170,7 @@ func (s *Store) Init(bootstrap bool, serf *serf.Serf, reconcileCh chan serf.Memb
 	if err != nil {
 		return err
 	}
+	s.logStore = logStore
 
 	configuration := raft.Configuration{}
 	configuration.Servers = append(configuration.Servers, raft.Server{
@@ -354,12 +384,12 @@ func (s *Store) establishLeadership() error {
 }
 
 func (s *Store) AddNode(n *sandglass.Node) error {
-	s.logger.Info("adding node: %+v", n)
+	s.logger.Infof("adding node: %+v", n)
 	return s.AddVoter(n.Name, n.RAFTAddr, 0)
 }
 
 func (s *Store) RemoveNode(n *sandglass.Node) error {
-	s.logger.Info("removing node: %+v", n)
+	s.logger.Infof("removing node: %+v", n)
 	return s.RemoveServer(n.Name, 0)
 }
 
@@ -370,6 +400,10 @@ func (s *Store) Stop() error {
 		return err
 	}
 
+	if err := s.logStore.Close(); err != nil {
+		return err
+	}
+
 	return s.transport.Close()
 }
 
@@ -434,6 +468,14 @@ func (f *fsm) Apply(l *raft.Log) (value interface{}) {
 		err = f.applyAddOrDeleteNode(false, c.Payload)
 	case SetHWMarks:
 		err = f.applySetHWMarks(c.Payload)
+	case RegisterConsumerGroupOp:
+		err = f.applyRegisterConsumerGroup(c.Payload)
+	case SetScheduleOp:
+		err = f.applySetSchedule(c.Payload)
+	case DeleteScheduleOp:
+		err = f.applyDeleteSchedule(c.Payload)
+	case AdvanceScheduleOp:
+		err = f.applyAdvanceSchedule(c.Payload)
 	default:
 		f.logger.WithField("operation", c.Op).Warnf("unrecognized operation")
 		return fmt.Errorf("unrecognized command op: %s", c.Op)
@@ -471,6 +513,9 @@ func (f *fsm) applySetTopic(b []byte) error {
 	f.logger.Debugf("applyCreateTopic %v", t.Name)
 
 	if !f.HasTopic(t.Name) {
+		t.SetCommittedOffsetFunc(f.conf.CommittedOffsetFunc)
+		t.SetKeyring(f.conf.Keyring)
+		t.SetDefaultStorageOptions(f.conf.StorageOptions)
 		err := t.InitStore(f.topicsDir)
 		if err != nil {
 			return err
@@ -500,6 +545,24 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 		}
 	}
 
+	for topic, partitions := range f.state.PartitionHWMarks {
+		state.PartitionHWMarks[topic] = make(map[string]uint64)
+		for part, hwMark := range partitions {
+			state.PartitionHWMarks[topic][part] = hwMark
+		}
+	}
+
+	for topic, groups := range f.state.ConsumerGroups {
+		state.ConsumerGroups[topic] = append([]ConsumerGroup(nil), groups...)
+	}
+
+	for topic, schedules := range f.state.Schedules {
+		state.Schedules[topic] = make(map[string]*sgproto.Schedule)
+		for name, s := range schedules {
+			state.Schedules[topic][name] = s
+		}
+	}
+
 	for k, v := range f.state.Members {
 		state.Members[k] = v
 	}
@@ -527,9 +590,18 @@ func (f *fsm) Restore(rc io.ReadCloser) error {
 
 	f.state = restoredState
 	for _, t := range f.state.Topics {
+		t.SetCommittedOffsetFunc(f.conf.CommittedOffsetFunc)
+		t.SetKeyring(f.conf.Keyring)
+		t.SetDefaultStorageOptions(f.conf.StorageOptions)
 		if err := t.InitStore(f.topicsDir); err != nil {
 			return err
 		}
+
+		for part, hwMark := range f.state.PartitionHWMarks[t.Name] {
+			if p := t.GetPartition(part); p != nil {
+				p.SetHWMark(hwMark)
+			}
+		}
 	}
 	return nil
 }
@@ -555,7 +627,12 @@ func (f *fsm) applySetPartitionLeaderBulk(d []byte) error {
 
 			hwMark := f.state.PartitionHWMarks[topic][part]
 			p := t.GetPartition(part)
-			if err := p.TruncateWALFrom(hwMark); err != nil {
+			if p == nil {
+				continue
+			}
+
+			// entries up to the HW mark are replicated and already applied to the view
+			if err := p.TruncateWALFrom(hwMark + 1); err != nil {
 				return err
 			}
 		}
@@ -592,9 +669,11 @@ func (f *fsm) applySetHWMarks(d []byte) error {
 		for p, hwMark := range p {
 			if oldHWMark, ok := f.state.PartitionHWMarks[t][p]; !ok || oldHWMark < hwMark {
 				f.state.PartitionHWMarks = setMap(f.state.PartitionHWMarks, t, p, hwMark)
-				if err := f.state.Topics[t].GetPartition(p).WalToView(oldHWMark, hwMark); err != nil {
+				partition := f.state.Topics[t].GetPartition(p)
+				if err := partition.WalToView(oldHWMark, hwMark); err != nil {
 					return err
 				}
+				partition.SetHWMark(hwMark)
 			}
 		}
 	}
@@ -602,6 +681,91 @@ func (f *fsm) applySetHWMarks(d []byte) error {
 	return nil
 }
 
+func (f *fsm) applyRegisterConsumerGroup(d []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var cg ConsumerGroup
+	if err := json.Unmarshal(d, &cg); err != nil {
+		return err
+	}
+
+	for _, existing := range f.state.ConsumerGroups[cg.Topic] {
+		if existing == cg {
+			return nil
+		}
+	}
+
+	if f.state.ConsumerGroups == nil {
+		f.state.ConsumerGroups = map[string][]ConsumerGroup{}
+	}
+	f.state.ConsumerGroups[cg.Topic] = append(f.state.ConsumerGroups[cg.Topic], cg)
+
+	return nil
+}
+
+// schedules are replaced rather than modified since they are handed out by GetSchedules
+func (f *fsm) applySetSchedule(d []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var s sgproto.Schedule
+	if err := json.Unmarshal(d, &s); err != nil {
+		return err
+	}
+
+	if f.state.Schedules == nil {
+		f.state.Schedules = map[string]map[string]*sgproto.Schedule{}
+	}
+	if f.state.Schedules[s.Topic] == nil {
+		f.state.Schedules[s.Topic] = map[string]*sgproto.Schedule{}
+	}
+	f.state.Schedules[s.Topic][s.Name] = &s
+
+	return nil
+}
+
+func (f *fsm) applyDeleteSchedule(d []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ref scheduleRef
+	if err := json.Unmarshal(d, &ref); err != nil {
+		return err
+	}
+
+	delete(f.state.Schedules[ref.Topic], ref.Name)
+	if len(f.state.Schedules[ref.Topic]) == 0 {
+		delete(f.state.Schedules, ref.Topic)
+	}
+
+	return nil
+}
+
+func (f *fsm) applyAdvanceSchedule(d []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var a advanceSchedule
+	if err := json.Unmarshal(d, &a); err != nil {
+		return err
+	}
+
+	// the schedule might have been deleted or advanced by a former controller in the meantime
+	old, ok := f.state.Schedules[a.Topic][a.Name]
+	if !ok || a.Sequence <= old.Sequence {
+		return nil
+	}
+
+	s := *old
+	s.Next = a.Next
+	s.Occurrences = a.Occurrences
+	s.Sequence = a.Sequence
+	f.state.Schedules[a.Topic][a.Name] = &s
+
+	return nil
+}
+
 func (s *Store) GetHWMark(topic, partition string) uint64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -665,6 +829,104 @@ func (s *Store) SetPartitionHWMark(v map[string]map[string]uint64) error {
 	return s.raftApplyCommand(SetHWMarks, &setHWMarks{State: v})
 }
 
+func (s *Store) RegisterConsumerGroup(cg ConsumerGroup) error {
+	return s.raftApplyCommand(RegisterConsumerGroupOp, cg)
+}
+
+func (s *Store) HasConsumerGroup(cg ConsumerGroup) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, existing := range s.state.ConsumerGroups[cg.Topic] {
+		if existing == cg {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetConsumerGroups returns the names of the consumer groups of a channel
+func (s *Store) GetConsumerGroups(topic, partition, channel string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var names []string
+	for _, cg := range s.state.ConsumerGroups[topic] {
+		if cg.Partition == partition && cg.Channel == channel {
+			names = append(names, cg.Name)
+		}
+	}
+
+	return names
+}
+
+type scheduleRef struct {
+	Topic, Name string
+}
+
+type advanceSchedule struct {
+	Topic, Name string
+	Next        time.Time
+	Occurrences uint64
+	Sequence    uint64
+}
+
+// SetSchedule stores a schedule, replacing the one of its topic with the same name
+func (s *Store) SetSchedule(sch *sgproto.Schedule) error {
+	return s.raftApplyCommand(SetScheduleOp, sch)
+}
+
+func (s *Store) DeleteSchedule(topic, name string) error {
+	return s.raftApplyCommand(DeleteScheduleOp, scheduleRef{Topic: topic, Name: name})
+}
+
+// AdvanceSchedule records the batch of occurrences produced for a schedule, it is ignored
+// when its sequence is not the following one of the schedule
+func (s *Store) AdvanceSchedule(topic, name string, next time.Time, occurrences, sequence uint64) error {
+	return s.raftApplyCommand(AdvanceScheduleOp, advanceSchedule{
+		Topic:       topic,
+		Name:        name,
+		Next:        next,
+		Occurrences: occurrences,
+		Sequence:    sequence,
+	})
+}
+
+func (s *Store) GetSchedule(topic, name string) *sgproto.Schedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state.Schedules[topic][name]
+}
+
+// GetSchedules returns the schedules of a topic sorted by name, or the ones of every topic when it is empty.
+// They should not be modified.
+func (s *Store) GetSchedules(topic string) []*sgproto.Schedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []*sgproto.Schedule
+	for t, schedules := range s.state.Schedules {
+		if topic != "" && t != topic {
+			continue
+		}
+
+		for _, sch := range schedules {
+			out = append(out, sch)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
 type setPartitionLeaderPayload struct {
 	topic, partition, leader string
 }
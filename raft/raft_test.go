@@ -1,6 +1,8 @@
 package raft
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -8,6 +10,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
 	"github.com/sandglass/sandglass/topic"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
@@ -68,3 +71,159 @@ func TestRaft(t *testing.T) {
 	err = s.SetPartitionLeaderBulkOp(state)
 	require.NoError(t, err)
 }
+
+func TestReadState(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s := New(Config{
+		BindAddr: "127.0.0.1:1236",
+		AdvAddr:  "127.0.0.1:1236",
+		Dir:      tmpDir,
+	}, logger)
+
+	err := s.Init(true, &serf.Serf{}, nil)
+	require.NoError(t, err)
+
+	time.Sleep(3 * time.Second)
+
+	err = s.CreateTopic(&topic.Topic{
+		Name:              "hello",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		StorageDriver:     sgproto.StorageDriver_Memory,
+		Partitions:        []*topic.Partition{{Id: "part1"}},
+	})
+	require.NoError(t, err)
+
+	err = s.SetPartitionHWMark(map[string]map[string]uint64{
+		"hello": {"part1": 5},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Stop())
+
+	state, err := ReadState(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, state.Topics, 1)
+	require.Equal(t, sgproto.StorageDriver_Memory, state.Topics["hello"].StorageDriver)
+	require.Len(t, state.Topics["hello"].Partitions, 1)
+	require.Equal(t, uint64(5), state.PartitionHWMarks["hello"]["part1"])
+}
+
+func TestLeaderChangeKeepsHWMark(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s := New(Config{
+		BindAddr: "127.0.0.1:1238",
+		AdvAddr:  "127.0.0.1:1238",
+		Dir:      tmpDir,
+	}, logger)
+
+	err := s.Init(true, &serf.Serf{}, nil)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	time.Sleep(3 * time.Second)
+
+	err = s.CreateTopic(&topic.Topic{
+		Name:              "hello",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		StorageDriver:     sgproto.StorageDriver_Memory,
+		Partitions:        []*topic.Partition{{Id: "part1"}},
+	})
+	require.NoError(t, err)
+
+	p := s.GetTopic("hello").GetPartition("part1")
+	for i := 0; i < 5; i++ {
+		err = p.PutMessage(&sgproto.Message{Value: []byte("value")})
+		require.NoError(t, err)
+	}
+
+	err = s.SetPartitionHWMark(map[string]map[string]uint64{
+		"hello": {"part1": 3},
+	})
+	require.NoError(t, err)
+
+	// the new leader drops the entries which are not replicated yet
+	err = s.SetPartitionLeaderBulkOp(map[string]map[string]string{
+		"hello": {"part1": "127.0.0.1:1238"},
+	})
+	require.NoError(t, err)
+
+	var indexes []uint64
+	err = p.RangeFromWAL(nil, func(msg *sgproto.Message) error {
+		indexes = append(indexes, msg.Index)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, indexes, "the entries up to the HW mark should be kept")
+}
+
+func TestSchedules(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s := New(Config{
+		BindAddr: "127.0.0.1:1237",
+		AdvAddr:  "127.0.0.1:1237",
+		Dir:      tmpDir,
+	}, logger)
+
+	err := s.Init(true, &serf.Serf{}, nil)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	time.Sleep(3 * time.Second)
+
+	next := time.Now().UTC().Add(time.Minute).Truncate(time.Second)
+	for _, name := range []string{"b", "a"} {
+		err = s.SetSchedule(&sgproto.Schedule{
+			Topic:    "hello",
+			Name:     name,
+			Interval: time.Minute,
+			Template: &sgproto.Message{Value: []byte("tick")},
+			Next:     next,
+		})
+		require.NoError(t, err)
+	}
+
+	schedules := s.GetSchedules("")
+	require.Len(t, schedules, 2)
+	require.Equal(t, "a", schedules[0].Name)
+	require.Empty(t, s.GetSchedules("other"))
+
+	err = s.AdvanceSchedule("hello", "a", next.Add(time.Minute), 1, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), schedules[0].Sequence, "handed out schedules should not be modified")
+
+	// a batch recorded twice is only counted once
+	err = s.AdvanceSchedule("hello", "a", next.Add(2*time.Minute), 2, 1)
+	require.NoError(t, err)
+
+	a := s.GetSchedule("hello", "a")
+	require.Equal(t, uint64(1), a.Sequence)
+	require.Equal(t, uint64(1), a.Occurrences)
+	require.True(t, next.Add(time.Minute).Equal(a.Next))
+
+	// schedules are kept in the snapshots
+	snapshot, err := (*fsm)(s).Snapshot()
+	require.NoError(t, err)
+	b, err := json.Marshal(snapshot.(*fsmSnapshot).state)
+	require.NoError(t, err)
+
+	err = s.DeleteSchedule("hello", "a")
+	require.NoError(t, err)
+	require.Nil(t, s.GetSchedule("hello", "a"))
+	require.Len(t, s.GetSchedules("hello"), 1)
+
+	err = (*fsm)(s).Restore(ioutil.NopCloser(bytes.NewReader(b)))
+	require.NoError(t, err)
+
+	a = s.GetSchedule("hello", "a")
+	require.NotNil(t, a)
+	require.Equal(t, "tick", string(a.Template.Value))
+	require.True(t, next.Add(time.Minute).Equal(a.Next))
+}
@@ -0,0 +1,69 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCron(t *testing.T) {
+	from := time.Date(2018, time.January, 31, 10, 42, 30, 0, time.UTC) // wednesday
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2018, time.January, 31, 10, 43, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, time.January, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2018, time.January, 31, 13, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2018, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2018, time.March, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2018, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * 1", time.Date(2018, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2018, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		require.NoError(t, err, test.expr)
+		require.Equal(t, test.next, c.Next(from), test.expr)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := ParseCron(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	now := time.Date(2018, time.January, 31, 10, 42, 30, 0, time.UTC)
+	s := &sgproto.Schedule{
+		Name:     "every10s",
+		Interval: 10 * time.Second,
+		Next:     now.Add(-time.Hour - 5*time.Second),
+	}
+
+	// only the last missed occurrence is kept
+	times, next, err := Occurrences(s, now, now.Add(20*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, []time.Time{
+		now.Add(-5 * time.Second),
+		now.Add(5 * time.Second),
+		now.Add(15 * time.Second),
+	}, times)
+	require.Equal(t, now.Add(25*time.Second), next)
+
+	s = &sgproto.Schedule{
+		Name: "hourly",
+		Cron: "0 * * * *",
+		Next: time.Date(2018, time.January, 31, 11, 0, 0, 0, time.UTC),
+	}
+	times, next, err = Occurrences(s, now, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, times)
+	require.Equal(t, s.Next, next)
+}
@@ -0,0 +1,131 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+var (
+	ErrInvalidSchedule = errors.New("ErrInvalidSchedule")
+)
+
+// MinInterval is the shortest interval between the occurrences of a schedule
+const MinInterval = time.Second
+
+// Validate checks that s has a name, a topic and either a cron expression or an interval
+func Validate(s *sgproto.Schedule) error {
+	if s.Topic == "" || s.Name == "" {
+		return ErrInvalidSchedule
+	}
+
+	switch {
+	case s.Cron != "" && s.Interval != 0:
+		return fmt.Errorf("schedule '%s' should have either a cron expression or an interval", s.Name)
+	case s.Cron != "":
+		_, err := ParseCron(s.Cron)
+		return err
+	case s.Interval < MinInterval:
+		return fmt.Errorf("interval of schedule '%s' should be at least %v", s.Name, MinInterval)
+	}
+
+	return nil
+}
+
+// Next returns the first occurrence of s strictly after t
+func Next(s *sgproto.Schedule, t time.Time) (time.Time, error) {
+	if s.Cron == "" {
+		if s.Interval < MinInterval {
+			return time.Time{}, ErrInvalidSchedule
+		}
+
+		return t.Add(s.Interval), nil
+	}
+
+	c, err := ParseCron(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next := c.Next(t)
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron expression '%s' never occurs", s.Cron)
+	}
+
+	return next, nil
+}
+
+// Occurrences returns the occurrences of s from its next one up to until, along with the first occurrence
+// following them. The occurrences missed before now are skipped except the last one, it is returned late.
+func Occurrences(s *sgproto.Schedule, now, until time.Time) (times []time.Time, next time.Time, err error) {
+	next = s.Next
+	if next.Before(now) {
+		if s.Cron == "" && s.Interval > 0 { // no need to go through every missed interval
+			if missed := now.Sub(next) / s.Interval; missed > 1 {
+				next = next.Add((missed - 1) * s.Interval)
+			}
+		}
+
+		last := next
+		for next.Before(now) {
+			last = next
+			if next, err = Next(s, next); err != nil {
+				return nil, time.Time{}, err
+			}
+		}
+		times = append(times, last)
+	}
+
+	for !next.After(until) {
+		times = append(times, next)
+		if next, err = Next(s, next); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	return times, next, nil
+}
+
+// Batch returns the request producing the occurrences of s up to until, nil when there is none, along with
+// the occurrence following them. The batch is the next one of the idempotent producer of the schedule so that
+// producing it again, after its occurrences could not be recorded, does not store them twice.
+func Batch(s *sgproto.Schedule, now, until time.Time) (*sgproto.ProduceMessageRequest, time.Time, error) {
+	times, next, err := Occurrences(s, now, until)
+	if err != nil || len(times) == 0 {
+		return nil, next, err
+	}
+
+	req := &sgproto.ProduceMessageRequest{
+		Topic:              s.Topic,
+		Partition:          s.Partition,
+		ProducerId:         "schedule/" + s.Name,
+		Sequence:           s.Sequence + 1,
+		Acks:               sgproto.AckLevel_ReplicatedAck,
+		PreserveProducedAt: true,
+	}
+	for _, at := range times {
+		req.Messages = append(req.Messages, occurrence(s, at, now))
+	}
+
+	return req, next, nil
+}
+
+// occurrence returns the message of a schedule due at the given time, the late ones are due right away
+func occurrence(s *sgproto.Schedule, at, now time.Time) *sgproto.Message {
+	msg := &sgproto.Message{}
+	if s.Template != nil {
+		*msg = *s.Template
+	}
+
+	msg.Offset = sgproto.Nil
+	msg.Index = 0
+	msg.ProducedAt = now
+	msg.ConsumeIn = 0
+	if at.After(now) {
+		msg.ConsumeIn = at.Sub(now)
+	}
+
+	return msg
+}
@@ -0,0 +1,62 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	now := time.Date(2018, time.January, 31, 10, 42, 30, 0, time.UTC)
+	template := &sgproto.Message{
+		Offset:  sgproto.NewOffset(42, now),
+		Index:   42,
+		Channel: "reports",
+		Value:   []byte("report"),
+	}
+	s := &sgproto.Schedule{
+		Topic:     "jobs",
+		Partition: "p0",
+		Name:      "every10s",
+		Interval:  10 * time.Second,
+		Next:      now.Add(-5 * time.Second),
+		Sequence:  7,
+		Template:  template,
+	}
+
+	req, next, err := Batch(s, now, now.Add(20*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, now.Add(25*time.Second), next)
+	require.Equal(t, "jobs", req.Topic)
+	require.Equal(t, "p0", req.Partition)
+	require.Equal(t, "schedule/every10s", req.ProducerId)
+	require.Equal(t, uint64(8), req.Sequence, "the batch should follow the last one recorded")
+	require.Equal(t, sgproto.AckLevel_ReplicatedAck, req.Acks)
+	require.True(t, req.PreserveProducedAt)
+
+	require.Len(t, req.Messages, 3)
+	for i, consumeIn := range []time.Duration{0, 5 * time.Second, 15 * time.Second} {
+		msg := req.Messages[i]
+		require.Equal(t, consumeIn, msg.ConsumeIn, "late occurrences should be due right away")
+		require.Equal(t, now, msg.ProducedAt)
+		require.Equal(t, sgproto.Nil, msg.Offset)
+		require.Equal(t, uint64(0), msg.Index)
+		require.Equal(t, "reports", msg.Channel)
+		require.Equal(t, "report", string(msg.Value))
+	}
+	require.Equal(t, uint64(42), template.Index, "the template should not be modified")
+
+	// the same batch is produced again until it is recorded
+	again, _, err := Batch(s, now, now.Add(20*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, req.ProducerId, again.ProducerId)
+	require.Equal(t, req.Sequence, again.Sequence)
+
+	s.Next = now.Add(time.Minute)
+	req, next, err = Batch(s, now, now.Add(20*time.Second))
+	require.NoError(t, err)
+	require.Nil(t, req)
+	require.Equal(t, s.Next, next)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrInvalidBackup = errors.New("ErrInvalidBackup")
+
+// maximum size of a key or a value read from a backup
+const maxBackupEntrySize = 1 << 30
+
+// BackupWriter writes entries in the backup format: the length of the key and the key,
+// then the length of the value and the value, lengths being encoded as uvarints
+type BackupWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func NewBackupWriter(w io.Writer) *BackupWriter {
+	return &BackupWriter{w: bufio.NewWriter(w)}
+}
+
+func (bw *BackupWriter) Write(key, val []byte) error {
+	if err := bw.writeBytes(key); err != nil {
+		return err
+	}
+	return bw.writeBytes(val)
+}
+
+func (bw *BackupWriter) writeBytes(b []byte) error {
+	n := binary.PutUvarint(bw.buf[:], uint64(len(b)))
+	if _, err := bw.w.Write(bw.buf[:n]); err != nil {
+		return err
+	}
+	_, err := bw.w.Write(b)
+	return err
+}
+
+// Flush should be called once every entry is written
+func (bw *BackupWriter) Flush() error {
+	return bw.w.Flush()
+}
+
+// BackupReader reads the entries written by a BackupWriter
+type BackupReader struct {
+	r *bufio.Reader
+}
+
+func NewBackupReader(r io.Reader) *BackupReader {
+	return &BackupReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next entry, io.EOF is returned once every entry was read
+func (br *BackupReader) Read() (key, val []byte, err error) {
+	key, err = br.readBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	val, err = br.readBytes()
+	if err == io.EOF {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return key, val, err
+}
+
+func (br *BackupReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxBackupEntrySize {
+		return nil, ErrInvalidBackup
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br.r, b); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
@@ -1,6 +1,8 @@
 package badger
 
 import (
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/sandglass/sandglass/sgutils"
@@ -16,11 +18,17 @@ type Storage struct {
 	operators map[string]*badger.MergeOperator
 }
 
-func NewStorage(path string, operators ...*storage.MergeOperator) (*Storage, error) {
+func NewStorage(path string, options storage.Options, operators ...*storage.MergeOperator) (*Storage, error) {
 	opt := badger.DefaultOptions
 	opt.Dir = path
 	opt.ValueDir = path
-	opt.SyncWrites = true
+	opt.SyncWrites = !options.NoSync()
+	if options.ValueThreshold > 0 {
+		opt.ValueThreshold = options.ValueThreshold
+	}
+	if options.ValueLogFileSize > 0 {
+		opt.ValueLogFileSize = options.ValueLogFileSize
+	}
 	db, err := badger.Open(opt)
 	if err != nil {
 		return nil, err
@@ -31,7 +39,7 @@ func NewStorage(path string, operators ...*storage.MergeOperator) (*Storage, err
 		operators: make(map[string]*badger.MergeOperator),
 	}
 
-	s.StorageCommons = scommons.StorageCommons{s}
+	s.StorageCommons = scommons.StorageCommons{Storage: s}
 
 	for _, operator := range operators {
 		fn := func(operator *storage.MergeOperator) badger.MergeFunc {
@@ -72,9 +80,25 @@ func (s *Storage) Put(key, val []byte) error {
 }
 
 func (s *Storage) BatchPut(entries []*storage.Entry) error {
+	batch := storage.NewWriteBatch()
+	for _, e := range entries {
+		batch.Put(e.Key, e.Value)
+	}
+
+	return s.Write(batch)
+}
+
+func (s *Storage) Write(batch *storage.WriteBatch) error {
 	return s.db.Update(func(txn *badger.Txn) error {
-		for _, e := range entries {
-			if err := txn.Set(e.Key, e.Value); err != nil {
+		for _, op := range batch.Ops() {
+			var err error
+			if op.Delete {
+				err = txn.Delete(op.Key)
+			} else {
+				err = txn.Set(op.Key, op.Value)
+			}
+
+			if err != nil {
 				return err
 			}
 		}
@@ -114,13 +138,43 @@ func (s *Storage) ProcessMergedKey(key []byte, fn func(val []byte) ([]*storage.E
 	return txn.Commit(nil)
 }
 
+// Iter always reads from a snapshot since badger iterators are bound to a read transaction
 func (s *Storage) Iter(opts *storage.IterOptions) storage.Iterator {
 	opt := badger.DefaultIteratorOptions
 	opt.PrefetchValues = opts.FetchValues
 	opt.Reverse = opts.Reverse
 	txn := s.db.NewTransaction(false)
 
-	return &iterator{iter: txn.NewIterator(opt), txn: txn}
+	lower, upper := opts.Bounds()
+	return &iterator{
+		iter:        txn.NewIterator(opt),
+		txn:         txn,
+		fetchValues: opts.FetchValues,
+		reverse:     opts.Reverse,
+		prefix:      opts.Prefix,
+		lower:       lower,
+		upper:       upper,
+	}
+}
+
+// PrefixStats iterates over the keys under prefix, the sizes of the values are
+// estimated from their pointers so that the value log is not read
+func (s *Storage) PrefixStats(prefix []byte) (*storage.PrefixStats, error) {
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	it := txn.NewIterator(badger.IteratorOptions{
+		PrefetchValues: false,
+	})
+	defer it.Close()
+
+	stats := &storage.PrefixStats{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		stats.Keys++
+		stats.Bytes += uint64(it.Item().EstimatedSize())
+	}
+
+	return stats, nil
 }
 
 func (s *Storage) IterReverse() storage.Iterator {
@@ -128,7 +182,7 @@ func (s *Storage) IterReverse() storage.Iterator {
 	opt.Reverse = true
 
 	txn := s.db.NewTransaction(false)
-	return &iterator{iter: txn.NewIterator(opt), txn: txn}
+	return &iterator{iter: txn.NewIterator(opt), txn: txn, fetchValues: true}
 }
 
 func (s *Storage) Truncate(prefix, min []byte, batchSize int) error {
@@ -145,6 +199,7 @@ func (s *Storage) Truncate(prefix, min []byte, batchSize int) error {
 		for it.Seek(min); it.ValidForPrefix(prefix) && len(buf) < batchSize; it.Next() {
 			buf = append(buf, sgutils.CopyBytes(it.Item().Key()))
 		}
+		it.Close()
 
 		if len(buf) == 0 {
 			return false, nil
@@ -175,23 +230,39 @@ func (s *Storage) Truncate(prefix, min []byte, batchSize int) error {
 }
 
 func (s *Storage) Delete(key []byte) error {
-	txn := s.db.NewTransaction(true)
-	defer txn.Discard()
-
-	return txn.Delete(key)
+	return s.BatchDelete([][]byte{key})
 }
 
 func (s *Storage) BatchDelete(keys [][]byte) error {
-	txn := s.db.NewTransaction(true)
-	defer txn.Discard()
-
+	batch := storage.NewWriteBatch()
 	for _, key := range keys {
-		if err := txn.Delete(key); err != nil {
-			return err
-		}
+		batch.Delete(key)
 	}
 
-	return nil
+	return s.Write(batch)
+}
+
+// Stats reports the sizes of the LSM tree and of the value log, badger refreshes them every minute
+func (s *Storage) Stats() (*storage.Stats, error) {
+	lsm, vlog := s.db.Size()
+
+	tables := map[int]int{}
+	for _, t := range s.db.Tables() {
+		tables[t.Level]++
+	}
+
+	props := map[string]string{
+		"badger.lsm-size":  strconv.FormatInt(lsm, 10),
+		"badger.vlog-size": strconv.FormatInt(vlog, 10),
+	}
+	for level, n := range tables {
+		props[fmt.Sprintf("badger.num-tables-at-level%d", level)] = strconv.Itoa(n)
+	}
+
+	return &storage.Stats{
+		DiskBytes:  lsm + vlog,
+		Properties: props,
+	}, nil
 }
 
 func (s *Storage) Close() error {
@@ -1,60 +1,127 @@
 package badger
 
 import (
+	"bytes"
+
 	"github.com/sandglass/sandglass/sgutils"
 	"github.com/sandglass/sandglass/storage"
 	"github.com/dgraph-io/badger"
 )
 
+// iterator reads the current entry as soon as it is positioned so that a
+// failed value log read invalidates it before Item is called.
+// This version of badger has no bounds in its iterator options: the prefix is
+// checked with ValidForPrefix and the bounds are used as seek keys, iteration
+// stops at the first key outside of them.
 type iterator struct {
-	iter *badger.Iterator
-	txn  *badger.Txn
+	iter        *badger.Iterator
+	txn         *badger.Txn
+	fetchValues bool
+	reverse     bool
+
+	prefix       []byte
+	lower, upper []byte
+
+	current *storage.Entry
+	err     error
+}
+
+// settle loads the current entry of the badger iterator, a failed read is kept for Err
+func (i *iterator) settle() {
+	i.current = nil
+	if i.err != nil || !i.iter.ValidForPrefix(i.prefix) {
+		return
+	}
+
+	item := i.iter.Item()
+	if !i.contains(item.Key()) {
+		return
+	}
+
+	e := &storage.Entry{Key: sgutils.CopyBytes(item.Key())}
+	if i.fetchValues {
+		v, err := item.Value()
+		if err != nil {
+			i.err = err
+			return
+		}
+		e.Value = sgutils.CopyBytes(v)
+	}
+
+	i.current = e
+}
+
+func (i *iterator) contains(key []byte) bool {
+	if i.lower != nil && bytes.Compare(key, i.lower) < 0 {
+		return false
+	}
+
+	return i.upper == nil || bytes.Compare(key, i.upper) < 0
 }
 
 func (i *iterator) Rewind() {
-	i.iter.Rewind()
+	switch {
+	case i.reverse && i.upper != nil:
+		i.seekBefore(i.upper)
+	case !i.reverse && i.lower != nil:
+		i.iter.Seek(i.lower)
+		i.settle()
+	default:
+		i.iter.Rewind()
+		i.settle()
+	}
+}
+
+// seekBefore positions a reverse iterator on the last key lower than key,
+// badger seeks to the last key lower or equal in reverse
+func (i *iterator) seekBefore(key []byte) {
+	i.iter.Seek(key)
+	if i.iter.Valid() && bytes.Equal(i.iter.Item().Key(), key) {
+		i.iter.Next()
+	}
+	i.settle()
 }
 
 func (i *iterator) Seek(at []byte) {
-	i.iter.Seek(at)
+	switch {
+	case i.reverse && i.upper != nil && bytes.Compare(at, i.upper) >= 0:
+		i.seekBefore(i.upper)
+	case !i.reverse && i.lower != nil && bytes.Compare(at, i.lower) < 0:
+		i.iter.Seek(i.lower)
+		i.settle()
+	default:
+		i.iter.Seek(at)
+		i.settle()
+	}
 }
 
 func (i *iterator) Valid() bool {
-	return i.iter.Valid()
+	return i.current != nil
 }
 
 func (i *iterator) ValidForPrefix(prefix []byte) bool {
-	return i.iter.ValidForPrefix(prefix)
+	return i.current != nil && bytes.HasPrefix(i.current.Key, prefix)
 }
 
 func (i *iterator) Next() {
+	if i.current == nil {
+		return
+	}
+
 	i.iter.Next()
+	i.settle()
 }
 
 func (i *iterator) Item() *storage.Entry {
-	item := i.iter.Item()
-	if item == nil {
-		return nil
-	}
-
-	key := sgutils.CopyBytes(item.Key())
-	v, err := item.Value()
-	if err != nil {
-		panic(err)
-	}
-
-	val := sgutils.CopyBytes(v)
-	if err != nil {
-		panic(err)
-	}
+	return i.current
+}
 
-	return &storage.Entry{
-		Key:   key,
-		Value: val,
-	}
+func (i *iterator) Err() error {
+	return i.err
 }
 
 func (i *iterator) Close() error {
+	i.current = nil
 	i.iter.Close()
 	i.txn.Discard()
 	return nil
@@ -0,0 +1,40 @@
+package storage
+
+// WriteBatch groups puts and deletes that are applied atomically by Storage.Write:
+// either every operation is persisted or none of them is.
+type WriteBatch struct {
+	ops []BatchOp
+}
+
+// BatchOp is a single operation of a WriteBatch
+type BatchOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key, val []byte) {
+	b.ops = append(b.ops, BatchOp{Key: key, Value: val})
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, BatchOp{Key: key, Delete: true})
+}
+
+// Ops returns the operations in the order they were added,
+// a later operation on a key overrides the previous ones
+func (b *WriteBatch) Ops() []BatchOp {
+	return b.ops
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
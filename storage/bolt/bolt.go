@@ -0,0 +1,267 @@
+package bolt
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/scommons"
+)
+
+var (
+	ErrNoMergeOperator = errors.New("ErrNoMergeOperator")
+	ErrKeyNotFound     = errors.New("ErrKeyNotFound")
+)
+
+var (
+	dbFileName = "data.bolt"
+	bucketName = []byte("sandglass")
+)
+
+type Storage struct {
+	db *bolt.DB
+	scommons.StorageCommons
+	operators map[string]*storage.MergeOperator
+}
+
+func NewStorage(path string, options storage.Options, operators ...*storage.MergeOperator) (*Storage, error) {
+	db, err := bolt.Open(filepath.Join(path, dbFileName), 0600, &bolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = options.NoSync()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Storage{
+		db:        db,
+		operators: make(map[string]*storage.MergeOperator),
+	}
+
+	s.StorageCommons = scommons.StorageCommons{Storage: s}
+
+	for _, operator := range operators {
+		s.operators[string(operator.Key)] = operator
+	}
+
+	return s, nil
+}
+
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketName).Get(key)
+		if v != nil {
+			val = sgutils.CopyBytes(v)
+		}
+		return nil
+	})
+	return val, err
+}
+
+func (s *Storage) Put(key, val []byte) error {
+	return s.BatchPut([]*storage.Entry{{Key: key, Value: val}})
+}
+
+func (s *Storage) BatchPut(entries []*storage.Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, e := range entries {
+			if err := b.Put(e.Key, e.Value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *Storage) Write(batch *storage.WriteBatch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, op := range batch.Ops() {
+			var err error
+			if op.Delete {
+				err = b.Delete(op.Key)
+			} else {
+				err = b.Put(op.Key, op.Value)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *Storage) Merge(key, operation []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.merge(tx.Bucket(bucketName), key, operation)
+	})
+}
+
+func (s *Storage) merge(b *bolt.Bucket, key, operation []byte) error {
+	operator, ok := s.operators[string(key)]
+	if !ok {
+		return ErrNoMergeOperator
+	}
+
+	newValue, ok := operator.MergeFunc(sgutils.CopyBytes(b.Get(key)), operation)
+	if !ok {
+		return nil
+	}
+
+	return b.Put(key, newValue)
+}
+
+func (s *Storage) ProcessMergedKey(key []byte, fn func(val []byte) ([]*storage.Entry, []byte, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		val := b.Get(key)
+		if val == nil {
+			return ErrKeyNotFound
+		}
+
+		entries, operation, err := fn(sgutils.CopyBytes(val))
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := b.Put(e.Key, e.Value); err != nil {
+				return err
+			}
+		}
+
+		return s.merge(b, key, operation)
+	})
+}
+
+func (s *Storage) Iter(opts *storage.IterOptions) storage.Iterator {
+	it := &iterator{db: s.db, opts: opts}
+	if opts.Snapshot {
+		// Begin only fails once the database is closed, reads fail the same way without it
+		tx, err := s.db.Begin(false)
+		if err == nil {
+			it.tx = tx
+		}
+	}
+
+	return storage.NewBoundedIterator(it, opts)
+}
+
+// PrefixStats iterates over the entries under prefix in a single read transaction, values are not copied
+func (s *Storage) PrefixStats(prefix []byte) (*storage.PrefixStats, error) {
+	stats := &storage.PrefixStats{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			stats.Keys++
+			stats.Bytes += uint64(len(k) + len(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (s *Storage) Truncate(prefix, min []byte, batchSize int) error {
+	truncate := func() (bool, error) {
+		var n int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucketName)
+			buf := make([][]byte, 0, batchSize)
+
+			c := b.Cursor()
+			for k, _ := c.Seek(min); k != nil && bytes.HasPrefix(k, prefix) && len(buf) < batchSize; k, _ = c.Next() {
+				buf = append(buf, sgutils.CopyBytes(k))
+			}
+
+			for _, key := range buf {
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+			}
+
+			n = len(buf)
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return n > 0, nil
+	}
+
+	ok, err := truncate()
+	for ; ok; ok, err = truncate() {
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Storage) Delete(key []byte) error {
+	return s.BatchDelete([][]byte{key})
+}
+
+func (s *Storage) BatchDelete(keys [][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, key := range keys {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Stats reports the size of the database file, which includes the free pages not yet reused
+func (s *Storage) Stats() (*storage.Stats, error) {
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	st := s.db.Stats()
+	return &storage.Stats{
+		DiskBytes: info.Size(),
+		Properties: map[string]string{
+			"bolt.free-pages":    strconv.Itoa(st.FreePageN),
+			"bolt.pending-pages": strconv.Itoa(st.PendingPageN),
+			"bolt.free-bytes":    strconv.Itoa(st.FreeAlloc),
+			"bolt.open-read-txs": strconv.Itoa(st.OpenTxN),
+		},
+	}, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+var _ storage.Storage = (*Storage)(nil)
@@ -0,0 +1,140 @@
+package bolt
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/storage"
+)
+
+// number of entries loaded per read transaction
+const chunkSize = 256
+
+// iterator reads entries by chunks, each one in its own short lived read
+// transaction. Keeping a read transaction open for the whole iteration would
+// block writers as soon as bolt needs to grow its memory map, which is only
+// done for snapshot iterators: the goroutine using one must not write meanwhile.
+type iterator struct {
+	db   *bolt.DB
+	tx   *bolt.Tx // set for snapshot iterators
+	opts *storage.IterOptions
+
+	buf       []*storage.Entry
+	pos       int
+	exhausted bool
+	err       error
+}
+
+// load fills the buffer starting at key, key itself is skipped when inclusive is false.
+// A nil key starts from the first (or last in reverse) entry.
+// A failed read empties the buffer and is kept for Err.
+func (i *iterator) load(key []byte, inclusive bool) {
+	i.buf = i.buf[:0]
+	i.pos = 0
+
+	i.err = i.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+
+		var k, v []byte
+		switch {
+		case key == nil && i.opts.Reverse:
+			k, v = c.Last()
+		case key == nil:
+			k, v = c.First()
+		case i.opts.Reverse:
+			k, v = c.Seek(key)
+			if k == nil {
+				k, v = c.Last()
+			}
+			for k != nil && (bytes.Compare(k, key) > 0 || (!inclusive && bytes.Equal(k, key))) {
+				k, v = c.Prev()
+			}
+		default:
+			k, v = c.Seek(key)
+			if !inclusive && bytes.Equal(k, key) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil && len(i.buf) < chunkSize; k, v = i.move(c) {
+			e := &storage.Entry{Key: sgutils.CopyBytes(k)}
+			if i.opts.FetchValues {
+				e.Value = sgutils.CopyBytes(v)
+			}
+			i.buf = append(i.buf, e)
+		}
+
+		i.exhausted = len(i.buf) < chunkSize
+		return nil
+	})
+	if i.err != nil {
+		i.buf = i.buf[:0]
+		i.exhausted = true
+	}
+}
+
+func (i *iterator) view(fn func(tx *bolt.Tx) error) error {
+	if i.tx != nil {
+		return fn(i.tx)
+	}
+	return i.db.View(fn)
+}
+
+func (i *iterator) move(c *bolt.Cursor) ([]byte, []byte) {
+	if i.opts.Reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+func (i *iterator) Rewind() {
+	i.load(nil, true)
+}
+
+func (i *iterator) Seek(at []byte) {
+	i.load(at, true)
+}
+
+func (i *iterator) Valid() bool {
+	return i.pos < len(i.buf)
+}
+
+func (i *iterator) ValidForPrefix(prefix []byte) bool {
+	return i.Valid() && bytes.HasPrefix(i.buf[i.pos].Key, prefix)
+}
+
+func (i *iterator) Next() {
+	if !i.Valid() {
+		return
+	}
+
+	i.pos++
+	if i.pos == len(i.buf) && !i.exhausted {
+		i.load(i.buf[i.pos-1].Key, false)
+	}
+}
+
+func (i *iterator) Item() *storage.Entry {
+	if !i.Valid() {
+		return nil
+	}
+
+	return i.buf[i.pos]
+}
+
+func (i *iterator) Err() error {
+	return i.err
+}
+
+func (i *iterator) Close() error {
+	i.buf = nil
+	if i.tx != nil {
+		err := i.tx.Rollback()
+		i.tx = nil
+		return err
+	}
+	return nil
+}
+
+var _ storage.Iterator = (*iterator)(nil)
@@ -0,0 +1,37 @@
+package bolt
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIteratorReadError(t *testing.T) {
+	s, err := NewStorage(t.TempDir(), storage.Options{})
+	require.NoError(t, err)
+
+	for i := 0; i < chunkSize+1; i++ {
+		require.NoError(t, s.Put([]byte(fmt.Sprintf("key%04d", i)), []byte("value")))
+	}
+
+	it := s.Iter(&storage.IterOptions{FetchValues: true})
+	defer it.Close()
+
+	n := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		if n == 0 {
+			// the next chunk is read from a closed database
+			require.NoError(t, s.Close())
+		}
+		n++
+	}
+	require.Equal(t, chunkSize, n)
+	require.Equal(t, bolt.ErrDatabaseNotOpen, it.Err())
+
+	it.Rewind()
+	require.False(t, it.Valid())
+	require.Equal(t, bolt.ErrDatabaseNotOpen, it.Err())
+}
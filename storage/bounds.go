@@ -0,0 +1,158 @@
+package storage
+
+import "bytes"
+
+// PrefixEnd returns the smallest key greater than every key starting with prefix,
+// nil is returned when there is none
+func PrefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// Successor returns the smallest key greater than key
+func Successor(key []byte) []byte {
+	next := make([]byte, len(key)+1)
+	copy(next, key)
+	return next
+}
+
+// Bounds returns the range [lower, upper) covered by the options.
+// A nil bound means the iteration is not bounded on that side.
+func (opts *IterOptions) Bounds() (lower, upper []byte) {
+	lower = opts.LowerBound
+	if opts.Prefix != nil && bytes.Compare(opts.Prefix, lower) > 0 {
+		lower = opts.Prefix
+	}
+
+	upper = opts.UpperBound
+	if opts.Prefix != nil {
+		end := PrefixEnd(opts.Prefix)
+		if end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+			upper = end
+		}
+	}
+
+	return lower, upper
+}
+
+func (opts *IterOptions) bounded() bool {
+	return opts.Prefix != nil || opts.LowerBound != nil || opts.UpperBound != nil
+}
+
+// NewBoundedIterator restricts it to the prefix and bounds of opts.
+// Rewind and Seek position the iterator within the bounds, it is returned as is when opts has none.
+func NewBoundedIterator(it Iterator, opts *IterOptions) Iterator {
+	if !opts.bounded() {
+		return it
+	}
+
+	lower, upper := opts.Bounds()
+	return &boundedIterator{
+		it:      it,
+		lower:   lower,
+		upper:   upper,
+		reverse: opts.Reverse,
+	}
+}
+
+type boundedIterator struct {
+	it           Iterator
+	lower, upper []byte
+	reverse      bool
+	current      *Entry
+}
+
+func (i *boundedIterator) contains(key []byte) bool {
+	if i.lower != nil && bytes.Compare(key, i.lower) < 0 {
+		return false
+	}
+
+	return i.upper == nil || bytes.Compare(key, i.upper) < 0
+}
+
+// settle caches the current entry of the underlying iterator when it is within the bounds
+func (i *boundedIterator) settle() {
+	i.current = nil
+	if !i.it.Valid() {
+		return
+	}
+
+	item := i.it.Item()
+	if item != nil && i.contains(item.Key) {
+		i.current = item
+	}
+}
+
+func (i *boundedIterator) Rewind() {
+	switch {
+	case i.reverse && i.upper != nil:
+		i.seekBefore(i.upper)
+	case !i.reverse && i.lower != nil:
+		i.it.Seek(i.lower)
+		i.settle()
+	default:
+		i.it.Rewind()
+		i.settle()
+	}
+}
+
+// seekBefore positions a reverse iterator on the last key lower than key
+func (i *boundedIterator) seekBefore(key []byte) {
+	i.it.Seek(key)
+	if i.it.Valid() && bytes.Equal(i.it.Item().Key, key) {
+		i.it.Next()
+	}
+	i.settle()
+}
+
+func (i *boundedIterator) Seek(at []byte) {
+	switch {
+	case i.reverse && i.upper != nil && bytes.Compare(at, i.upper) >= 0:
+		i.seekBefore(i.upper)
+	case !i.reverse && i.lower != nil && bytes.Compare(at, i.lower) < 0:
+		i.it.Seek(i.lower)
+		i.settle()
+	default:
+		i.it.Seek(at)
+		i.settle()
+	}
+}
+
+func (i *boundedIterator) Valid() bool {
+	return i.current != nil
+}
+
+func (i *boundedIterator) ValidForPrefix(prefix []byte) bool {
+	return i.current != nil && bytes.HasPrefix(i.current.Key, prefix)
+}
+
+func (i *boundedIterator) Next() {
+	if i.current == nil {
+		return
+	}
+
+	i.it.Next()
+	i.settle()
+}
+
+func (i *boundedIterator) Item() *Entry {
+	return i.current
+}
+
+func (i *boundedIterator) Err() error {
+	return i.it.Err()
+}
+
+func (i *boundedIterator) Close() error {
+	return i.it.Close()
+}
+
+var _ Iterator = (*boundedIterator)(nil)
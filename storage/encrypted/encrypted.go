@@ -0,0 +1,182 @@
+// Package encrypted wraps a storage driver to encrypt values at rest with AES-GCM.
+// Keys are left in clear so that the ordering of the underlying storage is preserved.
+package encrypted
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/scommons"
+)
+
+var (
+	ErrMergeNotSupported = errors.New("ErrMergeNotSupported")
+	ErrInvalidEnvelope   = errors.New("ErrInvalidEnvelope")
+)
+
+// an envelope is made of the version, the key id, the nonce and the sealed value
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 1 + 4
+)
+
+type Storage struct {
+	db      storage.Storage
+	keyring *Keyring
+	scommons.StorageCommons
+}
+
+// NewStorage encrypts the values written to db with the current key of keyring.
+// Merge operators work on stored values and thus cannot be used through it.
+func NewStorage(db storage.Storage, keyring *Keyring) (*Storage, error) {
+	if keyring == nil {
+		return nil, ErrNoKey
+	}
+
+	s := &Storage{
+		db:      db,
+		keyring: keyring,
+	}
+
+	s.StorageCommons = scommons.StorageCommons{Storage: s}
+
+	return s, nil
+}
+
+// seal encrypts val, key is used as additional data so that a value cannot be moved to another key
+func (s *Storage) seal(key, val []byte) ([]byte, error) {
+	aead, err := s.keyring.get(s.keyring.current)
+	if err != nil {
+		return nil, err
+	}
+
+	header := envelopeHeaderSize + aead.NonceSize()
+	out := make([]byte, header, header+len(val)+aead.Overhead())
+	out[0] = envelopeVersion
+	binary.BigEndian.PutUint32(out[1:envelopeHeaderSize], s.keyring.current)
+
+	nonce := out[envelopeHeaderSize:header]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, nonce, val, key), nil
+}
+
+func (s *Storage) open(key, envelope []byte) ([]byte, error) {
+	if len(envelope) < envelopeHeaderSize || envelope[0] != envelopeVersion {
+		return nil, ErrInvalidEnvelope
+	}
+
+	aead, err := s.keyring.get(binary.BigEndian.Uint32(envelope[1:envelopeHeaderSize]))
+	if err != nil {
+		return nil, err
+	}
+
+	header := envelopeHeaderSize + aead.NonceSize()
+	if len(envelope) < header {
+		return nil, ErrInvalidEnvelope
+	}
+
+	return aead.Open(nil, envelope[envelopeHeaderSize:header], envelope[header:], key)
+}
+
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	val, err := s.db.Get(key)
+	if err != nil || val == nil {
+		return val, err
+	}
+
+	return s.open(key, val)
+}
+
+func (s *Storage) Put(key, val []byte) error {
+	return s.BatchPut([]*storage.Entry{{Key: key, Value: val}})
+}
+
+func (s *Storage) BatchPut(entries []*storage.Entry) error {
+	sealed := make([]*storage.Entry, len(entries))
+	for i, e := range entries {
+		val, err := s.seal(e.Key, e.Value)
+		if err != nil {
+			return err
+		}
+
+		sealed[i] = &storage.Entry{Key: e.Key, Value: val}
+	}
+
+	return s.db.BatchPut(sealed)
+}
+
+func (s *Storage) Write(batch *storage.WriteBatch) error {
+	sealed := storage.NewWriteBatch()
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			sealed.Delete(op.Key)
+			continue
+		}
+
+		val, err := s.seal(op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+		sealed.Put(op.Key, val)
+	}
+
+	return s.db.Write(sealed)
+}
+
+func (s *Storage) Merge(key, operation []byte) error {
+	return ErrMergeNotSupported
+}
+
+func (s *Storage) ProcessMergedKey(key []byte, fn func(val []byte) ([]*storage.Entry, []byte, error)) error {
+	return ErrMergeNotSupported
+}
+
+func (s *Storage) Iter(opts *storage.IterOptions) storage.Iterator {
+	return &iterator{
+		Iterator: s.db.Iter(opts),
+		s:        s,
+		opts:     opts,
+	}
+}
+
+func (s *Storage) Truncate(prefix, min []byte, batchSize int) error {
+	return s.db.Truncate(prefix, min, batchSize)
+}
+
+func (s *Storage) Delete(key []byte) error {
+	return s.db.Delete(key)
+}
+
+func (s *Storage) BatchDelete(keys [][]byte) error {
+	return s.db.BatchDelete(keys)
+}
+
+func (s *Storage) Stats() (*storage.Stats, error) {
+	return s.db.Stats()
+}
+
+// PrefixStats counts the sealed values as stored, they do not need to be opened
+func (s *Storage) PrefixStats(prefix []byte) (*storage.PrefixStats, error) {
+	return s.db.PrefixStats(prefix)
+}
+
+// Backup keeps the values sealed, the backup can only be restored with the same keys
+func (s *Storage) Backup(w io.Writer, opts *storage.IterOptions) error {
+	return s.db.Backup(w, opts)
+}
+
+func (s *Storage) Restore(r io.Reader, check func(key []byte) error) error {
+	return s.db.Restore(r, check)
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+var _ storage.Storage = (*Storage)(nil)
@@ -0,0 +1,90 @@
+package encrypted
+
+import (
+	"bytes"
+
+	"github.com/sandglass/sandglass/storage"
+)
+
+// iterator decrypts the values of the underlying iterator as it moves,
+// a value that cannot be decrypted stops the iteration and is reported by Err
+type iterator struct {
+	storage.Iterator
+	s    *Storage
+	opts *storage.IterOptions
+
+	current *storage.Entry
+	err     error
+}
+
+// settle decrypts the current entry of the underlying iterator
+func (i *iterator) settle() {
+	i.current = nil
+	if i.err != nil || !i.Iterator.Valid() {
+		return
+	}
+
+	item := i.Iterator.Item()
+	if item == nil {
+		return
+	}
+
+	if !i.opts.FetchValues || len(item.Value) == 0 {
+		i.current = &storage.Entry{Key: item.Key}
+		return
+	}
+
+	val, err := i.s.open(item.Key, item.Value)
+	if err != nil {
+		i.err = err
+		return
+	}
+
+	i.current = &storage.Entry{
+		Key:   item.Key,
+		Value: val,
+	}
+}
+
+func (i *iterator) Rewind() {
+	i.err = nil
+	i.Iterator.Rewind()
+	i.settle()
+}
+
+func (i *iterator) Seek(at []byte) {
+	i.err = nil
+	i.Iterator.Seek(at)
+	i.settle()
+}
+
+func (i *iterator) Valid() bool {
+	return i.current != nil
+}
+
+func (i *iterator) ValidForPrefix(prefix []byte) bool {
+	return i.current != nil && bytes.HasPrefix(i.current.Key, prefix)
+}
+
+func (i *iterator) Next() {
+	if i.current == nil {
+		return
+	}
+
+	i.Iterator.Next()
+	i.settle()
+}
+
+func (i *iterator) Item() *storage.Entry {
+	return i.current
+}
+
+func (i *iterator) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+
+	return i.Iterator.Err()
+}
+
+var _ storage.Iterator = (*iterator)(nil)
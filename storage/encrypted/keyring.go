@@ -0,0 +1,152 @@
+package encrypted
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoKey      = errors.New("ErrNoKey")
+	ErrUnknownKey = errors.New("ErrUnknownKey")
+)
+
+// keyFileExt is the extension of the key files of a keyring directory
+const keyFileExt = ".key"
+
+// Keyring holds the AES keys used to encrypt values, each one identified by a number.
+// New values are encrypted with the key of the greatest id, the other keys are kept
+// to read values written before a rotation.
+type Keyring struct {
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+// NewKeyring creates a keyring from raw AES keys of 16, 24 or 32 bytes
+func NewKeyring(keys map[uint32][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKey
+	}
+
+	k := &Keyring{
+		keys: make(map[uint32]cipher.AEAD, len(keys)),
+	}
+
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", id, err)
+		}
+
+		k.keys[id] = aead
+		if id > k.current {
+			k.current = id
+		}
+	}
+
+	return k, nil
+}
+
+// LoadKeyfile reads a keyring from a file holding one key per line
+// as "<id> <base64 encoded key>", empty lines and lines starting with '#' are ignored.
+func LoadKeyfile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[uint32][]byte{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected '<id> <key>'", path, n)
+		}
+
+		id, key, err := parseKey(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %d", path, n, id)
+		}
+		keys[id] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewKeyring(keys)
+}
+
+// LoadKeyringDir reads a keyring from a directory where each key is stored
+// base64 encoded in its own "<id>.key" file. Rotating keys is done by adding a file with a greater id.
+func LoadKeyringDir(dir string) (*Keyring, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[uint32][]byte{}
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != keyFileExt {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		id, key, err := parseKey(strings.TrimSuffix(fi.Name(), keyFileExt), string(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fi.Name(), err)
+		}
+		keys[id] = key
+	}
+
+	return NewKeyring(keys)
+}
+
+func parseKey(id, key string) (uint32, []byte, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid key id '%s'", id)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid key %d: %v", n, err)
+	}
+
+	return uint32(n), b, nil
+}
+
+func (k *Keyring) get(id uint32) (cipher.AEAD, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return aead, nil
+}
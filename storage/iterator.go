@@ -11,6 +11,8 @@ type Iterator interface {
 	ValidForPrefix(prefix []byte) bool
 	Item() *Entry
 	Next()
+	// Err returns the error that stopped the iteration, Valid is false once it is set
+	Err() error
 	Close() error
 }
 
@@ -19,5 +21,6 @@ type MessageIterator interface {
 	Seek(sgproto.Offset) *sgproto.Message
 	Valid() bool
 	Next() *sgproto.Message
+	Err() error
 	Close() error
 }
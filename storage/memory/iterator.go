@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/storage"
+)
+
+// iterator does not hold the storage lock between calls, each move looks up
+// the next entry from the current key so that concurrent writes are allowed.
+// A snapshot iterator moves over a copy of the entries taken at its creation instead.
+type iterator struct {
+	s        *Storage
+	opts     *storage.IterOptions
+	current  *storage.Entry
+	snapshot []*storage.Entry
+}
+
+// entries returns the entries to iterate over, the returned func releases them
+func (i *iterator) entries() ([]*storage.Entry, func()) {
+	if i.snapshot != nil {
+		return i.snapshot, func() {}
+	}
+
+	i.s.mu.RLock()
+	return i.s.entries, i.s.mu.RUnlock
+}
+
+// search returns the position of the first entry whose key is >= key
+func search(entries []*storage.Entry, key []byte) int {
+	return sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].Key, key) >= 0
+	})
+}
+
+// at positions the iterator on the entry at pos, invalidating it when out of bounds
+func (i *iterator) at(entries []*storage.Entry, pos int) {
+	if pos < 0 || pos >= len(entries) {
+		i.current = nil
+		return
+	}
+
+	i.current = entries[pos]
+}
+
+func (i *iterator) Rewind() {
+	entries, release := i.entries()
+	defer release()
+
+	if i.opts.Reverse {
+		i.at(entries, len(entries)-1)
+		return
+	}
+	i.at(entries, 0)
+}
+
+func (i *iterator) Seek(at []byte) {
+	entries, release := i.entries()
+	defer release()
+
+	pos := search(entries, at)
+	if i.opts.Reverse {
+		if pos < len(entries) && bytes.Equal(entries[pos].Key, at) {
+			i.at(entries, pos)
+			return
+		}
+		i.at(entries, pos-1)
+		return
+	}
+	i.at(entries, pos)
+}
+
+func (i *iterator) Valid() bool {
+	return i.current != nil
+}
+
+func (i *iterator) ValidForPrefix(prefix []byte) bool {
+	return i.current != nil && bytes.HasPrefix(i.current.Key, prefix)
+}
+
+func (i *iterator) Next() {
+	if i.current == nil {
+		return
+	}
+
+	entries, release := i.entries()
+	defer release()
+
+	pos := search(entries, i.current.Key)
+	if i.opts.Reverse {
+		i.at(entries, pos-1)
+		return
+	}
+
+	if pos < len(entries) && bytes.Equal(entries[pos].Key, i.current.Key) {
+		pos++
+	}
+	i.at(entries, pos)
+}
+
+func (i *iterator) Item() *storage.Entry {
+	if i.current == nil {
+		return nil
+	}
+
+	return &storage.Entry{
+		Key:   sgutils.CopyBytes(i.current.Key),
+		Value: sgutils.CopyBytes(i.current.Value),
+	}
+}
+
+func (i *iterator) Err() error {
+	return nil
+}
+
+func (i *iterator) Close() error {
+	i.current = nil
+	i.snapshot = nil
+	return nil
+}
+
+var _ storage.Iterator = (*iterator)(nil)
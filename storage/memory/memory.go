@@ -0,0 +1,256 @@
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/scommons"
+)
+
+var (
+	ErrNoMergeOperator = errors.New("ErrNoMergeOperator")
+	ErrKeyNotFound     = errors.New("ErrKeyNotFound")
+)
+
+// Storage is an ordered in-memory key/value store.
+// Nothing is persisted: all the data is lost once the process exits.
+type Storage struct {
+	mu      sync.RWMutex
+	entries []*storage.Entry // sorted by key
+	scommons.StorageCommons
+	operators map[string]*storage.MergeOperator
+}
+
+func NewStorage(operators ...*storage.MergeOperator) (*Storage, error) {
+	s := &Storage{
+		operators: make(map[string]*storage.MergeOperator),
+	}
+
+	s.StorageCommons = scommons.StorageCommons{Storage: s}
+
+	for _, operator := range operators {
+		s.operators[string(operator.Key)] = operator
+	}
+
+	return s, nil
+}
+
+func (s *Storage) search(key []byte) int {
+	return search(s.entries, key)
+}
+
+func (s *Storage) get(key []byte) []byte {
+	i := s.search(key)
+	if i < len(s.entries) && bytes.Equal(s.entries[i].Key, key) {
+		return s.entries[i].Value
+	}
+
+	return nil
+}
+
+func (s *Storage) set(key, val []byte) {
+	e := &storage.Entry{
+		Key:   sgutils.CopyBytes(key),
+		Value: sgutils.CopyBytes(val),
+	}
+
+	i := s.search(key)
+	if i < len(s.entries) && bytes.Equal(s.entries[i].Key, key) {
+		s.entries[i] = e
+		return
+	}
+
+	s.entries = append(s.entries, nil)
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = e
+}
+
+func (s *Storage) del(key []byte) {
+	i := s.search(key)
+	if i < len(s.entries) && bytes.Equal(s.entries[i].Key, key) {
+		copy(s.entries[i:], s.entries[i+1:])
+		s.entries[len(s.entries)-1] = nil
+		s.entries = s.entries[:len(s.entries)-1]
+	}
+}
+
+func (s *Storage) merge(key, operation []byte) error {
+	operator, ok := s.operators[string(key)]
+	if !ok {
+		return ErrNoMergeOperator
+	}
+
+	newValue, ok := operator.MergeFunc(s.get(key), operation)
+	if !ok {
+		return nil
+	}
+
+	s.set(key, newValue)
+	return nil
+}
+
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	val := s.get(key)
+	if val == nil {
+		return nil, nil
+	}
+
+	return sgutils.CopyBytes(val), nil
+}
+
+func (s *Storage) Put(key, val []byte) error {
+	return s.BatchPut([]*storage.Entry{{Key: key, Value: val}})
+}
+
+func (s *Storage) BatchPut(entries []*storage.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range entries {
+		s.set(e.Key, e.Value)
+	}
+
+	return nil
+}
+
+func (s *Storage) Write(batch *storage.WriteBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			s.del(op.Key)
+		} else {
+			s.set(op.Key, op.Value)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) Merge(key, operation []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.merge(key, operation)
+}
+
+func (s *Storage) ProcessMergedKey(key []byte, fn func(val []byte) ([]*storage.Entry, []byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val := s.get(key)
+	if val == nil {
+		return ErrKeyNotFound
+	}
+
+	entries, operation, err := fn(sgutils.CopyBytes(val))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		s.set(e.Key, e.Value)
+	}
+
+	return s.merge(key, operation)
+}
+
+func (s *Storage) Iter(opts *storage.IterOptions) storage.Iterator {
+	it := &iterator{s: s, opts: opts}
+	if opts.Snapshot {
+		// entries are never modified in place, copying the slice is enough
+		s.mu.RLock()
+		it.snapshot = append(make([]*storage.Entry, 0, len(s.entries)), s.entries...)
+		s.mu.RUnlock()
+	}
+
+	return storage.NewBoundedIterator(it, opts)
+}
+
+// PrefixStats counts the entries under prefix, they are sorted so only those are visited
+func (s *Storage) PrefixStats(prefix []byte) (*storage.PrefixStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := &storage.PrefixStats{}
+	for i := s.search(prefix); i < len(s.entries) && bytes.HasPrefix(s.entries[i].Key, prefix); i++ {
+		stats.Keys++
+		stats.Bytes += uint64(len(s.entries[i].Key) + len(s.entries[i].Value))
+	}
+
+	return stats, nil
+}
+
+func (s *Storage) Truncate(prefix, min []byte, batchSize int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := s.search(min)
+	end := start
+	for end < len(s.entries) && bytes.HasPrefix(s.entries[end].Key, prefix) {
+		end++
+	}
+
+	if start == end {
+		return nil
+	}
+
+	n := copy(s.entries[start:], s.entries[end:])
+	for i := start + n; i < len(s.entries); i++ {
+		s.entries[i] = nil
+	}
+	s.entries = s.entries[:start+n]
+
+	return nil
+}
+
+func (s *Storage) Delete(key []byte) error {
+	return s.BatchDelete([][]byte{key})
+}
+
+func (s *Storage) BatchDelete(keys [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		s.del(key)
+	}
+
+	return nil
+}
+
+// Stats reports the size of the entries held in memory, nothing is on disk
+func (s *Storage) Stats() (*storage.Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var size int
+	for _, e := range s.entries {
+		size += len(e.Key) + len(e.Value)
+	}
+
+	return &storage.Stats{
+		Properties: map[string]string{
+			"memory.num-keys": strconv.Itoa(len(s.entries)),
+			"memory.bytes":    strconv.Itoa(size),
+		},
+	}, nil
+}
+
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = nil
+	return nil
+}
+
+var _ storage.Storage = (*Storage)(nil)
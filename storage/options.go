@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+var (
+	ErrInvalidOptions         = errors.New("ErrInvalidOptions")
+	ErrUnknownCompactionStyle = errors.New("ErrUnknownCompactionStyle")
+	ErrUnknownSyncMode        = errors.New("ErrUnknownSyncMode")
+)
+
+// Options tune the storage engines, zero values keep the defaults of each engine
+// and the options an engine does not support are ignored.
+type Options struct {
+	// BlockCacheSize and CompressedBlockCacheSize are the sizes in bytes of the RocksDB LRU caches,
+	// the storages of a process configured with the same sizes share their caches
+	BlockCacheSize           int64 `yaml:"block_cache_size,omitempty"`
+	CompressedBlockCacheSize int64 `yaml:"compressed_block_cache_size,omitempty"`
+
+	// BloomBitsPerKey of the RocksDB bloom filters
+	BloomBitsPerKey int `yaml:"bloom_bits_per_key,omitempty"`
+
+	// SyncMode set to NoSync skips the fsync of each write of Badger and Bolt, acknowledged writes may be
+	// lost on a crash. SyncWrites brings the fsync back when the defaults skip it.
+	// RocksDB never syncs its WAL on each write.
+	SyncMode sgproto.SyncMode `yaml:"sync_mode,omitempty"`
+
+	// ValueThreshold is the size in bytes from which Badger moves values to its value log
+	ValueThreshold int `yaml:"value_threshold,omitempty"`
+	// ValueLogFileSize is the maximum size in bytes of each file of the value log of Badger
+	ValueLogFileSize int64 `yaml:"value_log_file_size,omitempty"`
+
+	// CompactionStyle of RocksDB
+	CompactionStyle sgproto.CompactionStyle `yaml:"compaction_style,omitempty"`
+}
+
+// Override returns a copy of o with the fields set in other replacing its own
+func (o Options) Override(other Options) Options {
+	if other.BlockCacheSize > 0 {
+		o.BlockCacheSize = other.BlockCacheSize
+	}
+	if other.CompressedBlockCacheSize > 0 {
+		o.CompressedBlockCacheSize = other.CompressedBlockCacheSize
+	}
+	if other.BloomBitsPerKey > 0 {
+		o.BloomBitsPerKey = other.BloomBitsPerKey
+	}
+	if other.SyncMode != sgproto.SyncMode_DefaultSync {
+		o.SyncMode = other.SyncMode
+	}
+	if other.ValueThreshold > 0 {
+		o.ValueThreshold = other.ValueThreshold
+	}
+	if other.ValueLogFileSize > 0 {
+		o.ValueLogFileSize = other.ValueLogFileSize
+	}
+	if other.CompactionStyle != sgproto.CompactionStyle_DefaultCompaction {
+		o.CompactionStyle = other.CompactionStyle
+	}
+	return o
+}
+
+// OptionsFromProto converts the storage options of a topic config, opts may be nil
+func OptionsFromProto(opts *sgproto.StorageOptions) Options {
+	if opts == nil {
+		return Options{}
+	}
+
+	return Options{
+		BlockCacheSize:           opts.BlockCacheSize,
+		CompressedBlockCacheSize: opts.CompressedBlockCacheSize,
+		BloomBitsPerKey:          int(opts.BloomBitsPerKey),
+		SyncMode:                 opts.SyncMode,
+		ValueThreshold:           int(opts.ValueThreshold),
+		ValueLogFileSize:         opts.ValueLogFileSize,
+		CompactionStyle:          opts.CompactionStyle,
+	}
+}
+
+// Proto converts the options to be set in a topic config
+func (o Options) Proto() *sgproto.StorageOptions {
+	return &sgproto.StorageOptions{
+		BlockCacheSize:           o.BlockCacheSize,
+		CompressedBlockCacheSize: o.CompressedBlockCacheSize,
+		BloomBitsPerKey:          int32(o.BloomBitsPerKey),
+		SyncMode:                 o.SyncMode,
+		ValueThreshold:           int32(o.ValueThreshold),
+		ValueLogFileSize:         o.ValueLogFileSize,
+		CompactionStyle:          o.CompactionStyle,
+	}
+}
+
+// NoSync returns true when Badger and Bolt should not fsync each write
+func (o Options) NoSync() bool {
+	return o.SyncMode == sgproto.SyncMode_NoSync
+}
+
+// Validate checks that no option is negative and that the enums are known
+func (o Options) Validate() error {
+	if o.BlockCacheSize < 0 || o.CompressedBlockCacheSize < 0 || o.BloomBitsPerKey < 0 ||
+		o.ValueThreshold < 0 || o.ValueLogFileSize < 0 {
+		return ErrInvalidOptions
+	}
+
+	if _, ok := sgproto.CompactionStyle_name[int32(o.CompactionStyle)]; !ok {
+		return ErrUnknownCompactionStyle
+	}
+
+	if _, ok := sgproto.SyncMode_name[int32(o.SyncMode)]; !ok {
+		return ErrUnknownSyncMode
+	}
+
+	return nil
+}
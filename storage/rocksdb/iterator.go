@@ -9,8 +9,10 @@ import (
 )
 
 type iterator struct {
-	iter *gorocksdb.Iterator
-	opts *storage.IterOptions
+	iter  *gorocksdb.Iterator
+	opts  *storage.IterOptions
+	ropts *gorocksdb.ReadOptions
+	upper []byte
 }
 
 func (i *iterator) Rewind() {
@@ -61,8 +63,13 @@ func (i *iterator) Item() *storage.Entry {
 	}
 }
 
+func (i *iterator) Err() error {
+	return i.iter.Err()
+}
+
 func (i *iterator) Close() error {
 	i.iter.Close()
+	i.ropts.Destroy()
 	return nil
 }
 
@@ -4,21 +4,43 @@ package rocksdb
 
 import (
 	"C"
+	"fmt"
+	"sync"
 
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
 	"github.com/sandglass/sandglass/sgutils"
 	"github.com/sandglass/sandglass/storage"
 	"github.com/sandglass/sandglass/storage/scommons"
 	"github.com/tecbot/gorocksdb"
 )
 
-var bbto *gorocksdb.BlockBasedTableOptions
+const (
+	DefaultBlockCacheSize  = 3 << 30
+	DefaultBloomBitsPerKey = 10
+)
+
+var (
+	cachesMu sync.Mutex
+	caches   = map[int64]*gorocksdb.Cache{}
+)
+
+// sharedCache returns the LRU cache of the given size, created once per process
+func sharedCache(size int64) *gorocksdb.Cache {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+
+	cache, ok := caches[size]
+	if !ok {
+		cache = gorocksdb.NewLRUCache(int(size))
+		caches[size] = cache
+	}
+	return cache
+}
 
-func init() {
-	bbto = gorocksdb.NewDefaultBlockBasedTableOptions()
-	bbto.SetBlockCache(gorocksdb.NewLRUCache(3 << 30))
-	bbto.SetBlockCacheCompressed(gorocksdb.NewLRUCache(3 << 30))
-	filter := gorocksdb.NewBloomFilter(10)
-	bbto.SetFilterPolicy(filter)
+var compactionStyles = map[sgproto.CompactionStyle]gorocksdb.CompactionStyle{
+	sgproto.CompactionStyle_LevelCompaction:     gorocksdb.LevelCompactionStyle,
+	sgproto.CompactionStyle_UniversalCompaction: gorocksdb.UniversalCompactionStyle,
+	sgproto.CompactionStyle_FIFOCompaction:      gorocksdb.FIFOCompactionStyle,
 }
 
 type Store struct {
@@ -26,10 +48,31 @@ type Store struct {
 	scommons.StorageCommons
 }
 
-func NewStorage(path string, operators ...*storage.MergeOperator) (*Store, error) {
+func NewStorage(path string, options storage.Options, operators ...*storage.MergeOperator) (*Store, error) {
+	cacheSize := int64(DefaultBlockCacheSize)
+	if options.BlockCacheSize > 0 {
+		cacheSize = options.BlockCacheSize
+	}
+	compressedCacheSize := int64(DefaultBlockCacheSize)
+	if options.CompressedBlockCacheSize > 0 {
+		compressedCacheSize = options.CompressedBlockCacheSize
+	}
+	bloomBits := DefaultBloomBitsPerKey
+	if options.BloomBitsPerKey > 0 {
+		bloomBits = options.BloomBitsPerKey
+	}
+
+	bbto := gorocksdb.NewDefaultBlockBasedTableOptions()
+	bbto.SetBlockCache(sharedCache(cacheSize))
+	bbto.SetBlockCacheCompressed(sharedCache(compressedCacheSize))
+	bbto.SetFilterPolicy(gorocksdb.NewBloomFilter(bloomBits))
+
 	opts := gorocksdb.NewDefaultOptions()
 	opts.SetCreateIfMissing(true)
 	opts.SetBlockBasedTableFactory(bbto)
+	if style, ok := compactionStyles[options.CompactionStyle]; ok {
+		opts.SetCompactionStyle(style)
+	}
 	for _, operator := range operators {
 		opts.SetMergeOperator(mergeOperator{op: operator, name: string(operator.Key)})
 	}
@@ -41,7 +84,7 @@ func NewStorage(path string, operators ...*storage.MergeOperator) (*Store, error
 	s := &Store{
 		db: db,
 	}
-	s.StorageCommons = scommons.StorageCommons{s}
+	s.StorageCommons = scommons.StorageCommons{Storage: s}
 	return s, nil
 }
 
@@ -80,6 +123,23 @@ func (s *Store) BatchPut(entries []*storage.Entry) error {
 	return s.db.Write(wopts, batch)
 }
 
+func (s *Store) Write(b *storage.WriteBatch) error {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for _, op := range b.Ops() {
+		if op.Delete {
+			batch.Delete(op.Key)
+		} else {
+			batch.Put(op.Key, op.Value)
+		}
+	}
+
+	wopts := gorocksdb.NewDefaultWriteOptions()
+	defer wopts.Destroy()
+
+	return s.db.Write(wopts, batch)
+}
+
 func (s *Store) Merge(key, operation []byte) error {
 	wopts := gorocksdb.NewDefaultWriteOptions()
 	defer wopts.Destroy()
@@ -109,12 +169,48 @@ func (s *Store) ProcessMergedKey(key []byte, fn func(val []byte) ([]*storage.Ent
 	return s.db.Write(wopts, batch)
 }
 
+// Iter always reads from a snapshot since rocksdb iterators are consistent views of the database
 func (s *Store) Iter(opts *storage.IterOptions) storage.Iterator {
 	ropts := gorocksdb.NewDefaultReadOptions()
+
+	// rocksdb keeps a reference to the bound, it must outlive the iterator
+	_, upper := opts.Bounds()
+	if upper != nil && !opts.Reverse {
+		ropts.SetIterateUpperBound(upper)
+	}
+
+	it := &iterator{
+		iter:  s.db.NewIterator(ropts),
+		opts:  opts,
+		ropts: ropts,
+		upper: upper,
+	}
+	return storage.NewBoundedIterator(it, opts)
+}
+
+// PrefixStats iterates over the entries under prefix, only the sizes of the values are read
+func (s *Store) PrefixStats(prefix []byte) (*storage.PrefixStats, error) {
+	ropts := gorocksdb.NewDefaultReadOptions()
 	defer ropts.Destroy()
+	ropts.SetFillCache(false)
+
 	it := s.db.NewIterator(ropts)
+	defer it.Close()
+
+	stats := &storage.PrefixStats{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		k, v := it.Key(), it.Value()
+		stats.Keys++
+		stats.Bytes += uint64(k.Size() + v.Size())
+		k.Free()
+		v.Free()
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
 
-	return &iterator{iter: it, opts: opts}
+	return stats, nil
 }
 
 func (s *Store) Truncate(prefix, min []byte, batchSize int) error {
@@ -185,6 +281,39 @@ func (s *Store) BatchDelete(keys [][]byte) error {
 	return s.db.Write(wopts, batch)
 }
 
+// number of levels of the LSM tree with the default options
+const numLevels = 7
+
+var statsProperties = []string{
+	"rocksdb.estimate-num-keys",
+	"rocksdb.estimate-live-data-size",
+	"rocksdb.total-sst-files-size",
+	"rocksdb.cur-size-all-mem-tables",
+}
+
+// Stats reports the size of the database directory, which includes the WAL of rocksdb and the
+// obsolete files not yet deleted, along with rocksdb's own estimates
+func (s *Store) Stats() (*storage.Stats, error) {
+	size, err := storage.DirSize(s.db.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	props := map[string]string{}
+	for _, name := range statsProperties {
+		props[name] = s.db.GetProperty(name)
+	}
+	for level := 0; level < numLevels; level++ {
+		name := fmt.Sprintf("rocksdb.num-files-at-level%d", level)
+		props[name] = s.db.GetProperty(name)
+	}
+
+	return &storage.Stats{
+		DiskBytes:  size,
+		Properties: props,
+	}, nil
+}
+
 func (s *Store) Close() error {
 	s.db.Close()
 	return nil
@@ -3,6 +3,8 @@ package scommons
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"math"
 
 	"github.com/gogo/protobuf/proto"
 
@@ -14,8 +16,16 @@ var (
 	PendingPrefix = []byte{1, 'p'}
 	ViewPrefix    = []byte{1, 'v'}
 	WalPrefix     = []byte{1, 'w'}
+	BloomPrefix   = []byte{1, 'b'}
+	// ProducerPrefix holds the state of the idempotent producers
+	ProducerPrefix = []byte{1, 'i'}
+	// ExpiringPrefix marks the partitions holding messages with an expiry
+	ExpiringPrefix = []byte{1, 'e'}
 )
 
+// number of entries written at once by Restore
+const restoreBatchSize = 1000
+
 type StorageCommons struct {
 	storage.Storage
 }
@@ -24,16 +34,12 @@ func (s *StorageCommons) LastKeyForPrefix(prefix []byte) []byte {
 	it := s.Iter(&storage.IterOptions{
 		Reverse:     true,
 		FetchValues: false,
+		Prefix:      prefix,
 	})
 	defer it.Close()
 
-	if len(prefix) == 0 {
-		it.Rewind()
-	} else {
-		it.Seek(append(prefix, 0xFF, 0xFF, 0xFF))
-	}
-
-	if !it.ValidForPrefix(prefix) {
+	it.Rewind()
+	if !it.Valid() {
 		return nil
 	}
 
@@ -44,17 +50,11 @@ func (s *StorageCommons) LastKVForPrefix(prefix, suffix []byte) []byte {
 	it := s.Iter(&storage.IterOptions{
 		Reverse:     true,
 		FetchValues: true,
+		Prefix:      prefix,
 	})
 	defer it.Close()
 
-	// FIXME: use maxid instead of '~'
-	if len(prefix) == 0 {
-		it.Rewind()
-	} else {
-		it.Seek(append(prefix, bytes.Repeat([]byte{0xFF}, 3)...))
-	}
-
-	for ; it.ValidForPrefix(prefix); it.Next() {
+	for it.Rewind(); it.Valid(); it.Next() {
 		if suffix == nil || bytes.HasSuffix(it.Item().Key, suffix) {
 			return it.Item().Value
 		}
@@ -67,49 +67,67 @@ func (s *StorageCommons) ForEach(prefix []byte, fn func(msg *sgproto.Message) er
 	return s.ForRange(prefix, sgproto.Nil, sgproto.MaxOffset, fn)
 }
 
+// ForRange iterates over the messages stored by offset under prefix, from min to max inclusive
 func (s *StorageCommons) ForRange(prefix []byte, min, max sgproto.Offset, fn func(msg *sgproto.Message) error) error {
-	it := NewMessageIterator(prefix, s, &storage.IterOptions{
+	opts := &storage.IterOptions{
 		Reverse:     false,
 		FetchValues: true,
-	})
-	defer it.Close()
-
-	var m *sgproto.Message
-	if min == sgproto.Nil {
-		m = it.Rewind()
-	} else {
-		m = it.Seek(min)
+	}
+	if min != sgproto.Nil {
+		opts.LowerBound = Join(prefix, min[:])
+	}
+	if max != sgproto.MaxOffset {
+		opts.UpperBound = storage.Successor(Join(prefix, max[:]))
 	}
 
-	for ; it.Valid(); m = it.Next() {
-		if m.Offset.After(max) {
-			break
-		}
+	it := NewMessageIterator(prefix, s, opts)
+	defer it.Close()
 
+	for m := it.Rewind(); it.Valid(); m = it.Next() {
 		if err := fn(m); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return it.Err()
 }
 
+// ForEachWALEntry iterates over the WAL entries under prefix after min, min itself is skipped
+// since it is already in the replica
 func (s *StorageCommons) ForEachWALEntry(prefix []byte, min []byte, fn func(msg *sgproto.Message) error) error {
-	it := s.Iter(&storage.IterOptions{
+	opts := &storage.IterOptions{
 		FetchValues: true,
-	})
-	defer it.Close()
+		Prefix:      Join(prefix, nil),
+	}
+	if len(min) > 0 {
+		opts.LowerBound = storage.Successor(min)
+	}
 
-	if len(min) == 0 {
-		it.Seek(prefix)
-	} else {
-		it.Seek(min)
-		if it.ValidForPrefix(prefix) && bytes.Compare(min, it.Item().Key) == 0 { // skipping first since it is already in the replica
-			it.Next()
-		}
+	return s.forEachWALEntry(opts, fn)
+}
+
+// ForRangeWAL iterates over the WAL entries under prefix whose index is in the range (min, max],
+// max bounds the range when min is 0 as well
+func (s *StorageCommons) ForRangeWAL(prefix []byte, min, max uint64, fn func(msg *sgproto.Message) error) error {
+	opts := &storage.IterOptions{
+		FetchValues: true,
+		Prefix:      Join(prefix, nil),
+	}
+	if min > 0 {
+		opts.LowerBound = storage.Successor(walKey(prefix, min))
+	}
+	if max < math.MaxUint64 {
+		opts.UpperBound = storage.Successor(walKey(prefix, max))
 	}
 
-	for ; it.ValidForPrefix(prefix); it.Next() {
+	return s.forEachWALEntry(opts, fn)
+}
+
+func (s *StorageCommons) forEachWALEntry(opts *storage.IterOptions, fn func(msg *sgproto.Message) error) error {
+	it := s.Iter(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
 		value := it.Item().Value
 
 		var msg sgproto.Message
@@ -122,49 +140,71 @@ func (s *StorageCommons) ForEachWALEntry(prefix []byte, min []byte, fn func(msg
 		}
 	}
 
-	return nil
+	return it.Err()
 }
 
-func (s *StorageCommons) ForRangeWAL(prefix []byte, min, max uint64, fn func(msg *sgproto.Message) error) error {
-	it := s.Iter(&storage.IterOptions{
-		FetchValues: true,
-	})
+// Backup writes the entries selected by opts to w from a snapshot of the storage
+func (s *StorageCommons) Backup(w io.Writer, opts *storage.IterOptions) error {
+	o := *opts
+	o.FetchValues = true
+	o.Snapshot = true
+
+	it := s.Iter(&o)
 	defer it.Close()
 
-	var (
-		minKey, maxKey []byte
-	)
-	if min == 0 {
-		it.Seek(prefix)
-	} else {
-		minKey, maxKey = make([]byte, 8), make([]byte, 8)
-		binary.BigEndian.PutUint64(minKey[:], min)
-		binary.BigEndian.PutUint64(maxKey[:], max)
-		minKey = Join(prefix, minKey)
-		maxKey = Join(prefix, maxKey)
-		it.Seek(minKey)
-		if it.ValidForPrefix(prefix) && bytes.Compare(minKey, it.Item().Key) == 0 { // skipping first since it is already in the replica
-			it.Next()
+	bw := storage.NewBackupWriter(w)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if err := bw.Write(item.Key, item.Value); err != nil {
+			return err
 		}
 	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
 
-	for ; it.ValidForPrefix(prefix); it.Next() {
-		if maxKey != nil && bytes.Compare(it.Item().Key, maxKey) > 0 {
+// Restore writes the entries of a backup by batches. check is called with each key before it is written,
+// an error stops the restore and the batches already written are kept.
+func (s *StorageCommons) Restore(r io.Reader, check func(key []byte) error) error {
+	br := storage.NewBackupReader(r)
+	batch := storage.NewWriteBatch()
+	for {
+		key, val, err := br.Read()
+		if err == io.EOF {
 			break
+		} else if err != nil {
+			return err
 		}
 
-		value := it.Item().Value
-		var msg sgproto.Message
-		if err := proto.Unmarshal(value, &msg); err != nil {
-			return err
+		if check != nil {
+			if err := check(key); err != nil {
+				return err
+			}
 		}
 
-		if err := fn(&msg); err != nil {
-			return err
+		batch.Put(key, val)
+		if batch.Len() >= restoreBatchSize {
+			if err := s.Write(batch); err != nil {
+				return err
+			}
+			batch.Reset()
 		}
 	}
 
-	return nil
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return s.Write(batch)
+}
+
+func walKey(prefix []byte, index uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, index)
+	return Join(prefix, b)
 }
 
 func Join(keys ...[]byte) []byte {
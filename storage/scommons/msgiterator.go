@@ -12,18 +12,20 @@ type messageIter struct {
 	opts   *storage.IterOptions
 }
 
+// NewMessageIterator iterates over the messages stored under prefix,
+// the prefix is added to opts when they do not restrict the iteration to one already
 func NewMessageIterator(prefix []byte, s storage.Storage, opts *storage.IterOptions) storage.MessageIterator {
+	if opts.Prefix == nil {
+		o := *opts
+		o.Prefix = Join(prefix, nil)
+		opts = &o
+	}
+
 	return &messageIter{prefix, s.Iter(opts), opts}
 }
 
 func (i *messageIter) Rewind() *sgproto.Message {
 	i.iter.Rewind()
-	if !i.opts.Reverse {
-		i.iter.Seek(i.prefix)
-	} else {
-		i.iter.Seek(Join(i.prefix, []byte{'~', '~'}))
-	}
-
 	if i.Valid() {
 		return i.getCurrent()
 	}
@@ -41,7 +43,7 @@ func (i *messageIter) Seek(id sgproto.Offset) *sgproto.Message {
 }
 
 func (i *messageIter) Valid() bool {
-	return i.iter.ValidForPrefix(i.prefix)
+	return i.iter.Valid()
 }
 
 func (i *messageIter) ValidForPrefix(prefix []byte) bool {
@@ -68,6 +70,10 @@ func (i *messageIter) getCurrent() *sgproto.Message {
 	return &msg
 }
 
+func (i *messageIter) Err() error {
+	return i.iter.Err()
+}
+
 func (i *messageIter) Close() error {
 	return i.iter.Close()
 }
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Stats are approximate statistics about a storage
+type Stats struct {
+	// DiskBytes is the space used on disk, 0 for in-memory storages
+	DiskBytes int64
+	// Properties holds the statistics specific to the storage engine, such as the LSM levels
+	Properties map[string]string
+}
+
+// PrefixStats counts the keys under a prefix, drivers compute them without copying the values
+type PrefixStats struct {
+	Keys  uint64
+	Bytes uint64 // size of the keys and their values, as estimated by the driver
+}
+
+// DirSize returns the total size of the files under path
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"io"
+
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
 )
 
@@ -10,6 +12,7 @@ type Storage interface {
 	Get(key []byte) ([]byte, error)
 	Put(key, val []byte) error
 	BatchPut(entries []*Entry) error
+	Write(batch *WriteBatch) error
 	Merge(key, operation []byte) error
 	ProcessMergedKey(key []byte, fn func(val []byte) ([]*Entry, []byte, error)) error
 	Iter(*IterOptions) Iterator
@@ -17,6 +20,10 @@ type Storage interface {
 	BatchDelete(keys [][]byte) error
 	Delete(key []byte) error
 	Close() error
+	Stats() (*Stats, error)
+	PrefixStats(prefix []byte) (*PrefixStats, error)
+	Backup(w io.Writer, opts *IterOptions) error
+	Restore(r io.Reader, check func(key []byte) error) error
 	LastKeyForPrefix(prefix []byte) []byte
 	LastKVForPrefix(prefix, suffix []byte) []byte
 	ForEach(prefix []byte, fn func(msg *sgproto.Message) error) error
@@ -34,6 +41,17 @@ type IterOptions struct {
 	Reverse     bool
 	FetchValues bool
 	FillCache   bool
+
+	// Prefix restricts the iteration to the keys starting with it
+	Prefix []byte
+	// LowerBound is the smallest key returned by the iterator, inclusive
+	LowerBound []byte
+	// UpperBound is the first key not returned by the iterator, exclusive
+	UpperBound []byte
+
+	// Snapshot makes the iterator read the storage as it was when it was created,
+	// writes made during the iteration are not seen
+	Snapshot bool
 }
 
 type MergeOperator struct {
@@ -0,0 +1,100 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/sandglass/sandglass/storage"
+)
+
+var ErrPartitionNotEmpty = errors.New("ErrPartitionNotEmpty")
+
+// Backup writes the WAL entries of the partition up to hwMark to w, from a snapshot of the storage,
+// followed by the state of the idempotent producers whose last batch is part of the backup.
+// The view is not part of the backup, it is rebuilt from the WAL once restored.
+//
+// RocksDB checkpoints and badger backups are not used: they copy a whole storage, which is shared by
+// the partitions of a topic, up to its last write and in the format of its driver. A backup stops at
+// the HW mark of the partition and can be restored on replicas using another driver.
+func (p *Partition) Backup(w io.Writer, hwMark uint64) error {
+	err := p.db.Backup(w, &storage.IterOptions{
+		Prefix:     p.prependPrefixWAL(nil),
+		UpperBound: storage.Successor(p.genWALKey(hwMark)),
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.backupProducers(w, hwMark)
+}
+
+// backupProducers writes the persisted state of the producers whose last batch is below hwMark, the
+// state of the others is rebuilt from the messages of the backup once restored
+func (p *Partition) backupProducers(w io.Writer, hwMark uint64) error {
+	it := p.db.Iter(&storage.IterOptions{
+		FetchValues: true,
+		Prefix:      p.producerKey(""),
+	})
+	defer it.Close()
+
+	bw := storage.NewBackupWriter(w)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		st, err := unmarshalProducerState(item.Value)
+		if err != nil {
+			return err
+		}
+
+		if n := len(st.indexes); n > 0 && st.indexes[n-1] > hwMark {
+			continue
+		}
+
+		if err := bw.Write(item.Key, item.Value); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Restore writes the WAL entries and the producer states of a backup of the partition taken up to hwMark,
+// the partition should be empty. Produced messages wait for the restore to be done and are indexed after hwMark.
+// The view of the restored messages is built once the HW mark of the partition moves past them.
+func (p *Partition) Restore(r io.Reader, hwMark uint64) error {
+	// the pending loop holds the lock while it appends to the WAL
+	p.producers.mu.Lock()
+	defer p.producers.mu.Unlock()
+
+	if p.lastIndex > 0 {
+		return ErrPartitionNotEmpty
+	}
+
+	prefix := p.prependPrefixWAL(nil)
+	producers := p.producerKey("")
+	err := p.db.Restore(r, func(key []byte) error {
+		if bytes.HasPrefix(key, producers) {
+			return nil
+		}
+
+		if len(key) != len(prefix)+8 || !bytes.HasPrefix(key, prefix) {
+			return storage.ErrInvalidBackup
+		}
+
+		if binary.BigEndian.Uint64(key[len(prefix):]) > hwMark {
+			return storage.ErrInvalidBackup
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the last entries before the HW mark may have been pruned, their indexes are not reused
+	p.lastIndex = hwMark
+	return p.replayWAL()
+}
@@ -0,0 +1,159 @@
+package topic
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver sgproto.StorageDriver) {
+		newPartition := func() *Partition {
+			return newTestPartition(t, &Topic{
+				Name: "backup",
+				Kind: sgproto.TopicKind_KVKind,
+			}, driver)
+		}
+
+		src := newPartition()
+
+		for i := 0; i < 5; i++ {
+			err := src.PutMessage(&sgproto.Message{
+				Key:   []byte{byte('a' + i%2)},
+				Value: []byte{byte(i)},
+			})
+			require.Nil(t, err)
+		}
+		err := src.WalToView(0, 4)
+		require.Nil(t, err)
+
+		var buf bytes.Buffer
+		err = src.Backup(&buf, 4)
+		require.Nil(t, err)
+
+		dst := newPartition()
+
+		err = dst.Restore(bytes.NewReader(buf.Bytes()), 4)
+		require.Nil(t, err)
+		require.Equal(t, uint64(4), dst.lastIndex)
+
+		var indexes []uint64
+		err = dst.RangeFromWAL(nil, func(msg *sgproto.Message) error {
+			indexes = append(indexes, msg.Index)
+			return nil
+		})
+		require.Nil(t, err)
+		require.Equal(t, []uint64{1, 2, 3, 4}, indexes, "messages after the HW mark should not be backed up")
+
+		err = dst.WalToView(0, 4)
+		require.Nil(t, err)
+
+		msg, err := dst.GetMessage(DefaultChannel, sgproto.Nil, []byte("a"), nil)
+		require.Nil(t, err)
+		require.Equal(t, []byte{2}, msg.Value)
+
+		err = dst.Restore(bytes.NewReader(buf.Bytes()), 4)
+		require.Equal(t, ErrPartitionNotEmpty, err)
+
+		err = newPartition().Restore(bytes.NewReader(buf.Bytes()), 3)
+		require.Equal(t, storage.ErrInvalidBackup, err, "entries after the HW mark of the backup should be rejected")
+
+		other := &Partition{Id: "other", topic: dst.topic}
+		err = other.InitStore(mustNewStore(t, sgproto.StorageDriver_Memory, ""))
+		require.Nil(t, err)
+		defer other.Close()
+
+		err = other.Restore(bytes.NewReader(buf.Bytes()), 4)
+		require.Equal(t, storage.ErrInvalidBackup, err, "a partition should not restore the backup of another one")
+	})
+}
+
+func TestBackupProducers(t *testing.T) {
+	src := newTestPartition(t, &Topic{
+		Name: "backup",
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	produce := func(p *Partition, producerID string, sequence uint64) *sgproto.Message {
+		msg := &sgproto.Message{
+			ProducerId: producerID,
+			Sequence:   sequence,
+			Value:      []byte("value"),
+		}
+		err := p.PutMessage(msg)
+		require.Nil(t, err)
+		return msg
+	}
+
+	pruned := produce(src, "pruned", 1)
+	backedUp := produce(src, "backed up", 1)
+	produce(src, "after", 1)
+
+	// the last batch of a producer may be gone from the WAL, its state is still needed
+	err := src.db.Delete(src.genWALKey(pruned.Index))
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = src.Backup(&buf, backedUp.Index)
+	require.Nil(t, err)
+
+	dst := newTestPartition(t, src.topic, sgproto.StorageDriver_Memory)
+	err = dst.Restore(bytes.NewReader(buf.Bytes()), backedUp.Index)
+	require.Nil(t, err)
+
+	resent := produce(dst, "pruned", 1)
+	require.Equal(t, pruned.Offset, resent.Offset, "the state of the producers should be restored")
+
+	resent = produce(dst, "backed up", 1)
+	require.Equal(t, backedUp.Offset, resent.Offset)
+
+	after := produce(dst, "after", 1)
+	require.Equal(t, backedUp.Index+1, after.Index, "the batches after the HW mark are not part of the backup")
+}
+
+func TestRestoreWhileProducing(t *testing.T) {
+	src := newTestPartition(t, &Topic{
+		Name: "backup",
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	for i := 0; i < 3; i++ {
+		err := src.PutMessage(&sgproto.Message{Value: []byte("value")})
+		require.Nil(t, err)
+	}
+
+	var buf bytes.Buffer
+	err := src.Backup(&buf, 3)
+	require.Nil(t, err)
+
+	dst := newTestPartition(t, src.topic, sgproto.StorageDriver_Memory)
+
+	pr, pw := io.Pipe()
+	restored := make(chan error, 1)
+	go func() {
+		restored <- dst.Restore(pr, 5)
+	}()
+
+	// the restore is running once it reads the first byte
+	data := buf.Bytes()
+	_, err = pw.Write(data[:1])
+	require.Nil(t, err)
+
+	msg := &sgproto.Message{Value: []byte("produced")}
+	produced := make(chan error, 1)
+	go func() {
+		produced <- dst.PutMessage(msg)
+	}()
+
+	_, err = pw.Write(data[1:])
+	require.Nil(t, err)
+	require.Nil(t, pw.Close())
+
+	require.Nil(t, <-restored)
+	require.Nil(t, <-produced)
+	require.Equal(t, uint64(6), msg.Index, "messages produced during a restore should be indexed after its HW mark")
+}
@@ -0,0 +1,238 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/scommons"
+	"github.com/willf/bloom"
+)
+
+const (
+	// DefaultBloomFalsePositiveRate is used by topics that do not set one
+	DefaultBloomFalsePositiveRate = 0.01
+
+	// smallest number of keys a filter is sized for
+	minFilterCapacity = 1e3
+
+	// size of the header persisted before the filter: index, capacity and count
+	filterHeaderSize = 3 * 8
+)
+
+// BloomSyncInterval is the interval between two saves of the bloom filter of a partition.
+// Keys added since the last save are recovered from the WAL on startup.
+var BloomSyncInterval = 10 * time.Second
+
+// keyFilter tells whether a key of a KV partition might exist in the view
+type keyFilter struct {
+	mu       sync.RWMutex
+	bf       *bloom.BloomFilter
+	capacity uint64 // number of keys the filter was sized for
+	count    uint64 // number of keys added
+	index    uint64 // greatest index of the messages added
+	dirty    bool
+}
+
+func (t *Topic) bloomFalsePositiveRate() float64 {
+	if t.BloomFalsePositiveRate > 0 {
+		return t.BloomFalsePositiveRate
+	}
+	return DefaultBloomFalsePositiveRate
+}
+
+func (p *Partition) filterKey() []byte {
+	return scommons.Join(scommons.BloomPrefix, []byte(p.topic.Name), []byte(p.Id))
+}
+
+// filterKeys returns the keys tested by HasKey for msg: the key alone and,
+// when set, the key with its clustering key
+func (p *Partition) filterKeys(msg *sgproto.Message) [][]byte {
+	keys := [][]byte{p.prependPrefixView(msg.Channel, msg.Key)}
+	if len(msg.ClusteringKey) > 0 {
+		keys = append(keys, p.getStorageKey(msg))
+	}
+	return keys
+}
+
+// initFilter loads the persisted bloom filter and adds the keys written in the WAL since it was saved,
+// the filter is rebuilt from the view when none was persisted
+func (p *Partition) initFilter() error {
+	val, err := p.db.Get(p.filterKey())
+	if err != nil {
+		return err
+	}
+
+	f := &p.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(val) <= filterHeaderSize {
+		return p.rebuildFilter()
+	}
+
+	bf := &bloom.BloomFilter{}
+	if _, err := bf.ReadFrom(bytes.NewReader(val[filterHeaderSize:])); err != nil {
+		p.logger.WithError(err).Debugf("unable to read bloom filter, rebuilding it")
+		return p.rebuildFilter()
+	}
+
+	f.bf = bf
+	f.index = binary.BigEndian.Uint64(val[0:8])
+	f.capacity = binary.BigEndian.Uint64(val[8:16])
+	f.count = binary.BigEndian.Uint64(val[16:24])
+	f.dirty = false
+
+	err = p.rangeFromWAL(p.genWALKey(f.index), func(msg *sgproto.Message) error {
+		p.addToFilter(msg)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if f.count > f.capacity {
+		return p.rebuildFilter()
+	}
+
+	return nil
+}
+
+// rebuildFilter creates a filter sized from the number of entries in the view, f.mu should be held
+func (p *Partition) rebuildFilter() error {
+	prefix := p.prependPrefixView("")
+
+	var n uint64
+	it := p.db.Iter(&storage.IterOptions{
+		Prefix: prefix,
+	})
+	for it.Rewind(); it.Valid(); it.Next() {
+		n++
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil {
+		return err
+	}
+
+	f := &p.filter
+	f.capacity = 2 * n
+	if f.capacity < minFilterCapacity {
+		f.capacity = minFilterCapacity
+	}
+	f.bf = bloom.NewWithEstimates(uint(f.capacity), p.topic.bloomFalsePositiveRate())
+	f.count = 0
+	f.dirty = true
+
+	it = p.db.Iter(&storage.IterOptions{
+		FetchValues: true,
+		Prefix:      prefix,
+	})
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		var msg sgproto.Message
+		if err := proto.Unmarshal(it.Item().Value, &msg); err != nil {
+			return err
+		}
+
+		p.addToFilter(&msg)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	p.logger.WithField("keys", f.count).Debugf("bloom filter rebuilt")
+	return nil
+}
+
+// addToFilter should be called with f.mu held
+func (p *Partition) addToFilter(msg *sgproto.Message) {
+	f := &p.filter
+	for _, key := range p.filterKeys(msg) {
+		if !f.bf.TestAndAdd(key) {
+			f.count++
+		}
+	}
+
+	if msg.Index > f.index {
+		f.index = msg.Index
+	}
+	f.dirty = true
+}
+
+// updateFilter adds the keys of msgs newly written in the view,
+// the filter is resized once it holds more keys than it was sized for
+func (p *Partition) updateFilter(msgs []*sgproto.Message) error {
+	f := &p.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, msg := range msgs {
+		p.addToFilter(msg)
+	}
+
+	if f.count > f.capacity {
+		return p.rebuildFilter()
+	}
+
+	return nil
+}
+
+func (p *Partition) testFilter(key []byte) bool {
+	f := &p.filter
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.bf.Test(key)
+}
+
+// syncFilter persists the filter when keys were added since the last save
+func (p *Partition) syncFilter() error {
+	f := &p.filter
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.bf == nil || !f.dirty {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	header := make([]byte, filterHeaderSize)
+	binary.BigEndian.PutUint64(header[0:8], f.index)
+	binary.BigEndian.PutUint64(header[8:16], f.capacity)
+	binary.BigEndian.PutUint64(header[16:24], f.count)
+	buf.Write(header)
+
+	if _, err := f.bf.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	if err := p.db.Put(p.filterKey(), buf.Bytes()); err != nil {
+		return err
+	}
+
+	f.dirty = false
+	return nil
+}
+
+func (p *Partition) filterSyncLoop() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case <-p.ctxPending.Done():
+				return
+			case <-time.After(BloomSyncInterval):
+				if err := p.syncFilter(); err != nil {
+					p.logger.WithError(err).Debugf("error while saving bloom filter")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,172 @@
+package topic
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+var (
+	ErrNotTimerTopic    = errors.New("ErrNotTimerTopic")
+	ErrMessageNotFound  = errors.New("ErrMessageNotFound")
+	ErrMessageDue       = errors.New("ErrMessageDue")
+	ErrInvalidConsumeAt = errors.New("ErrInvalidConsumeAt")
+)
+
+// inFlight is the index of a withdrawal whose tombstone is not stored yet, it is not pruned
+const inFlight = math.MaxUint64
+
+// withdrawals are the messages cancelled or rescheduled whose tombstone is not in the view yet,
+// they are known by the leader only until the HW mark covers their tombstone
+type withdrawals struct {
+	mu      sync.Mutex
+	pending map[sgproto.Offset]uint64
+}
+
+// prune forgets the withdrawals visible in the view, the lock should be held
+func (w *withdrawals) prune(hwMark uint64) {
+	for offset, index := range w.pending {
+		if index <= hwMark {
+			delete(w.pending, offset)
+		}
+	}
+}
+
+// withdrawn returns whether the message at offset is being withdrawn, it is not delivered
+// even though its tombstone is not in the view yet
+func (w *withdrawals) withdrawn(offset sgproto.Offset) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, ok := w.pending[offset]
+	return ok
+}
+
+// Cancel stores a tombstone replacing the delayed message at offset. The leader stops delivering it at once,
+// every replica once the HW mark reaches the returned index. Messages already due cannot be cancelled.
+func (p *Partition) Cancel(channel string, offset sgproto.Offset, now time.Time) (uint64, error) {
+	tombstone, _, err := p.withdraw(channel, offset, now, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+
+	return tombstone.Index, nil
+}
+
+// Reschedule moves the delayed message at offset to at, the returned message is its copy at the new
+// offset. It is stored along with a tombstone for the former offset, see Cancel. The new time should
+// be in the future.
+func (p *Partition) Reschedule(channel string, offset sgproto.Offset, at, now time.Time) (*sgproto.Message, error) {
+	if !at.After(now) {
+		return nil, ErrInvalidConsumeAt
+	}
+
+	_, moved, err := p.withdraw(channel, offset, now, at)
+	return moved, err
+}
+
+func (p *Partition) withdraw(channel string, offset sgproto.Offset, now, at time.Time) (tombstone, moved *sgproto.Message, err error) {
+	if p.topic.Kind != sgproto.TopicKind_TimerKind {
+		return nil, nil, ErrNotTimerTopic
+	}
+
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
+	if !offset.Time().After(now) {
+		return nil, nil, ErrMessageDue
+	}
+
+	// the offset is reserved so that the lock is not held while the tombstone is stored
+	p.withdrawals.mu.Lock()
+	if p.withdrawals.pending == nil {
+		p.withdrawals.pending = map[sgproto.Offset]uint64{}
+	}
+	p.withdrawals.prune(p.HWMark())
+
+	if _, ok := p.withdrawals.pending[offset]; ok {
+		p.withdrawals.mu.Unlock()
+		return nil, nil, ErrMessageNotFound
+	}
+	p.withdrawals.pending[offset] = inFlight
+	p.withdrawals.mu.Unlock()
+
+	defer func() {
+		p.withdrawals.mu.Lock()
+		if err != nil {
+			delete(p.withdrawals.pending, offset)
+		} else {
+			p.withdrawals.pending[offset] = tombstone.Index
+		}
+		p.withdrawals.mu.Unlock()
+	}()
+
+	msg, err := p.getDelayed(channel, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg == nil {
+		return nil, nil, ErrMessageNotFound
+	}
+
+	tombstone = &sgproto.Message{
+		Channel:    channel,
+		Offset:     offset,
+		ProducedAt: now,
+		Tombstone:  true,
+	}
+	msgs := []*sgproto.Message{tombstone}
+
+	if !at.IsZero() {
+		moved = msg
+		moved.Offset = sgproto.Nil
+		moved.ConsumeIn = at.Sub(moved.ProducedAt)
+		moved.ProducerId = ""
+		moved.Sequence = 0
+		if moved.Ttl > 0 { // the ttl starts from the new time
+			moved.ExpiresAt = time.Time{}
+		}
+		msgs = append(msgs, moved)
+	}
+
+	if err := <-p.queue(msgs); err != nil {
+		return nil, nil, err
+	}
+
+	return tombstone, moved, nil
+}
+
+// getDelayed returns the message at offset from the view, or from the WAL when the HW mark does not cover
+// it yet. Messages below the HW mark are only read from the view where their tombstone replaces them.
+func (p *Partition) getDelayed(channel string, offset sgproto.Offset) (*sgproto.Message, error) {
+	hwMark := p.HWMark()
+	msg, err := p.GetMessage(channel, offset, nil, nil)
+	if err != nil || msg != nil || offset.Index() <= hwMark {
+		return msg, err
+	}
+
+	val, err := p.db.Get(p.genWALKey(offset.Index()))
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	msg = &sgproto.Message{}
+	if err := proto.Unmarshal(val, msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Offset != offset || msg.Channel != channel || msg.Tombstone {
+		return nil, nil
+	}
+
+	if err := p.decompress(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,84 @@
+package topic
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancel(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	msgs := []*sgproto.Message{
+		{Value: []byte("due")},
+		{Value: []byte("cancelled"), ConsumeIn: time.Hour},
+		{Value: []byte("rescheduled"), ConsumeIn: time.Hour, Ttl: time.Minute},
+		{Value: []byte("kept"), ConsumeIn: time.Hour},
+	}
+	err := p.BatchPutMessages(msgs)
+	require.Nil(t, err)
+	err = p.WalToView(0, math.MaxUint64)
+	require.Nil(t, err)
+	p.SetHWMark(msgs[3].Index)
+
+	now := time.Now().UTC()
+	_, err = p.Cancel("", msgs[0].Offset, now)
+	require.Equal(t, ErrMessageDue, err)
+
+	index, err := p.Cancel("", msgs[1].Offset, now)
+	require.Nil(t, err)
+
+	_, err = p.Cancel("", msgs[1].Offset, now)
+	require.Equal(t, ErrMessageNotFound, err, "a pending cancellation should be known before it reaches the view")
+
+	var values []string
+	err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		values = append(values, string(msg.Value))
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"due", "rescheduled", "kept"}, values, "a pending cancellation should not be delivered")
+
+	_, err = p.Reschedule("", msgs[2].Offset, time.Time{}, now)
+	require.Equal(t, ErrInvalidConsumeAt, err)
+	_, err = p.Reschedule("", msgs[2].Offset, now.Add(-time.Minute), now)
+	require.Equal(t, ErrInvalidConsumeAt, err, "a message cannot be rescheduled in the past")
+
+	at := now.Add(2 * time.Hour).Truncate(time.Millisecond)
+	moved, err := p.Reschedule("", msgs[2].Offset, at, now)
+	require.Nil(t, err)
+	require.Equal(t, at, moved.Offset.Time())
+	require.Equal(t, at.Add(time.Minute), moved.ExpiresAt, "the ttl should start from the new time")
+	require.True(t, moved.Index > index)
+
+	err = p.WalToView(msgs[3].Index, math.MaxUint64)
+	require.Nil(t, err)
+	p.SetHWMark(moved.Index)
+
+	got, err := p.GetMessage("master", msgs[1].Offset, nil, nil)
+	require.Nil(t, err)
+	require.Nil(t, got, "cancelled message should not be found")
+
+	_, err = p.Cancel("", msgs[1].Offset, now)
+	require.Equal(t, ErrMessageNotFound, err)
+
+	values = nil
+	err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		values = append(values, string(msg.Value))
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"due", "kept", "rescheduled"}, values)
+
+	unreplicated := &sgproto.Message{Value: []byte("unreplicated"), ConsumeIn: time.Hour}
+	err = p.PutMessage(unreplicated)
+	require.Nil(t, err)
+
+	_, err = p.Cancel("", unreplicated.Offset, now)
+	require.Nil(t, err, "a message above the HW mark should be found in the WAL")
+}
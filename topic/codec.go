@@ -0,0 +1,72 @@
+package topic
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+)
+
+// marshal encodes msg as it is stored, with its value compressed by the codec of the topic.
+// msg itself is left untouched.
+func (p *Partition) marshal(msg *sgproto.Message) ([]byte, error) {
+	if len(msg.Value) == 0 {
+		return proto.Marshal(msg)
+	}
+
+	value, err := p.codec.Compress(msg.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := *msg
+	stored.Value = value
+	return proto.Marshal(&stored)
+}
+
+// decompress restores the value of a stored message
+func (p *Partition) decompress(msg *sgproto.Message) error {
+	if len(msg.Value) == 0 {
+		return nil
+	}
+
+	value, err := p.codec.Decompress(msg.Value)
+	if err != nil {
+		return err
+	}
+
+	msg.Value = value
+	return nil
+}
+
+// messageIterator decompresses the messages of the view,
+// like the underlying iterator it returns nil for messages that cannot be decoded
+type messageIterator struct {
+	storage.MessageIterator
+	p *Partition
+}
+
+func (i *messageIterator) decompress(msg *sgproto.Message) *sgproto.Message {
+	if msg == nil {
+		return nil
+	}
+
+	if err := i.p.decompress(msg); err != nil {
+		return nil
+	}
+
+	return msg
+}
+
+func (i *messageIterator) Rewind() *sgproto.Message {
+	return i.decompress(i.MessageIterator.Rewind())
+}
+
+func (i *messageIterator) Seek(id sgproto.Offset) *sgproto.Message {
+	return i.decompress(i.MessageIterator.Seek(id))
+}
+
+func (i *messageIterator) Next() *sgproto.Message {
+	return i.decompress(i.MessageIterator.Next())
+}
+
+var _ storage.MessageIterator = (*messageIterator)(nil)
@@ -0,0 +1,145 @@
+package topic
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/storage"
+)
+
+// number of scanned entries between two progress reports
+const compactionReportInterval = 1000
+
+var (
+	ErrCompactionNotSupported = errors.New("ErrCompactionNotSupported")
+
+	errStopCompaction = errors.New("errStopCompaction")
+)
+
+// Compact removes the outdated versions of the messages of a KV topic.
+//
+// The view already holds a single version per key and clustering key. When the topic
+// compacts by key, the view entries other than the last version of each key are
+// deleted as well. Then every WAL entry below the HW mark that is not the version held
+// by the view is deleted, the entry at the HW mark is always kept. Tombstones below
+// the HW mark are purged from both once their previous versions are gone.
+//
+// fn is called periodically with the progress of the compaction and a last time once done.
+func (p *Partition) Compact(fn func(progress *sgproto.CompactProgress) error) error {
+	if p.topic.Kind != sgproto.TopicKind_KVKind {
+		return ErrCompactionNotSupported
+	}
+
+	progress := &sgproto.CompactProgress{
+		Topic:     p.topic.Name,
+		Partition: p.Id,
+	}
+
+	var keys [][]byte
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		err := p.db.BatchDelete(keys)
+		keys = keys[:0]
+		return err
+	}
+
+	scanned := func() error {
+		progress.Scanned++
+		if progress.Scanned%compactionReportInterval != 0 {
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		return fn(progress)
+	}
+
+	if p.topic.CompactByKey {
+		if err := p.compactView(progress, &keys, scanned); err != nil {
+			return err
+		}
+
+		// the WAL pass relies on the view
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	hwMark := p.HWMark()
+	if hwMark > 0 {
+		err := p.rangeFromWAL(nil, func(msg *sgproto.Message) error {
+			if msg.Index >= hwMark {
+				return errStopCompaction
+			}
+
+			latest, err := p.db.Get(p.getStorageKey(msg))
+			if err != nil {
+				return err
+			}
+
+			outdated := latest == nil
+			if !outdated {
+				var viewMsg sgproto.Message
+				if err := proto.Unmarshal(latest, &viewMsg); err != nil {
+					return err
+				}
+				outdated = viewMsg.Index != msg.Index
+			}
+
+			switch {
+			case outdated:
+				keys = append(keys, p.newWALKey(msg))
+				progress.Deleted++
+			case msg.Tombstone: // every older version is gone, the deletion can be forgotten
+				keys = append(keys, p.newWALKey(msg), p.getStorageKey(msg))
+				progress.Deleted += 2
+			}
+
+			return scanned()
+		})
+		if err != nil && err != errStopCompaction {
+			return err
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	progress.Done = true
+	return fn(progress)
+}
+
+// compactView deletes the view entries of every key except its last version
+func (p *Partition) compactView(progress *sgproto.CompactProgress, keys *[][]byte, scanned func() error) error {
+	it := p.db.Iter(&storage.IterOptions{
+		FetchValues: true,
+		Prefix:      p.prependPrefixView(""),
+	})
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+
+		var msg sgproto.Message
+		if err := proto.Unmarshal(item.Value, &msg); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(p.lastVersion(msg.Channel, msg.Key), item.Key) {
+			*keys = append(*keys, sgutils.CopyBytes(item.Key))
+			progress.Deleted++
+		}
+
+		if err := scanned(); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
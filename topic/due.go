@@ -0,0 +1,281 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+)
+
+// duration of the buckets of the lowest level of the timing wheels and number of buckets per level
+const (
+	dueWheelTick = time.Millisecond
+	dueWheelSize = 64
+)
+
+var (
+	ErrPartitionClosed = errors.New("ErrPartitionClosed")
+
+	errDueFound = errors.New("errDueFound")
+)
+
+// dueMessages wakes up the consumers waiting for the messages of a timer partition as soon as they are due.
+// The messages stored in the future wait in a timing wheel, the due ones wait for the HW mark to reach them
+// since consumers only see the replicated messages. The future messages already in the view when the
+// partition is opened are added to the wheel by channel, the first time one of them is waited for.
+type dueMessages struct {
+	mu           sync.Mutex
+	wheel        *timingWheel
+	timer        *time.Timer
+	wakeup       time.Time
+	unreplicated []wheelEntry
+	waiters      map[*dueWaiter]struct{}
+	loaded       map[string]bool
+	closed       bool
+}
+
+type dueWaiter struct {
+	channel string
+	after   sgproto.Offset
+	ch      chan struct{}
+}
+
+func (d *dueMessages) init(now time.Time) {
+	d.wheel = newTimingWheel(dueWheelTick, dueWheelSize, now)
+	d.waiters = map[*dueWaiter]struct{}{}
+	d.loaded = map[string]bool{}
+}
+
+// loadDue tracks the messages of the WAL not applied to the view yet, they are at the end of the WAL
+func (p *Partition) loadDue() error {
+	if p.topic.Kind != sgproto.TopicKind_TimerKind {
+		return nil
+	}
+
+	it := p.db.Iter(&storage.IterOptions{
+		FetchValues: true,
+		Prefix:      p.prependPrefixWAL(nil),
+		Reverse:     true,
+	})
+	defer it.Close()
+
+	var msgs []*sgproto.Message
+	for it.Rewind(); it.Valid(); it.Next() {
+		var msg sgproto.Message
+		if err := proto.Unmarshal(it.Item().Value, &msg); err != nil {
+			return err
+		}
+
+		val, err := p.db.Get(p.getStorageKey(&msg))
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			break
+		}
+		msgs = append(msgs, &msg)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	p.addDue(msgs, false)
+	return nil
+}
+
+// loadChannelDue tracks the messages of channel in the view that are not due yet
+func (p *Partition) loadChannelDue(channel string) error {
+	var msgs []*sgproto.Message
+	err := p.db.ForRange(p.prependPrefixView(channel), sgproto.NewOffset(0, time.Now()), sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		msgs = append(msgs, &sgproto.Message{
+			Channel:   msg.Channel,
+			Offset:    msg.Offset,
+			Tombstone: msg.Tombstone,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.addDue(msgs, true)
+	return nil
+}
+
+// addDue tracks stored messages until they are due, it does nothing for other kinds of topics.
+// Only the messages due after now are tracked when future is set.
+func (p *Partition) addDue(msgs []*sgproto.Message, future bool) {
+	if p.topic.Kind != sgproto.TopicKind_TimerKind {
+		return
+	}
+
+	now := time.Now()
+	p.due.mu.Lock()
+	defer p.due.mu.Unlock()
+
+	if p.due.closed {
+		return
+	}
+
+	if p.due.wheel == nil {
+		p.due.init(now)
+	}
+
+	for _, msg := range msgs {
+		if msg.Tombstone || (future && !msg.Offset.Time().After(now)) {
+			continue
+		}
+
+		e := wheelEntry{channel: msg.Channel, offset: msg.Offset}
+		if !p.due.wheel.add(e) {
+			p.releaseDue(e)
+		}
+	}
+
+	p.scheduleDue()
+}
+
+// scheduleDue sets the timer to the next expiration of the wheel, the lock should be held
+func (p *Partition) scheduleDue() {
+	next, ok := p.due.wheel.next()
+	if !ok || (!p.due.wakeup.IsZero() && !next.Before(p.due.wakeup)) {
+		return
+	}
+
+	p.due.wakeup = next
+	if p.due.timer == nil {
+		p.due.timer = time.AfterFunc(time.Until(next), p.expireDue)
+	} else {
+		p.due.timer.Reset(time.Until(next))
+	}
+}
+
+func (p *Partition) expireDue() {
+	p.due.mu.Lock()
+	defer p.due.mu.Unlock()
+
+	if p.due.closed {
+		return
+	}
+
+	p.due.wakeup = time.Time{}
+	p.due.wheel.expire(time.Now(), p.releaseDue)
+	p.scheduleDue()
+}
+
+// releaseDue wakes up the waiters of a due message once it is replicated, the lock should be held
+func (p *Partition) releaseDue(e wheelEntry) {
+	if e.offset.Index() > p.HWMark() {
+		p.due.unreplicated = append(p.due.unreplicated, e)
+		return
+	}
+
+	for w := range p.due.waiters {
+		if w.channel == e.channel && bytes.Compare(e.offset.Bytes(), w.after.Bytes()) > 0 {
+			close(w.ch)
+			delete(p.due.waiters, w)
+		}
+	}
+}
+
+// replicatedDue releases the due messages covered by the HW mark
+func (p *Partition) replicatedDue() {
+	p.due.mu.Lock()
+	defer p.due.mu.Unlock()
+
+	if len(p.due.unreplicated) == 0 {
+		return
+	}
+
+	entries := p.due.unreplicated
+	p.due.unreplicated = nil
+	for _, e := range entries {
+		p.releaseDue(e)
+	}
+}
+
+func (p *Partition) closeDue() {
+	p.due.mu.Lock()
+	defer p.due.mu.Unlock()
+
+	p.due.closed = true
+	if p.due.timer != nil {
+		p.due.timer.Stop()
+	}
+	for w := range p.due.waiters {
+		close(w.ch)
+	}
+	p.due.waiters = nil
+}
+
+// WaitDue blocks until a message of channel following after is due and replicated, or ctx is done.
+// It returns right away when there is already one.
+func (p *Partition) WaitDue(ctx context.Context, channel string, after sgproto.Offset) error {
+	if p.topic.Kind != sgproto.TopicKind_TimerKind {
+		return ErrNotTimerTopic
+	}
+
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
+	w := &dueWaiter{
+		channel: channel,
+		after:   after,
+		ch:      make(chan struct{}),
+	}
+
+	p.due.mu.Lock()
+	if p.due.wheel == nil {
+		p.due.init(time.Now())
+	}
+	if p.due.closed {
+		p.due.mu.Unlock()
+		return ErrPartitionClosed
+	}
+	p.due.waiters[w] = struct{}{}
+	load := !p.due.loaded[channel]
+	p.due.loaded[channel] = true
+	p.due.mu.Unlock()
+
+	defer func() {
+		p.due.mu.Lock()
+		delete(p.due.waiters, w)
+		p.due.mu.Unlock()
+	}()
+
+	if load {
+		if err := p.loadChannelDue(channel); err != nil {
+			p.due.mu.Lock()
+			delete(p.due.loaded, channel)
+			p.due.mu.Unlock()
+			return err
+		}
+	}
+
+	// the waiter is registered first so that no message is missed in between
+	now := sgproto.NewOffset(sgproto.MaxOffset.Index(), time.Now())
+	err := p.ForRange(channel, after, now, func(msg *sgproto.Message) error {
+		if msg.Offset.Equal(after) {
+			return nil
+		}
+		return errDueFound
+	})
+	if err == errDueFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	select {
+	case <-w.ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,97 @@
+package topic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitDue(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	waitDue := func(after sgproto.Offset, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return p.WaitDue(ctx, "", after)
+	}
+
+	msgs := []*sgproto.Message{
+		{Value: []byte("now")},
+		{Value: []byte("soon"), ConsumeIn: 200 * time.Millisecond},
+	}
+	err := p.BatchPutMessages(msgs)
+	require.Nil(t, err)
+
+	// consumers only see replicated messages
+	require.Equal(t, context.DeadlineExceeded, waitDue(sgproto.Nil, 50*time.Millisecond))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.WalToView(0, msgs[1].Index)
+		p.SetHWMark(msgs[1].Index)
+	}()
+	require.Nil(t, waitDue(sgproto.Nil, time.Second))
+	require.Nil(t, waitDue(sgproto.Nil, time.Millisecond), "a due message in the view should be found right away")
+
+	start := time.Now()
+	require.Nil(t, waitDue(msgs[0].Offset, time.Second))
+	require.False(t, time.Now().Before(msgs[1].Offset.Time()))
+	require.True(t, time.Since(start) < 500*time.Millisecond)
+
+	require.Equal(t, context.DeadlineExceeded, waitDue(msgs[1].Offset, 50*time.Millisecond))
+}
+
+func TestDueAfterReopen(t *testing.T) {
+	db := mustNewStore(t, sgproto.StorageDriver_Memory, "")
+	defer db.Close()
+
+	newPartition := func() *Partition {
+		p := &Partition{
+			Id: "test",
+			topic: &Topic{
+				Kind: sgproto.TopicKind_TimerKind,
+			},
+		}
+		err := p.InitStore(db)
+		require.Nil(t, err)
+		return p
+	}
+
+	p := newPartition()
+	msgs := []*sgproto.Message{
+		{Value: []byte("replicated"), ConsumeIn: 150 * time.Millisecond},
+		{Value: []byte("unreplicated"), ConsumeIn: 300 * time.Millisecond},
+	}
+	err := p.BatchPutMessages(msgs)
+	require.Nil(t, err)
+	p.WalToView(0, msgs[0].Index)
+	require.Nil(t, p.Close())
+
+	// the message in the view is found when the channel is first waited on,
+	// the one in the WAL tail when the partition is opened
+	p = newPartition()
+	defer p.Close()
+	p.SetHWMark(msgs[0].Index)
+
+	waitDue := func(after sgproto.Offset, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return p.WaitDue(ctx, "", after)
+	}
+
+	require.Nil(t, waitDue(sgproto.Nil, time.Second))
+	require.False(t, time.Now().Before(msgs[0].Offset.Time()))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.WalToView(msgs[0].Index, msgs[1].Index)
+		p.SetHWMark(msgs[1].Index)
+	}()
+	require.Nil(t, waitDue(msgs[0].Offset, time.Second))
+	require.False(t, time.Now().Before(msgs[1].Offset.Time()))
+}
@@ -0,0 +1,64 @@
+package topic
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/scommons"
+)
+
+// Expired returns whether msg expired at now, messages without expiry never do
+func Expired(msg *sgproto.Message, now time.Time) bool {
+	return !msg.ExpiresAt.IsZero() && !now.Before(msg.ExpiresAt)
+}
+
+// setExpiry converts the ttl of a message to its expiry once its offset is set
+func (p *Partition) setExpiry(msg *sgproto.Message) {
+	if msg.ExpiresAt.IsZero() && msg.Ttl > 0 {
+		msg.ExpiresAt = msg.Offset.Time().Add(msg.Ttl)
+	}
+}
+
+// expiringKey marks the partitions holding messages with an expiry, they are reaped even without retention
+func (p *Partition) expiringKey() []byte {
+	return scommons.Join(scommons.ExpiringPrefix, []byte(p.topic.Name), []byte(p.Id))
+}
+
+// markExpiring adds the marker to batch when one of msgs is the first message with an expiry of the
+// partition, setExpiring should be called once the batch is written
+func (p *Partition) markExpiring(batch *storage.WriteBatch, msgs []*sgproto.Message) bool {
+	if p.hasExpiring() {
+		return false
+	}
+
+	for _, msg := range msgs {
+		if !msg.ExpiresAt.IsZero() {
+			batch.Put(p.expiringKey(), []byte{1})
+			return true
+		}
+	}
+	return false
+}
+
+// loadExpiring reads the marker written by markExpiring
+func (p *Partition) loadExpiring() error {
+	val, err := p.db.Get(p.expiringKey())
+	if err != nil {
+		return err
+	}
+
+	if len(val) > 0 {
+		p.setExpiring()
+	}
+	return nil
+}
+
+func (p *Partition) setExpiring() {
+	atomic.StoreUint32(&p.expiring, 1)
+}
+
+func (p *Partition) hasExpiring() bool {
+	return atomic.LoadUint32(&p.expiring) == 1
+}
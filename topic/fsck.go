@@ -0,0 +1,222 @@
+package topic
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/compression"
+	"github.com/sandglass/sandglass/sgutils"
+	"github.com/sandglass/sandglass/storage"
+)
+
+// CheckReport describes the state of the data of a partition
+type CheckReport struct {
+	Topic       string
+	Partition   string
+	HWMark      uint64
+	WALEntries  uint64
+	ViewEntries uint64
+	Issues      []*CheckIssue
+}
+
+// CheckIssue is an inconsistency found in the storage of a partition
+type CheckIssue struct {
+	Key      []byte
+	Index    uint64
+	Problem  string
+	Repaired bool
+}
+
+func (i *CheckIssue) String() string {
+	s := fmt.Sprintf("key %q: %s", i.Key, i.Problem)
+	if i.Index > 0 {
+		s = fmt.Sprintf("index %d: %s", i.Index, i.Problem)
+	}
+
+	if i.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// OK returns true when no issue was found or all of them were repaired
+func (r *CheckReport) OK() bool {
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CheckReport) addIssue(key []byte, index uint64, format string, args ...interface{}) *CheckIssue {
+	issue := &CheckIssue{
+		Key:     sgutils.CopyBytes(key),
+		Index:   index,
+		Problem: fmt.Sprintf(format, args...),
+	}
+	r.Issues = append(r.Issues, issue)
+	return issue
+}
+
+// Check verifies the data of every partition of a stopped topic, hwMarks holds the HW mark of each partition.
+// The storage is opened without initializing the partitions and closed once done,
+// fn is called with the report of each partition.
+func (t *Topic) Check(basePath string, hwMarks map[string]uint64, repair bool, fn func(report *CheckReport) error) error {
+	if err := t.openStore(basePath); err != nil {
+		return err
+	}
+	defer t.db.Close()
+
+	codec, err := compression.Get(t.CompressionCodec)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range t.Partitions {
+		p.topic = t
+		p.db = t.db
+		p.codec = codec
+
+		if err := p.loadExpiring(); err != nil {
+			return err
+		}
+
+		report, err := p.Check(hwMarks[p.Id], repair)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check verifies that the WAL indexes are contiguous, that every WAL entry up to hwMark has its
+// view entry and that the stored values decode. Gaps below the HW mark are expected when the
+// topic is compacted, has a retention or when expired messages were reaped.
+// When repair is set, the missing or broken view entries are rebuilt from the WAL.
+func (p *Partition) Check(hwMark uint64, repair bool) (*CheckReport, error) {
+	report := &CheckReport{
+		Topic:     p.topic.Name,
+		Partition: p.Id,
+		HWMark:    hwMark,
+	}
+
+	pruned := p.topic.Kind == sgproto.TopicKind_KVKind || p.topic.hasRetention() || p.hasExpiring()
+	prefix := p.prependPrefixWAL(nil)
+	batch := storage.NewWriteBatch()
+	rebuilt := map[string]bool{}
+	var repairable []*CheckIssue
+
+	it := p.db.Iter(&storage.IterOptions{
+		FetchValues: true,
+		Prefix:      prefix,
+	})
+
+	var prev uint64
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		report.WALEntries++
+
+		if len(item.Key) != len(prefix)+8 {
+			report.addIssue(item.Key, 0, "malformed WAL key")
+			continue
+		}
+
+		index := binary.BigEndian.Uint64(item.Key[len(prefix):])
+		if prev > 0 && index != prev+1 && (!pruned || index-1 >= hwMark) {
+			report.addIssue(item.Key, index, "WAL entries %d to %d are missing", prev+1, index-1)
+		}
+		prev = index
+
+		var msg sgproto.Message
+		if err := proto.Unmarshal(item.Value, &msg); err != nil {
+			report.addIssue(item.Key, index, "undecodable WAL entry: %v", err)
+			continue
+		}
+
+		if msg.Index != index {
+			report.addIssue(item.Key, index, "WAL entry holds index %d", msg.Index)
+		}
+
+		decoded := msg
+		if err := p.decompress(&decoded); err != nil {
+			report.addIssue(item.Key, index, "undecodable value: %v", err)
+		}
+
+		if index > hwMark {
+			continue
+		}
+
+		var issue *CheckIssue
+		viewKey := p.getStorageKey(&msg)
+		viewMsg, err := p.getMessageByStorageKey(viewKey)
+		switch {
+		case err == ErrMissingViewEntry:
+			issue = report.addIssue(item.Key, index, "missing view entry")
+		case err != nil:
+			issue = report.addIssue(item.Key, index, "undecodable view entry: %v", err)
+		case p.topic.Kind == sgproto.TopicKind_TimerKind && viewMsg.Index != msg.Index,
+			p.topic.Kind == sgproto.TopicKind_KVKind && viewMsg.Index < msg.Index:
+			issue = report.addIssue(item.Key, index, "view entry holds index %d", viewMsg.Index)
+		default:
+			continue
+		}
+		repairable = append(repairable, issue)
+
+		// entries are added in the WAL order so that the last version of a key wins
+		batch.Put(viewKey, item.Value)
+		rebuilt[string(viewKey)] = true
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if repair && batch.Len() > 0 {
+		if p.topic.Kind == sgproto.TopicKind_KVKind {
+			// the persisted bloom filter does not know the repaired keys, it is rebuilt on startup
+			batch.Delete(p.filterKey())
+		}
+
+		if err := p.db.Write(batch); err != nil {
+			return nil, err
+		}
+
+		for _, issue := range repairable {
+			issue.Repaired = true
+		}
+	}
+
+	it = p.db.Iter(&storage.IterOptions{
+		FetchValues: true,
+		Prefix:      p.prependPrefixView(""),
+	})
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		report.ViewEntries++
+
+		if rebuilt[string(item.Key)] { // already reported
+			continue
+		}
+
+		var msg sgproto.Message
+		if err := proto.Unmarshal(item.Value, &msg); err != nil {
+			report.addIssue(item.Key, 0, "undecodable view entry: %v", err)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
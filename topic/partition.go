@@ -7,23 +7,36 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
-	"github.com/tylertreat/BoomFilters"
-
 	"github.com/celrenheit/sandflake"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/compression"
+	"github.com/sandglass/sandglass/sgutils"
 	"github.com/sandglass/sandglass/storage"
 	"github.com/sandglass/sandglass/storage/scommons"
 	"github.com/gogo/protobuf/proto"
-	"github.com/willf/bloom"
 )
 
 var (
-	ErrNoKeySet = errors.New("ErrNoKeySet")
+	ErrNoKeySet         = errors.New("ErrNoKeySet")
+	ErrMissingViewEntry = errors.New("ErrMissingViewEntry")
+)
+
+// DefaultChannel is the channel of the messages produced without one
+const DefaultChannel = "master"
+
+const (
+	// number of produce requests queued per partition before producers are blocked
+	incommingQueueSize = 256
+	// maximum number of messages stored in a single write by the group commit
+	maxGroupCommitMessages = 10000
+	// number of WAL entries deleted per write by TruncateWALFrom
+	truncateBatchSize = 1000
 )
 
 type Partition struct {
@@ -34,10 +47,21 @@ type Partition struct {
 	basepath string
 	topic    *Topic
 
-	bf  *bloom.BloomFilter // TODO: persist bloom filter
-	ibf boom.Filter
+	filter keyFilter
+	codec  compression.Codec
 
+	// lastIndex is the index of the last WAL entry, guarded by producers.mu
 	lastIndex uint64
+	hwMark    uint64
+	// hwMarkCh is closed when the HW mark moves
+	hwMarkCh chan struct{}
+	hwMarkMu sync.Mutex
+
+	producers   producers
+	withdrawals withdrawals
+	// expiring is set once a message with an expiry is stored
+	expiring uint32
+	due      dueMessages
 
 	ctxPending    context.Context
 	cancelPending context.CancelFunc
@@ -58,10 +82,14 @@ func (t *Partition) InitStore(db storage.Storage) error {
 		"component": "partition",
 		"partition": t.Id,
 	})
-	t.bf = bloom.NewWithEstimates(1e3, 1e-2)
-	t.ibf = boom.NewInverseBloomFilter(1e3)
 	t.db = db
 
+	codec, err := compression.Get(t.topic.CompressionCodec)
+	if err != nil {
+		return fmt.Errorf("unable to init compression codec %v: %v", t.topic.CompressionCodec, err)
+	}
+	t.codec = codec
+
 	var index uint64
 	msg, err := t.EndOfLog()
 	if err != nil {
@@ -73,9 +101,33 @@ func (t *Partition) InitStore(db storage.Storage) error {
 	}
 	t.lastIndex = index
 
+	if err := t.loadProducers(); err != nil {
+		return fmt.Errorf("unable to load producers: %v", err)
+	}
+
+	if err := t.loadExpiring(); err != nil {
+		return fmt.Errorf("unable to load expiry marker: %v", err)
+	}
+
+	if err := t.loadDue(); err != nil {
+		return fmt.Errorf("unable to load due messages: %v", err)
+	}
+
+	if t.topic.Kind == sgproto.TopicKind_KVKind {
+		if err := t.initFilter(); err != nil {
+			return fmt.Errorf("unable to init bloom filter: %v", err)
+		}
+	}
+
 	if t.ctxPending == nil {
-		t.incomming = make(chan *incommingRequest)
+		t.incomming = make(chan *incommingRequest, incommingQueueSize)
 		t.applyPendingToWalLoop()
+		if t.topic.Kind == sgproto.TopicKind_TimerKind {
+			t.reapLoop()
+		}
+		if t.topic.Kind == sgproto.TopicKind_KVKind {
+			t.filterSyncLoop()
+		}
 	}
 
 	return nil
@@ -86,55 +138,156 @@ func (p *Partition) applyPendingToWalLoop() {
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
+
+		evict := time.NewTicker(producerEvictionInterval)
+		defer evict.Stop()
+
 		for {
 			select {
 			case <-p.ctxPending.Done():
 				return
+			case <-evict.C:
+				if err := p.evictProducers(); err != nil {
+					p.logger.WithError(err).Debugf("error while evicting idle producers")
+				}
 			case req := <-p.incomming:
-				req.resp <- p.storeMessages(req.messages)
+				// group commit: the requests queued in the meantime are stored in the same write
+				reqs := []*incommingRequest{req}
+				n := len(req.messages)
+			DRAIN:
+				for n < maxGroupCommitMessages {
+					select {
+					case req := <-p.incomming:
+						reqs = append(reqs, req)
+						n += len(req.messages)
+					default:
+						break DRAIN
+					}
+				}
+
+				p.storeRequests(reqs)
 			}
 		}
 	}()
 }
 
-func (p *Partition) storeMessages(msgs []*sgproto.Message) error {
+// storeRequests stores the messages of the requests in order and answers each of them
+func (p *Partition) storeRequests(reqs []*incommingRequest) {
+	p.producers.mu.Lock()
+	defer p.producers.mu.Unlock()
+
+	// a batch is checked against the last stored batch of its producer,
+	// the following batches of the same producer wait for the next write
+	var group []*incommingRequest
+	producers := map[string]bool{}
+	for _, req := range reqs {
+		if len(req.messages) > 0 && req.messages[0].ProducerId != "" {
+			id := req.messages[0].ProducerId
+			if producers[id] {
+				p.storeGroup(group)
+				group = nil
+				producers = map[string]bool{}
+			}
+			producers[id] = true
+		}
+		group = append(group, req)
+	}
+
+	p.storeGroup(group)
+}
+
+func (p *Partition) storeGroup(reqs []*incommingRequest) {
 	index := p.lastIndex + 1
 
-	var entries []*storage.Entry
+	batch := storage.NewWriteBatch()
+	stored := make([]*incommingRequest, 0, len(reqs))
+	for _, req := range reqs {
+		msgs := req.messages
+		if len(msgs) == 0 {
+			req.resp <- nil
+			continue
+		}
+
+		if msgs[0].ProducerId != "" {
+			if resent, err := p.dedup(msgs); err != nil || resent {
+				req.resp <- err
+				continue
+			}
+		}
+
+		keys, vals, err := p.walEntries(msgs, index)
+		if err != nil {
+			req.resp <- err
+			continue
+		}
+
+		for i := range keys {
+			batch.Put(keys[i], vals[i])
+		}
+		index += uint64(len(msgs))
+		stored = append(stored, req)
+	}
+
+	if len(stored) == 0 {
+		return
+	}
+
+	var msgs []*sgproto.Message
+	for _, req := range stored {
+		msgs = append(msgs, req.messages...)
+	}
+	states := p.producers.update(msgs, time.Now())
+	p.putProducers(batch, states)
+	expiring := p.markExpiring(batch, msgs)
+
+	if err := p.db.Write(batch); err != nil {
+		for _, req := range stored {
+			req.resp <- err
+		}
+		return
+	}
+
+	p.lastIndex = index - 1
+	p.producers.install(states)
+	if expiring {
+		p.setExpiring()
+	}
+	for _, req := range stored {
+		p.addDue(req.messages, false)
+		req.resp <- nil
+	}
+}
+
+// walEntries assigns the indexes of the messages starting at index and returns their WAL entries
+func (p *Partition) walEntries(msgs []*sgproto.Message, index uint64) (keys, vals [][]byte, err error) {
+	keys = make([][]byte, 0, len(msgs))
+	vals = make([][]byte, 0, len(msgs))
 	for _, msg := range msgs {
 		msg.Index = index
 		if msg.Offset == sgproto.Nil {
 			msg.Offset = sgproto.NewOffset(msg.Index, msg.ProducedAt.Add(msg.ConsumeIn))
 		}
+		p.setExpiry(msg)
 		if msg.Channel == "" {
-			msg.Channel = "master"
+			msg.Channel = DefaultChannel
 		}
-		val, err := proto.Marshal(msg)
+		val, err := p.marshal(msg)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		entries = append(entries, &storage.Entry{
-			Key:   p.newWALKey(msg),
-			Value: val,
-		})
 
+		keys = append(keys, p.newWALKey(msg))
+		vals = append(vals, val)
 		index++
 	}
 
-	if len(entries) == 0 {
-		return nil
-	}
-
-	if err := p.db.BatchPut(entries); err != nil {
-		return err
-	}
-
-	p.lastIndex += uint64(len(msgs))
-	return nil
+	return keys, vals, nil
 }
 
+// WalToView copies the messages of the WAL in the range (start, end] to the view in a single batch
 func (p *Partition) WalToView(start, end uint64) error {
-	entries := []*storage.Entry{}
+	batch := storage.NewWriteBatch()
+	msgs := []*sgproto.Message{}
 	err := p.db.ForRangeWAL(p.prependPrefixWAL(), start, end, func(msg *sgproto.Message) error {
 		storagekey := p.getStorageKey(msg)
 
@@ -143,10 +296,14 @@ func (p *Partition) WalToView(start, end uint64) error {
 			return err
 		}
 
-		entries = append(entries, &storage.Entry{
-			Key:   storagekey,
-			Value: b,
-		})
+		if p.deletesKey(msg) {
+			if err := p.deleteVersions(batch, msgs, msg); err != nil {
+				return err
+			}
+		}
+
+		batch.Put(storagekey, b)
+		msgs = append(msgs, msg)
 
 		return nil
 	})
@@ -154,7 +311,55 @@ func (p *Partition) WalToView(start, end uint64) error {
 		return err
 	}
 
-	return p.db.BatchPut(entries)
+	if err := p.db.Write(batch); err != nil {
+		return err
+	}
+
+	if p.topic.Kind != sgproto.TopicKind_KVKind {
+		return nil
+	}
+
+	return p.updateFilter(msgs)
+}
+
+// SetHWMark records the index up to which messages are replicated
+func (p *Partition) SetHWMark(index uint64) {
+	atomic.StoreUint64(&p.hwMark, index)
+	p.replicatedDue()
+
+	p.hwMarkMu.Lock()
+	if p.hwMarkCh != nil {
+		close(p.hwMarkCh)
+		p.hwMarkCh = nil
+	}
+	p.hwMarkMu.Unlock()
+}
+
+func (p *Partition) HWMark() uint64 {
+	return atomic.LoadUint64(&p.hwMark)
+}
+
+// WaitHWMark blocks until the HW mark reaches index or ctx is done
+func (p *Partition) WaitHWMark(ctx context.Context, index uint64) error {
+	for {
+		p.hwMarkMu.Lock()
+		if p.HWMark() >= index {
+			p.hwMarkMu.Unlock()
+			return nil
+		}
+
+		if p.hwMarkCh == nil {
+			p.hwMarkCh = make(chan struct{})
+		}
+		advanced := p.hwMarkCh
+		p.hwMarkMu.Unlock()
+
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (t *Partition) String() string {
@@ -185,12 +390,24 @@ func (s *Partition) GetMessage(channel string, offset sgproto.Offset, k, suffix
 			return nil, err
 		}
 
+		if val == nil {
+			return nil, nil
+		}
+
 		var msg sgproto.Message
 		err = proto.Unmarshal(val, &msg)
 		if err != nil {
 			return nil, err
 		}
 
+		if msg.Tombstone { // cancelled
+			return nil, nil
+		}
+
+		if err := s.decompress(&msg); err != nil {
+			return nil, err
+		}
+
 		return &msg, nil
 	case sgproto.TopicKind_KVKind:
 		val := s.db.LastKVForPrefix(s.prependPrefixView(channel, k), suffix)
@@ -204,12 +421,59 @@ func (s *Partition) GetMessage(channel string, offset sgproto.Offset, k, suffix
 			return nil, err
 		}
 
+		if msg.Tombstone { // deleted
+			return nil, nil
+		}
+
+		if err := s.decompress(&msg); err != nil {
+			return nil, err
+		}
+
 		return &msg, nil
 	default:
 		return nil, fmt.Errorf("invalid storage kind: %s", s.topic.Kind.String())
 	}
 }
 
+// deletesKey returns whether msg is a tombstone for a key of a KV topic as a whole,
+// every clustering key of the key is deleted along with it
+func (p *Partition) deletesKey(msg *sgproto.Message) bool {
+	return p.topic.Kind == sgproto.TopicKind_KVKind && msg.Tombstone && len(msg.ClusteringKey) == 0
+}
+
+// deleteVersions adds to batch the deletion of the view entries of the clustering keys of
+// tombstone, whether they are stored or put earlier in the batch by pending.
+// Reads take the greatest clustering key of a key, the tombstone alone must remain.
+// The WAL entries of the deleted versions are removed by the compaction.
+func (p *Partition) deleteVersions(batch *storage.WriteBatch, pending []*sgproto.Message, tombstone *sgproto.Message) error {
+	for _, msg := range pending {
+		if msg.Channel == tombstone.Channel && bytes.Equal(msg.Key, tombstone.Key) && len(msg.ClusteringKey) > 0 {
+			batch.Delete(p.getStorageKey(msg))
+		}
+	}
+
+	it := p.db.Iter(&storage.IterOptions{
+		Prefix: p.prependPrefixView(tombstone.Channel, tombstone.Key, nil),
+	})
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		batch.Delete(it.Item().Key)
+	}
+
+	return it.Err()
+}
+
+// lastVersion returns the storage key of the last version of key in the view:
+// the greatest clustering key, or the key itself when it has no clustering key
+func (p *Partition) lastVersion(channel string, key []byte) []byte {
+	if k := p.db.LastKeyForPrefix(p.prependPrefixView(channel, key, nil)); k != nil {
+		return k
+	}
+
+	return p.prependPrefixView(channel, key)
+}
+
 func (s *Partition) prependPrefixView(channel string, keys ...[]byte) []byte {
 	base := [][]byte{scommons.ViewPrefix, []byte(s.topic.Name), []byte(s.Id), []byte(channel)}
 	return scommons.Join(append(base, keys...)...)
@@ -227,27 +491,34 @@ func (t *Partition) HasKey(channel string, key, clusterKey []byte) (bool, error)
 		return false, errors.New("HasKey should be used only with a KV topic")
 	}
 
-	pk := joinKeys(key, clusterKey)
-	existKey := t.prependPrefixView(channel, pk)
-
-	if t.ibf.Test(existKey) {
-		return true, nil
+	existKey := t.prependPrefixView(channel, key)
+	if len(clusterKey) > 0 {
+		existKey = t.prependPrefixView(channel, joinKeys(key, clusterKey))
 	}
 
-	if !t.bf.Test(existKey) {
+	if !t.testFilter(existKey) {
 		return false, nil
 	}
 
-	msg, err := t.GetMessage(channel, sgproto.Nil, pk, nil)
+	if len(clusterKey) == 0 {
+		existKey = t.lastVersion(channel, key)
+	}
+
+	val, err := t.db.Get(existKey)
 	if err != nil {
 		return false, err
 	}
 
-	if msg == nil {
+	if val == nil {
 		return false, nil
 	}
 
-	return msg.Offset != sgproto.Nil, nil
+	var msg sgproto.Message
+	if err := proto.Unmarshal(val, &msg); err != nil {
+		return false, err
+	}
+
+	return !msg.Tombstone, nil
 }
 
 func (t *Partition) newWALKey(msg *sgproto.Message) []byte {
@@ -265,24 +536,54 @@ func (t *Partition) PutMessage(msg *sgproto.Message) error {
 }
 
 func (t *Partition) BatchPutMessages(msgs []*sgproto.Message) error {
-	if len(msgs) == 0 {
-		return nil
-	}
+	return <-t.QueueMessages(msgs)
+}
 
+// QueueMessages queues messages to be stored and returns a channel receiving the result once they are.
+// The messages of successive calls are stored in the order they were queued.
+func (t *Partition) QueueMessages(msgs []*sgproto.Message) <-chan error {
 	now := time.Now().UTC()
 
 	for _, msg := range msgs {
 		msg.ProducedAt = now
 	}
 
+	return t.queue(msgs)
+}
+
+// ImportMessages stores messages exported from another topic, keeping their offsets and production times.
+// Messages without a production time are considered produced now.
+func (t *Partition) ImportMessages(msgs []*sgproto.Message) error {
+	return <-t.QueueImportMessages(msgs)
+}
+
+// QueueImportMessages is the asynchronous version of ImportMessages, see QueueMessages
+func (t *Partition) QueueImportMessages(msgs []*sgproto.Message) <-chan error {
+	now := time.Now().UTC()
+
+	for _, msg := range msgs {
+		if msg.ProducedAt.IsZero() {
+			msg.ProducedAt = now
+		}
+	}
+
+	return t.queue(msgs)
+}
+
+func (t *Partition) queue(msgs []*sgproto.Message) <-chan error {
 	req := &incommingRequest{
 		messages: msgs,
 		resp:     make(chan error, 1),
 	}
 
+	if len(msgs) == 0 {
+		req.resp <- nil
+		return req.resp
+	}
+
 	t.incomming <- req
 
-	return <-req.resp
+	return req.resp
 }
 
 func (p *Partition) WALBatchPutMessages(msgs []*sgproto.Message) error {
@@ -290,27 +591,54 @@ func (p *Partition) WALBatchPutMessages(msgs []*sgproto.Message) error {
 		return nil
 	}
 
-	entries := []*storage.Entry{}
+	batch := storage.NewWriteBatch()
 	for _, msg := range msgs {
-		val, err := proto.Marshal(msg)
+		p.setExpiry(msg)
+		val, err := p.marshal(msg)
 		if err != nil {
 			return err
 		}
 
-		entries = append(entries, &storage.Entry{
-			Key:   p.newWALKey(msg),
-			Value: val,
-		})
+		batch.Put(p.newWALKey(msg), val)
+	}
+
+	p.producers.mu.Lock()
+	defer p.producers.mu.Unlock()
+
+	states := p.producers.update(msgs, time.Now())
+	p.putProducers(batch, states)
+	expiring := p.markExpiring(batch, msgs)
+
+	if err := p.db.Write(batch); err != nil {
+		return err
 	}
 
-	return p.db.BatchPut(entries)
+	p.producers.install(states)
+	if expiring {
+		p.setExpiring()
+	}
+	p.addDue(msgs, false)
+	return nil
 }
 
+// ForRange iterates over the messages of channel from min to max, DefaultChannel is used when channel is empty
 func (p *Partition) ForRange(channel string, min, max sgproto.Offset, fn func(msg *sgproto.Message) error) error {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
 	var lastKey []byte
 	switch p.topic.Kind {
 	case sgproto.TopicKind_TimerKind:
 		return p.db.ForRange(p.prependPrefixView(channel), min, max, func(msg *sgproto.Message) error {
+			if msg.Tombstone || p.withdrawals.withdrawn(msg.Offset) { // cancelled
+				return nil
+			}
+
+			if err := p.decompress(msg); err != nil {
+				return err
+			}
+
 			err := fn(msg)
 			return err
 		})
@@ -322,13 +650,24 @@ func (p *Partition) ForRange(channel string, min, max sgproto.Offset, fn func(ms
 		defer it.Close()
 		for m := it.Rewind(); it.Valid(); m = it.Next() {
 			if lastKey == nil || !bytes.Equal(m.Key, lastKey) {
+				lastKey = m.Key
+				if m.Tombstone { // the last version of the key is a deletion
+					continue
+				}
+
+				if err := p.decompress(m); err != nil {
+					return err
+				}
+
 				err := fn(m)
 				if err != nil {
 					return err
 				}
-				lastKey = m.Key
 			}
 		}
+		if err := it.Err(); err != nil {
+			return err
+		}
 	default:
 		panic("unknown topic kind: " + p.topic.Kind.String())
 	}
@@ -339,27 +678,46 @@ func (p *Partition) Close() error {
 	if p.cancelPending != nil {
 		p.cancelPending()
 	}
+	p.closeDue()
 	p.wg.Wait()
-	return nil
+	return p.syncFilter()
 }
 
 func (p *Partition) Iter(channel string) storage.MessageIterator {
-	return scommons.NewMessageIterator(p.prependPrefixView(channel), p.db, &storage.IterOptions{
-		FetchValues: true,
-		Reverse:     false,
-	})
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
+	return &messageIterator{
+		MessageIterator: scommons.NewMessageIterator(p.prependPrefixView(channel), p.db, &storage.IterOptions{
+			FetchValues: true,
+			Reverse:     false,
+		}),
+		p: p,
+	}
 }
 
 func (p *Partition) RangeFromWAL(min []byte, fn func(*sgproto.Message) error) error {
+	return p.rangeFromWAL(min, func(msg *sgproto.Message) error {
+		if err := p.decompress(msg); err != nil {
+			return err
+		}
+
+		return fn(msg)
+	})
+}
+
+// rangeFromWAL iterates over the WAL entries as stored, values are left compressed
+func (p *Partition) rangeFromWAL(min []byte, fn func(*sgproto.Message) error) error {
 	return p.db.ForEachWALEntry(p.prependPrefixWAL(), min, fn)
 }
 
 func (p *Partition) LastWALEntry() []byte {
-	return p.db.LastKeyForPrefix(p.prependPrefixWAL())
+	return p.db.LastKeyForPrefix(p.prependPrefixWAL(nil))
 }
 
 func (p *Partition) EndOfLog() (*sgproto.Message, error) {
-	value := p.db.LastKVForPrefix(p.prependPrefixWAL(), nil)
+	value := p.db.LastKVForPrefix(p.prependPrefixWAL(nil), nil)
 	if len(value) == 0 {
 		return nil, nil
 	}
@@ -369,6 +727,10 @@ func (p *Partition) EndOfLog() (*sgproto.Message, error) {
 		return nil, err
 	}
 
+	if err := p.decompress(&msg); err != nil {
+		return nil, err
+	}
+
 	return &msg, nil
 }
 
@@ -379,7 +741,7 @@ func (p *Partition) getMessageByStorageKey(k []byte) (*sgproto.Message, error) {
 	}
 
 	if b == nil {
-		panic("should not happend, key in wal should always be also in msgs")
+		return nil, ErrMissingViewEntry
 	}
 
 	var msg sgproto.Message
@@ -388,14 +750,60 @@ func (p *Partition) getMessageByStorageKey(k []byte) (*sgproto.Message, error) {
 		return nil, err
 	}
 
+	if err := p.decompress(&msg); err != nil {
+		return nil, err
+	}
+
 	return &msg, nil
 }
 
+// TruncateWALFrom deletes the WAL entries starting at index by batches of truncateBatchSize.
+// The batches are taken from the end of the WAL: each write removes a suffix, so an interrupted
+// truncation leaves a contiguous prefix of the WAL, never a hole, and running it again completes it.
 func (p *Partition) TruncateWALFrom(index uint64) error {
-	prefix := p.prependPrefixWAL()
-	min := p.genWALKey(index)
+	p.producers.mu.Lock()
+	defer p.producers.mu.Unlock()
+
+	for {
+		n, err := p.truncateWALBatch(index)
+		if err != nil {
+			return err
+		}
+
+		if n < truncateBatchSize {
+			break
+		}
+	}
+
+	if index > 0 && p.lastIndex >= index {
+		p.lastIndex = index - 1
+	}
+
+	return nil
+}
+
+// truncateWALBatch deletes up to truncateBatchSize of the last WAL entries starting at index
+func (p *Partition) truncateWALBatch(index uint64) (int, error) {
+	batch := storage.NewWriteBatch()
+	it := p.db.Iter(&storage.IterOptions{
+		Prefix:     p.prependPrefixWAL(nil),
+		LowerBound: p.genWALKey(index),
+		Reverse:    true,
+	})
+	for it.Rewind(); it.Valid() && batch.Len() < truncateBatchSize; it.Next() {
+		batch.Delete(sgutils.CopyBytes(it.Item().Key))
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	if batch.Len() == 0 {
+		return 0, nil
+	}
 
-	return p.db.Truncate(prefix, min, 1000)
+	return batch.Len(), p.db.Write(batch)
 }
 
 func joinKeys(key, clusterKey []byte) []byte {
@@ -1,124 +1,908 @@
 package topic
 
 import (
+	"bytes"
+	"context"
 	"math"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/badger"
+	"github.com/sandglass/sandglass/storage/bolt"
+	"github.com/sandglass/sandglass/storage/encrypted"
+	"github.com/sandglass/sandglass/storage/memory"
 	"github.com/sandglass/sandglass/storage/rocksdb"
 
 	"io/ioutil"
 
 	"os"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
 	"github.com/stretchr/testify/require"
 )
 
 func TestTimerStorage(t *testing.T) {
-	p := &Partition{
-		Id: "test",
-		topic: &Topic{
+	forEachDriver(t, func(t *testing.T, driver sgproto.StorageDriver) {
+		p := newTestPartition(t, &Topic{
 			Kind: sgproto.TopicKind_TimerKind,
-		},
+		}, driver)
+
+		key := []byte("batman")
+		value := []byte("value")
+		id := sgproto.NewOffset(1, time.Unix(0, 0))
+		err := p.PutMessage(&sgproto.Message{
+			Offset: id,
+			Key:    key,
+			Value:  value,
+		})
+		require.Nil(t, err)
+
+		err = p.WalToView(0, math.MaxUint64)
+		require.Nil(t, err)
+
+		gotMsg, err := p.GetMessage("master", id, nil, nil)
+		require.Nil(t, err)
+		require.Equal(t, id, gotMsg.Offset)
+		require.Equal(t, string(value), string(gotMsg.Value))
+	})
+}
+
+func TestKVStorage(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver sgproto.StorageDriver) {
+		p := newTestPartition(t, &Topic{
+			Kind: sgproto.TopicKind_KVKind,
+		}, driver)
+
+		key := []byte("batman")
+		value := []byte("value")
+		id := sgproto.NewOffset(1, time.Unix(0, 0))
+		err := p.PutMessage(&sgproto.Message{
+			Offset: id,
+			Key:    key,
+			Value:  value,
+		})
+		require.Nil(t, err)
+
+		err = p.WalToView(0, math.MaxUint64)
+		require.Nil(t, err)
+
+		gotMsg, err := p.GetMessage("master", sgproto.Nil, key, nil)
+		require.Nil(t, err)
+		require.NotNil(t, gotMsg)
+		require.Equal(t, string(key), string(gotMsg.Key))
+		require.Equal(t, string(value), string(gotMsg.Value))
+	})
+}
+
+func TestLastMessage(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver sgproto.StorageDriver) {
+		p := newTestPartition(t, &Topic{
+			Kind: sgproto.TopicKind_KVKind,
+		}, driver)
+
+		key := []byte("batman")
+		value := []byte("value")
+		id := sgproto.NewOffset(1, time.Unix(0, 0))
+		err := p.PutMessage(&sgproto.Message{
+			Offset: id,
+			Key:    key,
+			Value:  value,
+		})
+		require.Nil(t, err)
+
+		err = p.WalToView(0, math.MaxUint64)
+		require.Nil(t, err)
+
+		gotKey := p.LastWALEntry()
+		require.Nil(t, err)
+		require.NotNil(t, gotKey)
+
+		gotMsg, err := p.EndOfLog()
+		require.Nil(t, err)
+		require.NotNil(t, gotMsg)
+		require.Equal(t, string(key), string(gotMsg.Key))
+		require.Equal(t, string(value), string(gotMsg.Value))
+	})
+}
+
+func TestRetention(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Kind:            sgproto.TopicKind_TimerKind,
+		RetentionMaxAge: time.Hour,
+	}, sgproto.StorageDriver_Memory)
+
+	old := time.Now().Add(-2 * time.Hour)
+	var offsets []sgproto.Offset
+	for i := 1; i <= 4; i++ {
+		id := sgproto.NewOffset(uint64(i), old)
+		if i == 4 {
+			id = sgproto.NewOffset(uint64(i), time.Now())
+		}
+		offsets = append(offsets, id)
+		err := p.PutMessage(&sgproto.Message{
+			Offset: id,
+			Value:  []byte("value"),
+		})
+		require.Nil(t, err)
 	}
-	dir, err := ioutil.TempDir("", "")
+
+	err := p.WalToView(0, math.MaxUint64)
 	require.Nil(t, err)
-	defer os.RemoveAll(dir)
 
-	err = p.InitStore(mustNewStore(t, dir))
+	n, err := p.Reap()
 	require.Nil(t, err)
+	require.Equal(t, 0, n, "nothing should be deleted without hw mark")
 
-	key := []byte("batman")
-	value := []byte("value")
-	id := sgproto.NewOffset(1, time.Unix(0, 0))
-	err = p.PutMessage(&sgproto.Message{
-		Offset: id,
-		Key:    key,
-		Value:  value,
+	p.SetHWMark(3)
+	p.topic.SetCommittedOffsetFunc(func(topic, partition, channel string) (sgproto.Offset, error) {
+		return offsets[0], nil
 	})
+
+	n, err = p.Reap()
+	require.Nil(t, err)
+	require.Equal(t, 1, n, "in flight messages should be retained")
+
+	p.topic.SetCommittedOffsetFunc(nil)
+	n, err = p.Reap()
+	require.Nil(t, err)
+	require.Equal(t, 1, n, "message at hw mark should be retained")
+
+	var got []sgproto.Offset
+	err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		got = append(got, msg.Offset)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, offsets[2:], got)
+}
+
+func TestExpiry(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	n, err := p.Reap()
 	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	now := time.Now().UTC()
+	msgs := []*sgproto.Message{
+		{Value: []byte("no expiry")},
+		{Value: []byte("expired"), ExpiresAt: now.Add(-time.Minute)},
+		{Value: []byte("ttl"), ConsumeIn: time.Hour, Ttl: time.Minute},
+		{Value: []byte("last")},
+	}
+	err = p.BatchPutMessages(msgs)
+	require.Nil(t, err)
+
+	require.True(t, msgs[0].ExpiresAt.IsZero())
+	require.False(t, Expired(msgs[0], now.Add(time.Hour)))
+	require.True(t, Expired(msgs[1], now))
+	require.Equal(t, msgs[2].Offset.Time().Add(time.Minute), msgs[2].ExpiresAt, "the ttl should start when the message is due")
+	require.False(t, Expired(msgs[2], now.Add(time.Hour)))
+	require.True(t, Expired(msgs[2], now.Add(time.Hour+time.Minute)))
 
 	err = p.WalToView(0, math.MaxUint64)
 	require.Nil(t, err)
+	p.SetHWMark(msgs[3].Index)
 
-	gotMsg, err := p.GetMessage(id, nil, nil)
+	n, err = p.Reap()
 	require.Nil(t, err)
-	require.Equal(t, id, gotMsg.Offset)
-	require.Equal(t, string(value), string(gotMsg.Value))
+	require.Equal(t, 1, n, "expired messages should be reaped without retention settings")
+
+	var got []string
+	err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		got = append(got, string(msg.Value))
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"no expiry", "last", "ttl"}, got)
 }
 
-func TestKVStorage(t *testing.T) {
-	p := &Partition{
-		Id: "test",
-		topic: &Topic{
-			Kind: sgproto.TopicKind_KVKind,
-		},
+func TestCompaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		compactByKey bool
+		deleted      uint64
+		keys         []string
+	}{
+		{"clustering key", false, 1, []string{"b", "ab", "a"}},
+		{"key", true, 3, []string{"b", "ab", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPartition(t, &Topic{
+				Kind:         sgproto.TopicKind_KVKind,
+				CompactByKey: tt.compactByKey,
+			}, sgproto.StorageDriver_Memory)
+
+			msgs := []*sgproto.Message{
+				{Key: []byte("a"), Value: []byte("1")},
+				{Key: []byte("a"), Value: []byte("2")},
+				{Key: []byte("a"), ClusteringKey: []byte("x"), Value: []byte("3")},
+				{Key: []byte("ab"), Value: []byte("4")},
+				{Key: []byte("b"), Value: []byte("5")},
+			}
+			for _, msg := range msgs {
+				err := p.PutMessage(msg)
+				require.Nil(t, err)
+			}
+
+			err := p.WalToView(0, math.MaxUint64)
+			require.Nil(t, err)
+			p.SetHWMark(5)
+
+			var last *sgproto.CompactProgress
+			err = p.Compact(func(progress *sgproto.CompactProgress) error {
+				last = progress
+				return nil
+			})
+			require.Nil(t, err)
+			require.True(t, last.Done)
+			require.Equal(t, tt.deleted, last.Deleted)
+
+			var keys []string
+			err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+				keys = append(keys, string(msg.Key))
+				return nil
+			})
+			require.Nil(t, err)
+			require.Equal(t, tt.keys, keys)
+
+			msg, err := p.GetMessage("master", sgproto.Nil, []byte("a"), []byte("x"))
+			require.Nil(t, err)
+			require.Equal(t, "3", string(msg.Value))
+
+			eol, err := p.EndOfLog()
+			require.Nil(t, err)
+			require.Equal(t, uint64(5), eol.Index, "message at hw mark should be retained")
+		})
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Kind: sgproto.TopicKind_KVKind,
+	}, sgproto.StorageDriver_Memory)
+
+	msgs := []*sgproto.Message{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("a"), Tombstone: true},
+		{Key: []byte("c"), Value: []byte("3")},
+	}
+	for _, msg := range msgs {
+		err := p.PutMessage(msg)
+		require.Nil(t, err)
+	}
+
+	err := p.WalToView(0, math.MaxUint64)
+	require.Nil(t, err)
+
+	msg, err := p.GetMessage("master", sgproto.Nil, []byte("a"), nil)
+	require.Nil(t, err)
+	require.Nil(t, msg, "deleted key should not be found")
+
+	var keys []string
+	err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		keys = append(keys, string(msg.Key))
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"c", "b"}, keys)
+
+	p.SetHWMark(4)
+	var last *sgproto.CompactProgress
+	err = p.Compact(func(progress *sgproto.CompactProgress) error {
+		last = progress
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), last.Deleted, "tombstone should be purged along with the previous version")
+
+	val, err := p.db.Get(p.getStorageKey(msgs[2]))
+	require.Nil(t, err)
+	require.Nil(t, val)
+
+	// deleting a key without clustering key deletes all of its clustering keys
+	msgs = []*sgproto.Message{
+		{Key: []byte("d"), ClusteringKey: []byte("1"), Value: []byte("4")},
+		{Key: []byte("d"), ClusteringKey: []byte("2"), Value: []byte("5")},
 	}
+	err = p.BatchPutMessages(msgs)
+	require.Nil(t, err)
+	err = p.WalToView(4, msgs[0].Index)
+	require.Nil(t, err)
+
+	tombstone := &sgproto.Message{Key: []byte("d"), Tombstone: true}
+	err = p.PutMessage(tombstone)
+	require.Nil(t, err)
+	err = p.WalToView(msgs[0].Index, math.MaxUint64)
+	require.Nil(t, err)
+
+	msg, err = p.GetMessage("master", sgproto.Nil, []byte("d"), nil)
+	require.Nil(t, err)
+	require.Nil(t, msg, "the clustering keys of a deleted key should not be found")
+
+	for _, m := range msgs {
+		ok, err := p.HasKey("master", m.Key, m.ClusteringKey)
+		require.Nil(t, err)
+		require.False(t, ok)
+	}
+
+	keys = nil
+	err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		keys = append(keys, string(msg.Key))
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"c", "b"}, keys)
+
+	p.SetHWMark(tombstone.Index + 1)
+	err = p.Compact(func(progress *sgproto.CompactProgress) error {
+		last = progress
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), last.Deleted, "the deleted versions should be purged along with the tombstone")
+}
+
+func TestHasKey(t *testing.T) {
+	tp := &Topic{
+		Kind: sgproto.TopicKind_KVKind,
+	}
+	newPartition := func(db storage.Storage) *Partition {
+		p := &Partition{
+			Id:    "test",
+			topic: tp,
+		}
+		err := p.InitStore(db)
+		require.Nil(t, err)
+		return p
+	}
+	put := func(p *Partition, msg *sgproto.Message) {
+		err := p.PutMessage(msg)
+		require.Nil(t, err)
+		err = p.WalToView(0, math.MaxUint64)
+		require.Nil(t, err)
+	}
+	has := func(p *Partition, key, clusterKey string) bool {
+		ok, err := p.HasKey("master", []byte(key), []byte(clusterKey))
+		require.Nil(t, err)
+		return ok
+	}
+
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	err = p.InitStore(mustNewStore(t, dir))
+	db := mustNewStore(t, sgproto.StorageDriver_Memory, dir)
+	p := newPartition(db)
+
+	put(p, &sgproto.Message{Key: []byte("a"), Value: []byte("1")})
+	put(p, &sgproto.Message{Key: []byte("b"), ClusteringKey: []byte("x"), Value: []byte("2")})
+	require.True(t, has(p, "a", ""))
+	require.True(t, has(p, "b", "x"))
+	require.True(t, has(p, "b", ""))
+	require.False(t, has(p, "b", "y"))
+	require.False(t, has(p, "c", ""))
+
+	put(p, &sgproto.Message{Key: []byte("a"), Tombstone: true})
+	require.False(t, has(p, "a", ""), "deleted key should not exist")
+
+	err = p.Close() // saves the filter
 	require.Nil(t, err)
 
-	key := []byte("batman")
-	value := []byte("value")
-	id := sgproto.NewOffset(1, time.Unix(0, 0))
-	err = p.PutMessage(&sgproto.Message{
-		Offset: id,
-		Key:    key,
-		Value:  value,
-	})
+	p = newPartition(db)
+	require.True(t, has(p, "b", "x"))
+
+	put(p, &sgproto.Message{Key: []byte("c"), Value: []byte("3")})
+	p.cancelPending() // stop without saving the filter
+	p.wg.Wait()
+
+	p = newPartition(db)
+	defer p.Close()
+	require.True(t, has(p, "c", ""), "keys added since the last save should be recovered from the WAL")
+}
+
+func TestCompression(t *testing.T) {
+	value := []byte(strings.Repeat(`{"task":"send_email","to":"batman@example.com"}`, 20))
+
+	for _, codec := range []sgproto.CompressionCodec{sgproto.CompressionCodec_Gzip, sgproto.CompressionCodec_Flate} {
+		t.Run(codec.String(), func(t *testing.T) {
+			p := newTestPartition(t, &Topic{
+				Kind:             sgproto.TopicKind_TimerKind,
+				CompressionCodec: codec,
+			}, sgproto.StorageDriver_Memory)
+
+			msg := &sgproto.Message{
+				Value: value,
+			}
+			err := p.PutMessage(msg)
+			require.Nil(t, err)
+			require.Equal(t, value, msg.Value, "produced message should not be altered")
+
+			err = p.WalToView(0, math.MaxUint64)
+			require.Nil(t, err)
+
+			var stored sgproto.Message
+			raw, err := p.db.Get(p.getStorageKey(msg))
+			require.Nil(t, err)
+			err = proto.Unmarshal(raw, &stored)
+			require.Nil(t, err)
+			require.True(t, len(stored.Value) < len(value), "value should be stored compressed")
+
+			got, err := p.GetMessage("master", msg.Offset, nil, nil)
+			require.Nil(t, err)
+			require.Equal(t, value, got.Value)
+
+			err = p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(m *sgproto.Message) error {
+				require.Equal(t, value, m.Value)
+				return nil
+			})
+			require.Nil(t, err)
+
+			err = p.RangeFromWAL(nil, func(m *sgproto.Message) error {
+				require.Equal(t, value, m.Value)
+				return nil
+			})
+			require.Nil(t, err)
+
+			it := p.Iter("master")
+			defer it.Close()
+			require.Equal(t, value, it.Rewind().Value)
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Kind:             sgproto.TopicKind_KVKind,
+		CompressionCodec: sgproto.CompressionCodec_Gzip,
+	}, sgproto.StorageDriver_Memory)
+
+	headers := map[string][]byte{
+		"trace-id":     []byte("abc"),
+		"content-type": []byte("application/json"),
+	}
+	msg := &sgproto.Message{
+		Key:     []byte("key"),
+		Value:   []byte(`{"task":"send_email"}`),
+		Headers: headers,
+	}
+	err := p.PutMessage(msg)
 	require.Nil(t, err)
 
 	err = p.WalToView(0, math.MaxUint64)
 	require.Nil(t, err)
 
-	gotMsg, err := p.GetMessage(sgproto.Nil, key, nil)
+	got, err := p.GetMessage("master", sgproto.Nil, msg.Key, nil)
 	require.Nil(t, err)
-	require.NotNil(t, gotMsg)
-	require.Equal(t, string(key), string(gotMsg.Key))
-	require.Equal(t, string(value), string(gotMsg.Value))
+	require.Equal(t, headers, got.Headers)
+
+	var count int
+	err = p.RangeFromWAL(nil, func(m *sgproto.Message) error {
+		count++
+		require.Equal(t, headers, m.Headers, "headers should be replicated with the WAL")
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
 }
 
-func TestLastMessage(t *testing.T) {
-	p := &Partition{
-		Id: "test",
-		topic: &Topic{
-			Kind: sgproto.TopicKind_KVKind,
-		},
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	raw := mustNewStore(t, sgproto.StorageDriver_Memory, dir)
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+
+	newPartition := func(keys map[uint32][]byte) *Partition {
+		keyring, err := encrypted.NewKeyring(keys)
+		require.Nil(t, err)
+		db, err := encrypted.NewStorage(raw, keyring)
+		require.Nil(t, err)
+
+		p := &Partition{
+			Id: "test",
+			topic: &Topic{
+				Kind:      sgproto.TopicKind_KVKind,
+				Encrypted: true,
+			},
+		}
+		err = p.InitStore(db)
+		require.Nil(t, err)
+		return p
+	}
+	put := func(p *Partition, key, value string) {
+		err := p.PutMessage(&sgproto.Message{Key: []byte(key), Value: []byte(value)})
+		require.Nil(t, err)
+		err = p.WalToView(0, math.MaxUint64)
+		require.Nil(t, err)
+	}
+	get := func(p *Partition, key string) string {
+		msg, err := p.GetMessage("master", sgproto.Nil, []byte(key), nil)
+		require.Nil(t, err)
+		require.NotNil(t, msg)
+		return string(msg.Value)
 	}
+
+	p := newPartition(map[uint32][]byte{1: key1})
+	put(p, "a", "secret")
+	require.Equal(t, "secret", get(p, "a"))
+	require.Nil(t, p.Close())
+
+	stored, err := raw.Get(p.prependPrefixView("master", []byte("a")))
+	require.Nil(t, err)
+	require.False(t, bytes.Contains(stored, []byte("secret")), "value should be encrypted")
+
+	// rotation: new writes use the new key, old entries stay readable
+	p = newPartition(map[uint32][]byte{1: key1, 2: key2})
+	defer p.Close()
+	put(p, "b", "classified")
+	require.Equal(t, "secret", get(p, "a"))
+	require.Equal(t, "classified", get(p, "b"))
+
+	var keys []string
+	err = p.RangeFromWAL(nil, func(msg *sgproto.Message) error {
+		keys = append(keys, string(msg.Key))
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, keys)
+
+	onlyNew, err := encrypted.NewKeyring(map[uint32][]byte{2: key2})
+	require.Nil(t, err)
+	db, err := encrypted.NewStorage(raw, onlyNew)
+	require.Nil(t, err)
+	_, err = db.Get(p.genWALKey(1))
+	require.Equal(t, encrypted.ErrUnknownKey, err, "entries written with a removed key should not be readable")
+
+	err = db.ForEachWALEntry(p.prependPrefixWAL(), nil, func(msg *sgproto.Message) error {
+		return nil
+	})
+	require.Equal(t, encrypted.ErrUnknownKey, err, "iterating over entries written with a removed key should fail")
+}
+
+func TestCheck(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Name: "check",
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	for i := 0; i < 4; i++ {
+		err := p.PutMessage(&sgproto.Message{Value: []byte("value")})
+		require.Nil(t, err)
+	}
+
+	err := p.WalToView(0, math.MaxUint64)
+	require.Nil(t, err)
+
+	var msgs []*sgproto.Message
+	err = p.RangeFromWAL(nil, func(msg *sgproto.Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	require.Nil(t, err)
+
+	report, err := p.Check(4, false)
+	require.Nil(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, uint64(4), report.WALEntries)
+	require.Equal(t, uint64(4), report.ViewEntries)
+
+	err = p.db.Delete(p.getStorageKey(msgs[1]))
+	require.Nil(t, err)
+	err = p.db.Put(p.getStorageKey(msgs[2]), []byte("garbage"))
+	require.Nil(t, err)
+
+	report, err = p.Check(4, false)
+	require.Nil(t, err)
+	require.False(t, report.OK())
+	require.Len(t, report.Issues, 2)
+
+	report, err = p.Check(4, true)
+	require.Nil(t, err)
+	require.True(t, report.OK(), "missing and broken view entries should be rebuilt")
+
+	report, err = p.Check(4, false)
+	require.Nil(t, err)
+	require.Len(t, report.Issues, 0)
+
+	msg, err := p.GetMessage("master", msgs[1].Offset, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, "value", string(msg.Value))
+
+	err = p.db.Delete(p.genWALKey(2))
+	require.Nil(t, err)
+
+	report, err = p.Check(4, true)
+	require.Nil(t, err)
+	require.False(t, report.OK(), "gaps in the WAL cannot be repaired")
+	require.Len(t, report.Issues, 1)
+	require.Equal(t, uint64(3), report.Issues[0].Index)
+
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	err = p.InitStore(mustNewStore(t, dir))
+	newTopic := func() *Topic {
+		return &Topic{
+			Name:          "check",
+			Kind:          sgproto.TopicKind_KVKind,
+			NumPartitions: 1,
+			StorageDriver: sgproto.StorageDriver_Bolt,
+			Partitions:    []*Partition{{Id: "test"}},
+		}
+	}
+
+	tp := newTopic()
+	err = tp.InitStore(dir)
+	require.Nil(t, err)
+	err = tp.Partitions[0].PutMessage(&sgproto.Message{Key: []byte("a"), Value: []byte("value")})
 	require.Nil(t, err)
+	require.Nil(t, tp.Close())
 
-	key := []byte("batman")
-	value := []byte("value")
-	id := sgproto.NewOffset(1, time.Unix(0, 0))
-	err = p.PutMessage(&sgproto.Message{
-		Offset: id,
-		Key:    key,
-		Value:  value,
+	var reports []*CheckReport
+	err = newTopic().Check(dir, map[string]uint64{"test": 1}, false, func(report *CheckReport) error {
+		reports = append(reports, report)
+		return nil
 	})
 	require.Nil(t, err)
+	require.Len(t, reports, 1)
+	require.Len(t, reports[0].Issues, 1, "the message was not applied to the view")
+}
+
+func TestCheckExpired(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Name: "check",
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	msgs := []*sgproto.Message{
+		{Value: []byte("value")},
+		{Value: []byte("expired"), ExpiresAt: time.Now().Add(-time.Minute)},
+		{Value: []byte("value")},
+	}
+	err := p.BatchPutMessages(msgs)
+	require.Nil(t, err)
 
 	err = p.WalToView(0, math.MaxUint64)
 	require.Nil(t, err)
+	p.SetHWMark(msgs[2].Index)
 
-	gotKey := p.LastWALEntry()
+	n, err := p.Reap()
 	require.Nil(t, err)
-	require.NotNil(t, gotKey)
+	require.Equal(t, 1, n)
 
-	gotMsg, err := p.EndOfLog()
+	report, err := p.Check(msgs[2].Index, false)
 	require.Nil(t, err)
-	require.NotNil(t, gotMsg)
-	require.Equal(t, string(key), string(gotMsg.Key))
-	require.Equal(t, string(value), string(gotMsg.Value))
+	require.True(t, report.OK(), "the gap left by a reaped message should not be reported: %v", report.Issues)
+	require.Equal(t, uint64(2), report.WALEntries)
+}
+
+func TestWriteBatch(t *testing.T) {
+	for stDriver, stDriverName := range sgproto.StorageDriver_name {
+		t.Run(stDriverName, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			db := mustNewStore(t, sgproto.StorageDriver(stDriver), dir)
+			defer db.Close()
+
+			err = db.Put([]byte("a"), []byte("1"))
+			require.Nil(t, err)
+
+			batch := storage.NewWriteBatch()
+			batch.Put([]byte("b"), []byte("2"))
+			batch.Delete([]byte("a"))
+			batch.Put([]byte("c"), []byte("3"))
+			batch.Delete([]byte("c"))
+			err = db.Write(batch)
+			require.Nil(t, err)
+
+			val, err := db.Get([]byte("a"))
+			require.Nil(t, err)
+			require.Nil(t, val)
+
+			val, err = db.Get([]byte("b"))
+			require.Nil(t, err)
+			require.Equal(t, "2", string(val))
+
+			val, err = db.Get([]byte("c"))
+			require.Nil(t, err)
+			require.Nil(t, val, "a later operation should override the previous ones")
+
+			p := &Partition{
+				Id: "test",
+				topic: &Topic{
+					Kind: sgproto.TopicKind_TimerKind,
+				},
+			}
+			err = p.InitStore(db)
+			require.Nil(t, err)
+
+			for i := 0; i < 5; i++ {
+				err = p.PutMessage(&sgproto.Message{Value: []byte("value")})
+				require.Nil(t, err)
+			}
+
+			err = p.TruncateWALFrom(3)
+			require.Nil(t, err)
+
+			var indexes []uint64
+			err = p.RangeFromWAL(nil, func(msg *sgproto.Message) error {
+				indexes = append(indexes, msg.Index)
+				return nil
+			})
+			require.Nil(t, err)
+			require.Equal(t, []uint64{1, 2}, indexes)
+		})
+	}
+}
+
+func TestTruncateWALFrom(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver sgproto.StorageDriver) {
+		p := newTestPartition(t, &Topic{
+			Name: "truncate",
+			Kind: sgproto.TopicKind_TimerKind,
+		}, driver)
+
+		msgs := make([]*sgproto.Message, 2*truncateBatchSize+5)
+		for i := range msgs {
+			msgs[i] = &sgproto.Message{Value: []byte("value")}
+		}
+		err := p.BatchPutMessages(msgs)
+		require.Nil(t, err)
+
+		err = p.TruncateWALFrom(10)
+		require.Nil(t, err)
+
+		var indexes []uint64
+		err = p.RangeFromWAL(nil, func(msg *sgproto.Message) error {
+			indexes = append(indexes, msg.Index)
+			return nil
+		})
+		require.Nil(t, err)
+		require.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9}, indexes)
+
+		msg := &sgproto.Message{Value: []byte("value")}
+		err = p.PutMessage(msg)
+		require.Nil(t, err)
+		require.Equal(t, uint64(10), msg.Index, "indexes should follow the truncated WAL")
+
+		last, err := p.EndOfLog()
+		require.Nil(t, err)
+		require.Equal(t, uint64(10), last.Index)
+	})
+}
+
+func TestWalToViewRange(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver sgproto.StorageDriver) {
+		p := newTestPartition(t, &Topic{
+			Kind: sgproto.TopicKind_TimerKind,
+		}, driver)
+
+		msgs := make([]*sgproto.Message, 4)
+		for i := range msgs {
+			msgs[i] = &sgproto.Message{Value: []byte("value")}
+		}
+		err := p.BatchPutMessages(msgs)
+		require.Nil(t, err)
+
+		viewed := func() []uint64 {
+			var indexes []uint64
+			err := p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+				indexes = append(indexes, msg.Index)
+				return nil
+			})
+			require.Nil(t, err)
+			return indexes
+		}
+
+		// the first advance of the HW mark starts at 0, messages past it are not copied
+		err = p.WalToView(0, 2)
+		require.Nil(t, err)
+		require.Equal(t, []uint64{1, 2}, viewed())
+
+		err = p.WalToView(2, math.MaxUint64)
+		require.Nil(t, err)
+		require.Equal(t, []uint64{1, 2, 3, 4}, viewed())
+	})
+}
+
+func TestBoundedIterator(t *testing.T) {
+	keys := []string{"a", "b\xff", "b\xff\x00", "b\xff\xff", "c", "d"}
+
+	tests := []struct {
+		name    string
+		opts    storage.IterOptions
+		seek    string
+		want    []string
+		reverse []string
+	}{
+		{"prefix", storage.IterOptions{Prefix: []byte("b\xff")}, "", []string{"b\xff", "b\xff\x00", "b\xff\xff"}, []string{"b\xff\xff", "b\xff\x00", "b\xff"}},
+		{"bounds", storage.IterOptions{LowerBound: []byte("b\xff\x00"), UpperBound: []byte("d")}, "", []string{"b\xff\x00", "b\xff\xff", "c"}, []string{"c", "b\xff\xff", "b\xff\x00"}},
+		{"prefix and bounds", storage.IterOptions{Prefix: []byte("b"), UpperBound: []byte("b\xff\xff")}, "", []string{"b\xff", "b\xff\x00"}, []string{"b\xff\x00", "b\xff"}},
+		{"seek outside bounds", storage.IterOptions{LowerBound: []byte("c")}, "a", []string{"c", "d"}, nil},
+	}
+
+	for stDriver, stDriverName := range sgproto.StorageDriver_name {
+		t.Run(stDriverName, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			db := mustNewStore(t, sgproto.StorageDriver(stDriver), dir)
+			defer db.Close()
+
+			for _, key := range keys {
+				err = db.Put([]byte(key), []byte(key))
+				require.Nil(t, err)
+			}
+
+			collect := func(opts storage.IterOptions, seek string) []string {
+				it := db.Iter(&opts)
+				defer it.Close()
+
+				if seek != "" {
+					it.Seek([]byte(seek))
+				} else {
+					it.Rewind()
+				}
+
+				var got []string
+				for ; it.Valid(); it.Next() {
+					got = append(got, string(it.Item().Key))
+				}
+				return got
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					require.Equal(t, tt.want, collect(tt.opts, tt.seek))
+
+					if tt.reverse != nil {
+						opts := tt.opts
+						opts.Reverse = true
+						require.Equal(t, tt.reverse, collect(opts, tt.seek))
+					}
+				})
+			}
+
+			t.Run("snapshot", func(t *testing.T) {
+				it := db.Iter(&storage.IterOptions{
+					Prefix:   []byte("e"),
+					Snapshot: true,
+				})
+
+				// bolt writers wait for the snapshot to be released
+				done := make(chan error, 1)
+				go func() {
+					done <- db.Put([]byte("e"), []byte("e"))
+				}()
+
+				select {
+				case err := <-done:
+					require.Nil(t, err)
+					done <- nil
+				case <-time.After(100 * time.Millisecond):
+				}
+
+				it.Rewind()
+				require.False(t, it.Valid(), "writes made after the creation of a snapshot should not be seen")
+				it.Close()
+				require.Nil(t, <-done)
+			})
+		})
+	}
 }
 
 func BenchmarkStorageDrivers(b *testing.B) {
@@ -135,7 +919,7 @@ func BenchmarkStorageDrivers(b *testing.B) {
 			require.Nil(b, err)
 			defer os.RemoveAll(dir)
 
-			err = p.InitStore(mustNewStore(b, dir))
+			err = p.InitStore(mustNewStore(b, sgproto.StorageDriver(stDriver), dir))
 			require.Nil(b, err)
 			// defer p.Close()
 
@@ -164,7 +948,7 @@ func BenchmarkStorageDrivers(b *testing.B) {
 				b.ReportAllocs()
 				b.RunParallel(func(pb *testing.PB) {
 					for pb.Next() {
-						msg, err := p.GetMessage(firstId, nil, nil)
+						msg, err := p.GetMessage("master", firstId, nil, nil)
 						require.Nil(b, err)
 						require.NotNil(b, msg)
 					}
@@ -175,7 +959,7 @@ func BenchmarkStorageDrivers(b *testing.B) {
 				b.ReportAllocs()
 				b.RunParallel(func(pb *testing.PB) {
 					for pb.Next() {
-						err := p.ForRange(sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+						err := p.ForRange("master", sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
 							return nil
 						})
 						require.Nil(b, err)
@@ -186,8 +970,243 @@ func BenchmarkStorageDrivers(b *testing.B) {
 	}
 }
 
-func mustNewStore(tb testing.TB, dir string) storage.Storage {
-	s, err := rocksdb.NewStorage(dir)
+func TestStorageOptions(t *testing.T) {
+	defaults := storage.Options{
+		BlockCacheSize:  64 << 20,
+		ValueThreshold:  32,
+		CompactionStyle: sgproto.CompactionStyle_LevelCompaction,
+	}
+	opts := defaults.Override(storage.Options{
+		SyncMode:        sgproto.SyncMode_NoSync,
+		ValueThreshold:  64,
+		CompactionStyle: sgproto.CompactionStyle_UniversalCompaction,
+	})
+	require.Equal(t, storage.Options{
+		BlockCacheSize:  64 << 20,
+		SyncMode:        sgproto.SyncMode_NoSync,
+		ValueThreshold:  64,
+		CompactionStyle: sgproto.CompactionStyle_UniversalCompaction,
+	}, opts)
+
+	// a topic syncs its writes even though the defaults do not
+	synced := opts.Override(storage.Options{SyncMode: sgproto.SyncMode_SyncWrites})
+	require.False(t, synced.NoSync())
+	require.True(t, opts.Override(storage.Options{}).NoSync(), "options left to their defaults should not override them")
+
+	for stDriver, stDriverName := range sgproto.StorageDriver_name {
+		t.Run(stDriverName, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			topic := &Topic{
+				Name:              "options",
+				Kind:              sgproto.TopicKind_TimerKind,
+				ReplicationFactor: 1,
+				NumPartitions:     1,
+				StorageDriver:     sgproto.StorageDriver(stDriver),
+				StorageOptions:    storage.Options{SyncMode: sgproto.SyncMode_NoSync},
+				Partitions:        []*Partition{{Id: "test"}},
+			}
+			topic.SetDefaultStorageOptions(defaults)
+			require.Nil(t, topic.Validate())
+
+			err = topic.InitStore(dir)
+			require.Nil(t, err)
+			defer topic.Close()
+
+			err = topic.PutMessage("test", &sgproto.Message{Value: []byte("value")})
+			require.Nil(t, err)
+		})
+	}
+
+	topic := &Topic{
+		Name:              "options",
+		ReplicationFactor: 1,
+		NumPartitions:     1,
+		StorageOptions:    storage.Options{BlockCacheSize: -1},
+	}
+	require.NotNil(t, topic.Validate())
+
+	topic.StorageOptions = storage.Options{SyncMode: sgproto.SyncMode(42)}
+	require.EqualError(t, topic.Validate(), "invalid storage options: ErrUnknownSyncMode")
+}
+
+func TestImportMessages(t *testing.T) {
+	p := newTestPartition(t, &Topic{
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	producedAt := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	exported := sgproto.NewOffset(42, producedAt.Add(time.Minute))
+	err := p.ImportMessages([]*sgproto.Message{
+		{
+			Offset:     exported,
+			ProducedAt: producedAt,
+			ConsumeIn:  time.Minute,
+			Value:      []byte("exported"),
+		},
+		{
+			Value: []byte("new"),
+		},
+	})
+	require.Nil(t, err)
+
+	err = p.WalToView(0, math.MaxUint64)
+	require.Nil(t, err)
+
+	msg, err := p.GetMessage(DefaultChannel, exported, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, []byte("exported"), msg.Value)
+	require.True(t, producedAt.Equal(msg.ProducedAt), "the production time should be kept")
+	require.Equal(t, time.Minute, msg.ConsumeIn)
+
+	var msgs []*sgproto.Message
+	err = p.ForRange(DefaultChannel, sgproto.Nil, sgproto.MaxOffset, func(msg *sgproto.Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, []byte("new"), msgs[1].Value)
+	require.False(t, msgs[1].ProducedAt.IsZero(), "messages without production time should be considered produced now")
+}
+
+func TestWaitHWMark(t *testing.T) {
+	p := &Partition{Id: "test"}
+	p.SetHWMark(2)
+
+	err := p.WaitHWMark(context.Background(), 2)
+	require.Nil(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.WaitHWMark(context.Background(), 4)
+	}()
+
+	p.SetHWMark(3)
+	select {
+	case err := <-done:
+		t.Fatalf("should wait for the HW mark to reach the index, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.SetHWMark(5)
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("should stop waiting once the HW mark reaches the index")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = p.WaitHWMark(ctx, 6)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestChoosePartitions(t *testing.T) {
+	topic := &Topic{
+		Kind: sgproto.TopicKind_TimerKind,
+		Partitions: []*Partition{
+			{Id: "p0"}, {Id: "p1"}, {Id: "p2"},
+		},
+	}
+
+	var msgs []*sgproto.Message
+	for i := 0; i < 6; i++ {
+		msgs = append(msgs, &sgproto.Message{Key: []byte{byte('a' + i%2)}})
+	}
+
+	partitions, err := topic.ChoosePartitions(sgproto.Partitioner_DefaultPartitioner, msgs)
+	require.Nil(t, err)
+	for _, p := range partitions {
+		require.Equal(t, partitions[0], p, "the random partitioner should send the whole batch to one partition")
+	}
+
+	partitions, err = topic.ChoosePartitions(sgproto.Partitioner_KeyHashPartitioner, msgs)
+	require.Nil(t, err)
+	for i, p := range partitions {
+		require.Equal(t, partitions[i%2], p, "messages with the same key should go to the same partition")
+	}
+
+	kv := &Topic{Kind: sgproto.TopicKind_KVKind, Partitions: topic.Partitions}
+	partitions, err = kv.ChoosePartitions(sgproto.Partitioner_DefaultPartitioner, msgs)
+	require.Nil(t, err)
+	for i, p := range partitions {
+		require.Equal(t, kv.ChoosePartitionForKey(msgs[i].Key), p, "KV topics should hash keys by default")
+	}
+
+	partitions, err = topic.ChoosePartitions(sgproto.Partitioner_RoundRobinPartitioner, msgs)
+	require.Nil(t, err)
+	counts := map[string]int{}
+	for i, p := range partitions {
+		require.NotEqual(t, partitions[(i+1)%len(partitions)], p)
+		counts[p.Id]++
+	}
+	require.Equal(t, map[string]int{"p0": 2, "p1": 2, "p2": 2}, counts)
+
+	_, err = topic.ChoosePartitions(sgproto.Partitioner_ExplicitPartitioner, msgs)
+	require.NotNil(t, err)
+
+	topic.Partitioner = sgproto.Partitioner_ExplicitPartitioner
+	require.Equal(t, sgproto.Partitioner_ExplicitPartitioner, topic.DefaultPartitioner())
+}
+
+// testDrivers are the storage drivers the storage tests of partitions run against,
+// RocksDB is backed by Badger when built without cgo
+var testDrivers = []sgproto.StorageDriver{
+	sgproto.StorageDriver_RocksDB,
+	sgproto.StorageDriver_Badger,
+	sgproto.StorageDriver_Bolt,
+	sgproto.StorageDriver_Memory,
+}
+
+// forEachDriver runs fn as a subtest for each of testDrivers
+func forEachDriver(t *testing.T, fn func(t *testing.T, driver sgproto.StorageDriver)) {
+	for _, driver := range testDrivers {
+		driver := driver
+		t.Run(driver.String(), func(t *testing.T) {
+			fn(t, driver)
+		})
+	}
+}
+
+// newTestPartition opens a partition of topic on a new storage of the given driver,
+// both are closed and removed at the end of the test
+func newTestPartition(tb testing.TB, topic *Topic, driver sgproto.StorageDriver) *Partition {
+	tb.Helper()
+
+	db := mustNewStore(tb, driver, tb.TempDir())
+	tb.Cleanup(func() { db.Close() })
+
+	p := &Partition{
+		Id:    "test",
+		topic: topic,
+	}
+	require.Nil(tb, p.InitStore(db))
+	tb.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func mustNewStore(tb testing.TB, driver sgproto.StorageDriver, dir string) storage.Storage {
+	var (
+		s   storage.Storage
+		err error
+	)
+	switch driver {
+	case sgproto.StorageDriver_Badger:
+		s, err = badger.NewStorage(dir, storage.Options{})
+	case sgproto.StorageDriver_RocksDB:
+		s, err = rocksdb.NewStorage(dir, storage.Options{})
+	case sgproto.StorageDriver_Memory:
+		s, err = memory.NewStorage()
+	case sgproto.StorageDriver_Bolt:
+		s, err = bolt.NewStorage(dir, storage.Options{})
+	default:
+		tb.Fatalf("unknown storage driver: %v", driver)
+	}
 	require.NoError(tb, err)
 	return s
 }
@@ -0,0 +1,53 @@
+package topic
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/sgutils"
+)
+
+// DefaultPartitioner returns the partitioner used when a produce does not set one
+func (t *Topic) DefaultPartitioner() sgproto.Partitioner {
+	if t.Partitioner != sgproto.Partitioner_DefaultPartitioner {
+		return t.Partitioner
+	}
+
+	if t.Kind == sgproto.TopicKind_KVKind {
+		return sgproto.Partitioner_KeyHashPartitioner
+	}
+
+	return sgproto.Partitioner_RandomPartitioner
+}
+
+// ChoosePartitions returns the partition of each message according to partitioner,
+// the default partitioner of the topic is used when it is DefaultPartitioner
+func (t *Topic) ChoosePartitions(partitioner sgproto.Partitioner, msgs []*sgproto.Message) ([]*Partition, error) {
+	if partitioner == sgproto.Partitioner_DefaultPartitioner {
+		partitioner = t.DefaultPartitioner()
+	}
+
+	switch partitioner {
+	case sgproto.Partitioner_RandomPartitioner, sgproto.Partitioner_KeyHashPartitioner, sgproto.Partitioner_RoundRobinPartitioner:
+	default: // the explicit partitioner leaves the choice to the producer
+		return nil, fmt.Errorf("partitioner %v does not choose partitions", partitioner)
+	}
+
+	n := len(t.Partitions)
+	random := t.ChooseRandomPartition()
+	res := make([]*Partition, len(msgs))
+	for i, msg := range msgs {
+		switch {
+		case partitioner == sgproto.Partitioner_KeyHashPartitioner && len(msg.Key) > 0:
+			// same as ChoosePartitionForKey so that the messages of KV topics are found by key
+			res[i] = t.Partitions[sgutils.Hash(msg.Key, n)]
+		case partitioner == sgproto.Partitioner_RoundRobinPartitioner:
+			res[i] = t.Partitions[int(atomic.AddUint32(&t.roundRobin, 1)%uint32(n))]
+		default:
+			res[i] = random
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,320 @@
+package topic
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/storage"
+	"github.com/sandglass/sandglass/storage/scommons"
+)
+
+var (
+	ErrOutOfOrderSequence = errors.New("ErrOutOfOrderSequence")
+	ErrDuplicateSequence  = errors.New("ErrDuplicateSequence")
+
+	errInvalidProducerState = errors.New("errInvalidProducerState")
+)
+
+// ProducerIdleTimeout is the time after which the state of an idempotent producer that stored no batch
+// is forgotten, a batch it resends afterwards is stored again
+var ProducerIdleTimeout = 24 * time.Hour
+
+// interval between two evictions of the idle producers of a partition
+var producerEvictionInterval = time.Minute
+
+// size of the sequence, the time and the number of messages of a persisted producer state
+const producerStateHeaderSize = 8 + 8 + 4
+
+// producerState is the last batch stored for an idempotent producer
+type producerState struct {
+	sequence uint64
+	offsets  []sgproto.Offset
+	indexes  []uint64
+	// seen is when the last batch was stored
+	seen time.Time
+}
+
+// add records a stored message of the producer
+func (st *producerState) add(msg *sgproto.Message, now time.Time) {
+	if st.sequence != msg.Sequence {
+		st.sequence = msg.Sequence
+		st.offsets = nil
+		st.indexes = nil
+	}
+	st.offsets = append(st.offsets, msg.Offset)
+	st.indexes = append(st.indexes, msg.Index)
+	st.seen = now
+}
+
+func (st *producerState) marshal() []byte {
+	b := make([]byte, producerStateHeaderSize+len(st.offsets)*(sgproto.Size+8))
+	binary.BigEndian.PutUint64(b[0:8], st.sequence)
+	binary.BigEndian.PutUint64(b[8:16], uint64(st.seen.UnixNano()))
+	binary.BigEndian.PutUint32(b[16:20], uint32(len(st.offsets)))
+	entry := b[producerStateHeaderSize:]
+	for i := range st.offsets {
+		copy(entry, st.offsets[i][:])
+		binary.BigEndian.PutUint64(entry[sgproto.Size:], st.indexes[i])
+		entry = entry[sgproto.Size+8:]
+	}
+	return b
+}
+
+func unmarshalProducerState(b []byte) (*producerState, error) {
+	if len(b) < producerStateHeaderSize {
+		return nil, errInvalidProducerState
+	}
+
+	n := int(binary.BigEndian.Uint32(b[16:20]))
+	if len(b) != producerStateHeaderSize+n*(sgproto.Size+8) {
+		return nil, errInvalidProducerState
+	}
+
+	st := &producerState{
+		sequence: binary.BigEndian.Uint64(b[0:8]),
+		seen:     time.Unix(0, int64(binary.BigEndian.Uint64(b[8:16]))),
+		offsets:  make([]sgproto.Offset, n),
+		indexes:  make([]uint64, n),
+	}
+	b = b[producerStateHeaderSize:]
+	for i := 0; i < n; i++ {
+		copy(st.offsets[i][:], b[:sgproto.Size])
+		st.indexes[i] = binary.BigEndian.Uint64(b[sgproto.Size : sgproto.Size+8])
+		b = b[sgproto.Size+8:]
+	}
+	return st, nil
+}
+
+// producers tracks the last batch of each idempotent producer of a partition. The state of a producer is
+// persisted along with its batches, by the leader as well as by the followers as they sync the WAL, and
+// loaded when the partition is opened. Producers idle for ProducerIdleTimeout are evicted.
+type producers struct {
+	mu     sync.Mutex
+	states map[string]*producerState
+}
+
+// update returns the states of the producers of msgs once they are stored, msgs being in the order they
+// are stored. The current states are left untouched until they are installed, the lock should be held
+func (ps *producers) update(msgs []*sgproto.Message, now time.Time) map[string]*producerState {
+	var updated map[string]*producerState
+	for _, msg := range msgs {
+		if msg.ProducerId == "" {
+			continue
+		}
+
+		if updated == nil {
+			updated = map[string]*producerState{}
+		}
+
+		st := updated[msg.ProducerId]
+		if st == nil {
+			st = &producerState{}
+			if cur := ps.states[msg.ProducerId]; cur != nil {
+				st.sequence = cur.sequence
+				st.offsets = append([]sgproto.Offset(nil), cur.offsets...)
+				st.indexes = append([]uint64(nil), cur.indexes...)
+			}
+			updated[msg.ProducerId] = st
+		}
+
+		st.add(msg, now)
+	}
+
+	return updated
+}
+
+// track records a stored message in the current state of its producer, the lock should be held
+func (ps *producers) track(msg *sgproto.Message, now time.Time) {
+	if msg.ProducerId == "" {
+		return
+	}
+
+	st := ps.states[msg.ProducerId]
+	if st == nil {
+		st = &producerState{}
+		ps.states[msg.ProducerId] = st
+	}
+	st.add(msg, now)
+}
+
+// install replaces the states of the producers by the updated ones, the lock should be held
+func (ps *producers) install(updated map[string]*producerState) {
+	if ps.states == nil {
+		ps.states = map[string]*producerState{}
+	}
+
+	for id, st := range updated {
+		ps.states[id] = st
+	}
+}
+
+// evict forgets the producers idle since ProducerIdleTimeout and returns their IDs, the lock should be held
+func (ps *producers) evict(now time.Time) []string {
+	var ids []string
+	for id, st := range ps.states {
+		if now.Sub(st.seen) >= ProducerIdleTimeout {
+			delete(ps.states, id)
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// check returns the state of the producer when the batch is the last one stored for it, the lock should be held
+func (ps *producers) check(producerID string, sequence uint64) (*producerState, error) {
+	st := ps.states[producerID]
+	switch {
+	case st == nil: // unknown producer, any sequence is accepted
+		return nil, nil
+	case sequence == st.sequence:
+		return st, nil
+	case sequence < st.sequence:
+		return nil, ErrDuplicateSequence
+	case sequence > st.sequence+1:
+		return nil, ErrOutOfOrderSequence
+	}
+
+	return nil, nil
+}
+
+// dedup sets the offsets and indexes of the messages to the ones they were stored with when they are the
+// resent copy of the last batch of their producer, in which case they should not be stored again
+func (p *Partition) dedup(msgs []*sgproto.Message) (bool, error) {
+	msg := msgs[0]
+	st, err := p.producers.check(msg.ProducerId, msg.Sequence)
+	if err != nil || st == nil {
+		return false, err
+	}
+
+	if len(st.offsets) != len(msgs) {
+		return false, ErrDuplicateSequence
+	}
+
+	for i, msg := range msgs {
+		msg.Offset = st.offsets[i]
+		msg.Index = st.indexes[i]
+	}
+	return true, nil
+}
+
+// producerKey is the key of the persisted state of a producer, the empty ID gives the prefix of all of them
+func (p *Partition) producerKey(id string) []byte {
+	return scommons.Join(scommons.ProducerPrefix, []byte(p.topic.Name), []byte(p.Id), []byte(id))
+}
+
+// putProducers adds the persisted states of the producers to batch
+func (p *Partition) putProducers(batch *storage.WriteBatch, states map[string]*producerState) {
+	for id, st := range states {
+		batch.Put(p.producerKey(id), st.marshal())
+	}
+}
+
+// loadProducers loads the persisted state of the producers, the idle ones are deleted
+func (p *Partition) loadProducers() error {
+	p.producers.mu.Lock()
+	defer p.producers.mu.Unlock()
+
+	states, idle, err := p.readProducers(time.Now())
+	if err != nil {
+		return err
+	}
+	p.producers.states = states
+
+	if len(idle) == 0 {
+		return nil
+	}
+
+	return p.db.BatchDelete(idle)
+}
+
+// readProducers returns the persisted states of the producers by ID and the keys of the idle ones
+func (p *Partition) readProducers(now time.Time) (map[string]*producerState, [][]byte, error) {
+	prefix := p.producerKey("")
+	it := p.db.Iter(&storage.IterOptions{
+		FetchValues: true,
+		Prefix:      prefix,
+	})
+	defer it.Close()
+
+	states := map[string]*producerState{}
+	var idle [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		st, err := unmarshalProducerState(item.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if now.Sub(st.seen) >= ProducerIdleTimeout {
+			idle = append(idle, item.Key)
+			continue
+		}
+		states[string(item.Key[len(prefix):])] = st
+	}
+
+	return states, idle, it.Err()
+}
+
+// evictProducers deletes the state of the idle producers
+func (p *Partition) evictProducers() error {
+	p.producers.mu.Lock()
+	defer p.producers.mu.Unlock()
+
+	ids := p.producers.evict(time.Now())
+	if len(ids) == 0 {
+		return nil
+	}
+
+	keys := make([][]byte, len(ids))
+	for i, id := range ids {
+		keys[i] = p.producerKey(id)
+	}
+	return p.db.BatchDelete(keys)
+}
+
+// replayWAL rebuilds and persists the expiry marker from the whole WAL once it is restored from a backup,
+// future messages are tracked until they are due. The restored states of the producers are kept, the
+// state of the other producers is rebuilt from their messages. producers.mu should be held.
+func (p *Partition) replayWAL() error {
+	now := time.Now()
+	restored, _, err := p.readProducers(now)
+	if err != nil {
+		return err
+	}
+	p.producers.states = map[string]*producerState{}
+
+	batch := storage.NewWriteBatch()
+	var expiring bool
+	err = p.rangeFromWAL(nil, func(msg *sgproto.Message) error {
+		if restored[msg.ProducerId] == nil {
+			p.producers.track(msg, now)
+		}
+		p.setExpiry(msg)
+		if !expiring && p.markExpiring(batch, []*sgproto.Message{msg}) {
+			expiring = true
+		}
+		p.addDue([]*sgproto.Message{msg}, true)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.putProducers(batch, p.producers.states)
+	p.producers.install(restored)
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	if err := p.db.Write(batch); err != nil {
+		return err
+	}
+
+	if expiring {
+		p.setExpiring()
+	}
+	return nil
+}
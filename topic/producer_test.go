@@ -0,0 +1,122 @@
+package topic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentProducer(t *testing.T) {
+	db := mustNewStore(t, sgproto.StorageDriver_Memory, "")
+	defer db.Close()
+
+	newPartition := func() *Partition {
+		p := &Partition{
+			Id: "test",
+			topic: &Topic{
+				Kind: sgproto.TopicKind_TimerKind,
+			},
+		}
+		err := p.InitStore(db)
+		require.Nil(t, err)
+		return p
+	}
+
+	batch := func(sequence uint64, n int) []*sgproto.Message {
+		var msgs []*sgproto.Message
+		for i := 0; i < n; i++ {
+			msgs = append(msgs, &sgproto.Message{
+				ProducerId: "producer",
+				Sequence:   sequence,
+				Value:      []byte{byte(i)},
+			})
+		}
+		return msgs
+	}
+
+	offsets := func(msgs []*sgproto.Message) (res []sgproto.Offset) {
+		for _, msg := range msgs {
+			res = append(res, msg.Offset)
+		}
+		return res
+	}
+
+	p := newPartition()
+
+	first := batch(1, 2)
+	err := p.BatchPutMessages(first)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), p.lastIndex)
+
+	resent := batch(1, 2)
+	err = p.BatchPutMessages(resent)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), p.lastIndex, "a resent batch should not be stored twice")
+	require.Equal(t, offsets(first), offsets(resent))
+
+	err = p.BatchPutMessages(batch(3, 1))
+	require.Equal(t, ErrOutOfOrderSequence, err)
+
+	second := batch(2, 1)
+	err = p.BatchPutMessages(second)
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), p.lastIndex)
+
+	err = p.BatchPutMessages(batch(1, 2))
+	require.Equal(t, ErrDuplicateSequence, err)
+
+	err = p.BatchPutMessages([]*sgproto.Message{{ProducerId: "other", Sequence: 42}})
+	require.Nil(t, err, "the first batch of a producer can have any sequence")
+	require.Nil(t, p.Close())
+
+	// the state of the producers is persisted, the WAL is not needed to load it
+	err = db.Truncate(p.prependPrefixWAL(nil), p.prependPrefixWAL(nil), 1000)
+	require.Nil(t, err)
+	require.Nil(t, db.LastKeyForPrefix(p.prependPrefixWAL(nil)))
+
+	p = newPartition()
+	defer p.Close()
+
+	resent = batch(2, 1)
+	err = p.BatchPutMessages(resent)
+	require.Nil(t, err)
+	require.Equal(t, offsets(second), offsets(resent))
+}
+
+func TestIdleProducers(t *testing.T) {
+	defer func(timeout time.Duration) { ProducerIdleTimeout = timeout }(ProducerIdleTimeout)
+	ProducerIdleTimeout = 50 * time.Millisecond
+
+	p := newTestPartition(t, &Topic{
+		Kind: sgproto.TopicKind_TimerKind,
+	}, sgproto.StorageDriver_Memory)
+
+	msg := func(producer string) *sgproto.Message {
+		return &sgproto.Message{ProducerId: producer, Sequence: 1, Value: []byte("value")}
+	}
+
+	err := p.PutMessage(msg("idle"))
+	require.Nil(t, err)
+	time.Sleep(2 * ProducerIdleTimeout)
+	err = p.PutMessage(msg("active"))
+	require.Nil(t, err)
+
+	err = p.evictProducers()
+	require.Nil(t, err)
+
+	val, err := p.db.Get(p.producerKey("idle"))
+	require.Nil(t, err)
+	require.Nil(t, val, "the state of an idle producer should be deleted")
+
+	resent := msg("idle")
+	err = p.PutMessage(resent)
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), resent.Index, "a batch resent by an evicted producer should be stored again")
+
+	resent = msg("active")
+	err = p.PutMessage(resent)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), resent.Index, "a batch resent by an active producer should not be stored again")
+}
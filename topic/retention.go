@@ -0,0 +1,137 @@
+package topic
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+// RetentionCheckInterval is the interval between two reaping rounds of a partition
+var RetentionCheckInterval = 30 * time.Second
+
+var errStopReaping = errors.New("errStopReaping")
+
+// CommittedOffsetFunc returns the lowest offset committed by the consumer groups of a channel.
+// Messages after this offset are still in flight and must be retained.
+// sgproto.MaxOffset is expected when no consumer group consumes the channel.
+type CommittedOffsetFunc func(topic, partition, channel string) (sgproto.Offset, error)
+
+// SetCommittedOffsetFunc should be called before InitStore
+func (t *Topic) SetCommittedOffsetFunc(fn CommittedOffsetFunc) {
+	t.committedOffset = fn
+}
+
+func (t *Topic) hasRetention() bool {
+	return t.RetentionMaxAge > 0 || t.RetentionMaxBytes > 0
+}
+
+func (p *Partition) reapLoop() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case <-p.ctxPending.Done():
+				return
+			case <-time.After(RetentionCheckInterval):
+				n, err := p.Reap()
+				if err != nil {
+					p.logger.WithError(err).Debugf("error while reaping partition")
+					continue
+				}
+
+				if n > 0 {
+					p.logger.WithField("msgs_reaped", n).Debugf("reaped %d messages", n)
+				}
+			}
+		}
+	}()
+}
+
+// Reap deletes the messages exceeding the retention settings of the topic and the expired ones.
+// Only messages below the HW mark and committed by every consumer group are deleted,
+// the message at the HW mark is always kept so that the end of the log is preserved.
+func (p *Partition) Reap() (int, error) {
+	t := p.topic
+	hwMark := p.HWMark()
+	if (!t.hasRetention() && !p.hasExpiring()) || hwMark == 0 {
+		return 0, nil
+	}
+
+	var size int64
+	if t.RetentionMaxBytes > 0 {
+		err := p.rangeFromWAL(nil, func(msg *sgproto.Message) error {
+			size += int64(msg.Size())
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var (
+		now    = time.Now().UTC()
+		cutoff = now.Add(-t.RetentionMaxAge)
+		floors = map[string]sgproto.Offset{}
+		keys   [][]byte
+		reaped int
+	)
+
+	flush := func() error {
+		err := p.db.BatchDelete(keys)
+		keys = keys[:0]
+		return err
+	}
+
+	err := p.rangeFromWAL(nil, func(msg *sgproto.Message) error {
+		if msg.Index >= hwMark {
+			return errStopReaping
+		}
+
+		expired := (t.RetentionMaxAge > 0 && msg.Offset.Time().Before(cutoff)) || Expired(msg, now)
+		oversized := t.RetentionMaxBytes > 0 && size > t.RetentionMaxBytes
+		if !expired && !oversized {
+			return nil
+		}
+
+		floor, ok := floors[msg.Channel]
+		if !ok {
+			floor = sgproto.MaxOffset
+			if t.committedOffset != nil {
+				var err error
+				floor, err = t.committedOffset(t.Name, p.Id, msg.Channel)
+				if err != nil {
+					return err
+				}
+			}
+			floors[msg.Channel] = floor
+		}
+
+		if bytes.Compare(msg.Offset[:], floor[:]) > 0 { // still in flight
+			return nil
+		}
+
+		keys = append(keys, p.newWALKey(msg), p.getStorageKey(msg))
+		size -= int64(msg.Size())
+		reaped++
+
+		if len(keys) >= 1000 {
+			return flush()
+		}
+
+		return nil
+	})
+	if err != nil && err != errStopReaping {
+		return 0, err
+	}
+
+	if len(keys) > 0 {
+		if err := flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return reaped, nil
+}
@@ -0,0 +1,40 @@
+package topic
+
+import (
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+// StorageStats returns the approximate statistics of the storage shared by the partitions of the topic
+func (t *Topic) StorageStats() (*sgproto.StorageStats, error) {
+	stats, err := t.db.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sgproto.StorageStats{
+		StorageDriver: t.StorageDriver,
+		DiskBytes:     stats.DiskBytes,
+		Properties:    stats.Properties,
+	}, nil
+}
+
+// Stats counts the entries of the WAL and of the view of the partition, every channel included
+func (p *Partition) Stats() (*sgproto.PartitionStats, error) {
+	wal, err := p.db.PrefixStats(p.prependPrefixWAL(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := p.db.PrefixStats(p.prependPrefixView(""))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sgproto.PartitionStats{
+		Partition:   p.Id,
+		WalEntries:  wal.Keys,
+		WalBytes:    wal.Bytes,
+		ViewEntries: view.Keys,
+		ViewBytes:   view.Bytes,
+	}, nil
+}
@@ -0,0 +1,39 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, driver sgproto.StorageDriver) {
+		p := newTestPartition(t, &Topic{
+			Name: "stats",
+			Kind: sgproto.TopicKind_TimerKind,
+		}, driver)
+
+		for i := 0; i < 5; i++ {
+			err := p.PutMessage(&sgproto.Message{Value: []byte("value")})
+			require.Nil(t, err)
+		}
+
+		err := p.WalToView(0, 3)
+		require.Nil(t, err)
+
+		stats, err := p.Stats()
+		require.Nil(t, err)
+		require.Equal(t, "test", stats.Partition)
+		require.Equal(t, uint64(5), stats.WalEntries)
+		require.Equal(t, uint64(3), stats.ViewEntries)
+		require.True(t, stats.WalBytes > stats.ViewBytes)
+
+		st, err := p.db.Stats()
+		require.Nil(t, err)
+		require.NotEmpty(t, st.Properties)
+		if driver == sgproto.StorageDriver_Bolt {
+			require.True(t, st.DiskBytes > 0)
+		}
+	})
+}
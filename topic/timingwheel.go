@@ -0,0 +1,149 @@
+package topic
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+)
+
+// wheelEntry is a message waiting in the timing wheel until it is due
+type wheelEntry struct {
+	channel string
+	offset  sgproto.Offset
+}
+
+func (e wheelEntry) due() int64 {
+	return e.offset.Time().UnixNano() / int64(time.Millisecond)
+}
+
+// wheelBucket holds the entries of a slot of a wheel, expiration is the start of the time span
+// they were added for or -1 when the bucket is empty
+type wheelBucket struct {
+	expiration int64
+	entries    []wheelEntry
+	index      int
+}
+
+// bucketQueue orders the non-empty buckets of every level of a timing wheel by expiration,
+// the next wakeup is the one of its first bucket
+type bucketQueue []*wheelBucket
+
+func (q bucketQueue) Len() int           { return len(q) }
+func (q bucketQueue) Less(i, j int) bool { return q[i].expiration < q[j].expiration }
+func (q bucketQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *bucketQueue) Push(x interface{}) {
+	b := x.(*wheelBucket)
+	b.index = len(*q)
+	*q = append(*q, b)
+}
+
+func (q *bucketQueue) Pop() interface{} {
+	old := *q
+	b := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return b
+}
+
+// timingWheel is a hierarchical timing wheel in milliseconds. Each level covers size times the span of a
+// bucket of the level below it, the entries of an upper level are moved down as their bucket expires until
+// they reach a bucket of a single tick. Adding an entry is constant time and the wheel only wakes up for
+// non-empty buckets. It is not safe for concurrent use.
+type timingWheel struct {
+	tick     int64
+	size     int64
+	interval int64
+	current  int64
+	buckets  []*wheelBucket
+	queue    *bucketQueue
+	overflow *timingWheel
+}
+
+func newTimingWheel(tick time.Duration, size int, now time.Time) *timingWheel {
+	ms := int64(tick / time.Millisecond)
+	return newWheelLevel(ms, int64(size), now.UnixNano()/int64(time.Millisecond), &bucketQueue{})
+}
+
+func newWheelLevel(tick, size, start int64, queue *bucketQueue) *timingWheel {
+	w := &timingWheel{
+		tick:     tick,
+		size:     size,
+		interval: tick * size,
+		current:  start - start%tick,
+		buckets:  make([]*wheelBucket, size),
+		queue:    queue,
+	}
+	for i := range w.buckets {
+		w.buckets[i] = &wheelBucket{expiration: -1}
+	}
+
+	return w
+}
+
+// add places the entry in the wheel, it returns false when the entry is already due
+func (w *timingWheel) add(e wheelEntry) bool {
+	due := e.due()
+	switch {
+	case due < w.current+w.tick:
+		return false
+	case due < w.current+w.interval:
+		slot := due / w.tick
+		b := w.buckets[slot%w.size]
+		b.entries = append(b.entries, e)
+
+		// a bucket is queued again only once it was flushed
+		if expiration := slot * w.tick; b.expiration != expiration {
+			b.expiration = expiration
+			heap.Push(w.queue, b)
+		}
+		return true
+	default:
+		if w.overflow == nil {
+			w.overflow = newWheelLevel(w.interval, w.size, w.current, w.queue)
+		}
+		return w.overflow.add(e)
+	}
+}
+
+func (w *timingWheel) advance(to int64) {
+	if to >= w.current+w.tick {
+		w.current = to - to%w.tick
+		if w.overflow != nil {
+			w.overflow.advance(w.current)
+		}
+	}
+}
+
+// expire calls fn for each entry due at now, the entries of the expired buckets of the upper levels
+// which are not due yet are moved to the lower levels
+func (w *timingWheel) expire(now time.Time, fn func(e wheelEntry)) {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	for w.queue.Len() > 0 && (*w.queue)[0].expiration <= ms {
+		b := heap.Pop(w.queue).(*wheelBucket)
+		w.advance(b.expiration)
+
+		entries := b.entries
+		b.entries = nil
+		b.expiration = -1
+		for _, e := range entries {
+			if !w.add(e) {
+				fn(e)
+			}
+		}
+	}
+	w.advance(ms)
+}
+
+// next returns the time of the next bucket to expire, false when the wheel is empty
+func (w *timingWheel) next() (time.Time, bool) {
+	if w.queue.Len() == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, (*w.queue)[0].expiration*int64(time.Millisecond)), true
+}
@@ -0,0 +1,48 @@
+package topic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimingWheel(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	w := newTimingWheel(time.Millisecond, 8, start)
+
+	// spread over the first three levels of 8ms, 64ms and 512ms buckets
+	delays := []time.Duration{300 * time.Millisecond, 5 * time.Millisecond, 40 * time.Millisecond, 0, 5 * time.Millisecond}
+	for i, d := range delays {
+		e := wheelEntry{channel: "master", offset: sgproto.NewOffset(uint64(i+1), start.Add(d))}
+		require.Equal(t, d > 0, w.add(e), "an entry due now should not be added")
+	}
+
+	next, ok := w.next()
+	require.True(t, ok)
+	require.Equal(t, start.Add(5*time.Millisecond), next)
+
+	var (
+		fired []uint64
+		now   time.Time
+	)
+	fire := func(e wheelEntry) {
+		require.False(t, e.offset.Time().After(now), "entries should not fire before they are due")
+		fired = append(fired, e.offset.Index())
+	}
+
+	for _, at := range []time.Duration{4 * time.Millisecond, 5 * time.Millisecond, 39 * time.Millisecond, 299 * time.Millisecond} {
+		now = start.Add(at)
+		w.expire(now, fire)
+	}
+	require.Equal(t, []uint64{2, 5, 3}, fired)
+
+	now = start.Add(time.Second)
+	w.expire(now, fire)
+	require.Equal(t, []uint64{2, 5, 3, 1}, fired)
+
+	_, ok = w.next()
+	require.False(t, ok)
+	require.False(t, w.add(wheelEntry{offset: sgproto.NewOffset(6, start.Add(time.Second))}))
+}
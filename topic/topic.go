@@ -4,13 +4,18 @@ import (
 	"math/rand"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"fmt"
 
 	"github.com/sandglass/sandglass-grpc/go/sgproto"
+	"github.com/sandglass/sandglass/compression"
 	"github.com/sandglass/sandglass/sgutils"
 	"github.com/sandglass/sandglass/storage"
 	"github.com/sandglass/sandglass/storage/badger"
+	"github.com/sandglass/sandglass/storage/bolt"
+	"github.com/sandglass/sandglass/storage/encrypted"
+	"github.com/sandglass/sandglass/storage/memory"
 	"github.com/sandglass/sandglass/storage/rocksdb"
 	"golang.org/x/sync/errgroup"
 )
@@ -23,8 +28,40 @@ type Topic struct {
 	Partitions        []*Partition
 	StorageDriver     sgproto.StorageDriver
 
-	basepath string
-	db       storage.Storage
+	// Retention of TimerKind topics, zero values disable it
+	RetentionMaxAge   time.Duration
+	RetentionMaxBytes int64
+
+	// CompactByKey makes the compaction of KV topics keep a single version per key
+	// instead of one per key and clustering key
+	CompactByKey bool
+
+	// BloomFalsePositiveRate of the filters used by HasKey on KV topics,
+	// DefaultBloomFalsePositiveRate is used when zero
+	BloomFalsePositiveRate float64
+
+	// CompressionCodec applied to the values of stored messages
+	CompressionCodec sgproto.CompressionCodec
+
+	// Encrypted topics have their values encrypted at rest with the keyring of the broker
+	Encrypted bool
+
+	// StorageOptions override the storage options of the brokers for this topic
+	StorageOptions storage.Options
+
+	// Partitioner of the messages produced without partition, see DefaultPartitioner
+	Partitioner sgproto.Partitioner
+
+	// ExpiredChannel receives a copy of the expired messages skipped by the consumer groups,
+	// they are only acknowledged when empty
+	ExpiredChannel string
+
+	basepath        string
+	db              storage.Storage
+	committedOffset CommittedOffsetFunc
+	keyring         *encrypted.Keyring
+	defaultOptions  storage.Options
+	roundRobin      uint32
 }
 
 func (t *Topic) Validate() error {
@@ -37,11 +74,48 @@ func (t *Topic) Validate() error {
 	if t.NumPartitions < 1 {
 		return fmt.Errorf("number of partitions should not be > 0")
 	}
+	if t.RetentionMaxAge < 0 || t.RetentionMaxBytes < 0 {
+		return fmt.Errorf("retention settings should not be negative")
+	}
+	if t.Kind != sgproto.TopicKind_TimerKind && t.hasRetention() {
+		return fmt.Errorf("retention is only supported by timer topics")
+	}
+	if t.Kind != sgproto.TopicKind_KVKind && t.CompactByKey {
+		return fmt.Errorf("compaction is only supported by KV topics")
+	}
+	if t.BloomFalsePositiveRate < 0 || t.BloomFalsePositiveRate >= 1 {
+		return fmt.Errorf("bloom false positive rate should be between 0 and 1")
+	}
+	if _, err := compression.Get(t.CompressionCodec); err != nil {
+		return fmt.Errorf("unknown compression codec: %v", t.CompressionCodec)
+	}
+	if _, ok := sgproto.Partitioner_name[int32(t.Partitioner)]; !ok {
+		return fmt.Errorf("unknown partitioner: %v", t.Partitioner)
+	}
+	if err := t.StorageOptions.Validate(); err != nil {
+		return fmt.Errorf("invalid storage options: %v", err)
+	}
 
 	return nil
 }
 
 func (t *Topic) InitStore(basePath string) error {
+	if err := t.openStore(basePath); err != nil {
+		return err
+	}
+
+	for _, p := range t.Partitions {
+		err := t.initPartition(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openStore opens the storage of the topic without initializing its partitions
+func (t *Topic) openStore(basePath string) error {
 	msgdir := filepath.Join(basePath, t.Name)
 	t.basepath = msgdir
 
@@ -53,12 +127,18 @@ func (t *Topic) InitStore(basePath string) error {
 		return fmt.Errorf("Num partitions should be > 0")
 	}
 
+	opts := t.defaultOptions.Override(t.StorageOptions)
+
 	var err error
 	switch t.StorageDriver {
 	case sgproto.StorageDriver_Badger:
-		t.db, err = badger.NewStorage(msgdir)
+		t.db, err = badger.NewStorage(msgdir, opts)
 	case sgproto.StorageDriver_RocksDB:
-		t.db, err = rocksdb.NewStorage(msgdir)
+		t.db, err = rocksdb.NewStorage(msgdir, opts)
+	case sgproto.StorageDriver_Memory:
+		t.db, err = memory.NewStorage()
+	case sgproto.StorageDriver_Bolt:
+		t.db, err = bolt.NewStorage(msgdir, opts)
 	default:
 		return fmt.Errorf("unknown storage driver: %v for topic: %v", t.StorageDriver, t.Name)
 	}
@@ -66,8 +146,13 @@ func (t *Topic) InitStore(basePath string) error {
 		return err
 	}
 
-	for _, p := range t.Partitions {
-		err := t.initPartition(p)
+	if t.Encrypted {
+		if t.keyring == nil {
+			t.db.Close()
+			return fmt.Errorf("topic %v is encrypted but no keyring is configured", t.Name)
+		}
+
+		t.db, err = encrypted.NewStorage(t.db, t.keyring)
 		if err != nil {
 			return err
 		}
@@ -76,6 +161,17 @@ func (t *Topic) InitStore(basePath string) error {
 	return nil
 }
 
+// SetKeyring should be called before InitStore, it is required by encrypted topics
+func (t *Topic) SetKeyring(keyring *encrypted.Keyring) {
+	t.keyring = keyring
+}
+
+// SetDefaultStorageOptions should be called before InitStore,
+// the storage options of the topic take precedence over them
+func (t *Topic) SetDefaultStorageOptions(opts storage.Options) {
+	t.defaultOptions = opts
+}
+
 func (t *Topic) initPartition(p *Partition) error {
 	p.topic = t
 	err := p.InitStore(t.db)